@@ -1,13 +1,14 @@
 package app
 
 import (
-	"fmt"
+	"encoding/hex"
 	"strings"
 
 	wrsp "github.com/tepleton/wrsp/types"
 	sm "github.com/tepleton/basecoin/state"
 	"github.com/tepleton/basecoin/types"
 	. "github.com/tepleton/go-common"
+	"github.com/tepleton/go-events"
 	"github.com/tepleton/go-wire"
 	eyes "github.com/tepleton/merkleeyes/client"
 )
@@ -24,19 +25,31 @@ type Basecoin struct {
 	state      *sm.State
 	cacheState *sm.State
 	plugins    *types.Plugins
+	migrations *types.Migrations
+	evsw       events.EventSwitch
 }
 
 func NewBasecoin(eyesCli *eyes.Client) *Basecoin {
-	state := sm.NewState(eyesCli)
+	state := sm.NewState(sm.NewEyesStore(eyesCli))
 	plugins := types.NewPlugins()
+	evsw := events.NewEventSwitch()
+	evsw.Start()
 	return &Basecoin{
 		eyesCli:    eyesCli,
 		state:      state,
 		cacheState: nil,
 		plugins:    plugins,
+		migrations: types.NewMigrations(),
+		evsw:       evsw,
 	}
 }
 
+// Subscribe to account, tx, block and plugin events.
+// See types/events.go for the event strings.
+func (app *Basecoin) EventSwitch() events.EventSwitch {
+	return app.evsw
+}
+
 // TMSP::Info
 func (app *Basecoin) Info() wrsp.ResponseInfo {
 	return wrsp.ResponseInfo{Data: Fmt("Basecoin v%v", version)}
@@ -44,6 +57,13 @@ func (app *Basecoin) Info() wrsp.ResponseInfo {
 
 func (app *Basecoin) RegisterPlugin(plugin types.Plugin) {
 	app.plugins.RegisterPlugin(plugin)
+	app.setPluginSchemaVersions(app.state)
+}
+
+// Reaches the stores of the app's plugins, see state.Host.
+// Give it only to the plugins that need it, like the IBC plugin.
+func (app *Basecoin) Host() sm.Host {
+	return sm.NewHost(app.plugins)
 }
 
 // TMSP::SetOption
@@ -55,7 +75,7 @@ func (app *Basecoin) SetOption(key string, value string) (log string) {
 		if plugin == nil {
 			return "Invalid plugin name: " + PluginName
 		}
-		return plugin.SetOption(app.state, key, value)
+		return plugin.SetOption(sm.NewPluginStore(app.state, app.plugins, plugin), key, value)
 	} else {
 		// Set option on basecoin
 		switch key {
@@ -71,6 +91,39 @@ func (app *Basecoin) SetOption(key string, value string) (log string) {
 			}
 			app.state.SetAccount(acc.PubKey.Address(), acc)
 			return "Success"
+		case "gas":
+			var err error
+			var config types.GasConfig
+			wire.ReadJSONPtr(&config, []byte(value), &err)
+			if err != nil {
+				return "Error decoding gas config: " + err.Error()
+			}
+			sm.SetGasConfig(app.state, config)
+			return "Success"
+		case "minFee":
+			var err error
+			var fees types.Coins
+			wire.ReadJSONPtr(&fees, []byte(value), &err)
+			if err != nil {
+				return "Error decoding minimum fees: " + err.Error()
+			}
+			if !fees.IsValid() || !fees.IsNonnegative() {
+				return "Invalid minimum fees: " + value
+			}
+			sm.SetMinFees(app.state, fees)
+			return "Success"
+		case "minGasPrice":
+			var err error
+			var prices types.Coins
+			wire.ReadJSONPtr(&prices, []byte(value), &err)
+			if err != nil {
+				return "Error decoding minimum gas prices: " + err.Error()
+			}
+			if !prices.IsValid() || !prices.IsNonnegative() {
+				return "Invalid minimum gas prices: " + value
+			}
+			sm.SetMinGasPrices(app.state, prices)
+			return "Success"
 		}
 		return "Unrecognized option key " + key
 	}
@@ -79,39 +132,35 @@ func (app *Basecoin) SetOption(key string, value string) (log string) {
 // TMSP::DeliverTx
 func (app *Basecoin) DeliverTx(txBytes []byte) (res wrsp.Result) {
 	if len(txBytes) > maxTxSize {
-		return wrsp.CodeType_BaseEncodingError, nil, "Tx size exceeds maximum"
+		return wrsp.ErrBaseEncodingError.AppendLog("Tx size exceeds maximum")
 	}
 
 	// Decode tx
 	var tx types.Tx
 	err := wire.ReadBinaryBytes(txBytes, &tx)
 	if err != nil {
-		return wrsp.CodeType_BaseEncodingError, nil, "Error decoding tx: " + err.Error()
+		return wrsp.ErrBaseEncodingError.AppendLog("Error decoding tx: " + err.Error())
 	}
 
 	// Validate and exec tx
-	res = sm.ExecTx(app.state, app.plugins, tx, false, nil)
+	res = sm.ExecTx(app.state, app.plugins, tx, false, app.evsw)
 	if res.IsErr() {
 		return res.PrependLog("Error in DeliverTx")
 	}
-	// Store accounts
-	storeAccounts(app.eyesCli, accs)
-	return wrsp.CodeType_OK, nil, "Success"
+	return res
 }
 
 // TMSP::CheckTx
-func (app *Basecoin) CheckTx(txBytes []byte) (code wrsp.CodeType, result []byte, log string) {
+func (app *Basecoin) CheckTx(txBytes []byte) (res wrsp.Result) {
 	if len(txBytes) > maxTxSize {
-		return wrsp.CodeType_BaseEncodingError, nil, "Tx size exceeds maximum"
+		return wrsp.ErrBaseEncodingError.AppendLog("Tx size exceeds maximum")
 	}
 
-	fmt.Printf("%X\n", txBytes)
-
 	// Decode tx
 	var tx types.Tx
 	err := wire.ReadBinaryBytes(txBytes, &tx)
 	if err != nil {
-		return wrsp.CodeType_BaseEncodingError, nil, "Error decoding tx: " + err.Error()
+		return wrsp.ErrBaseEncodingError.AppendLog("Error decoding tx: " + err.Error())
 	}
 
 	// Validate tx
@@ -119,23 +168,93 @@ func (app *Basecoin) CheckTx(txBytes []byte) (code wrsp.CodeType, result []byte,
 	if res.IsErr() {
 		return res.PrependLog("Error in CheckTx")
 	}
-	return wrsp.CodeType_OK, nil, "Success"
+	return wrsp.OK
 }
 
 // TMSP::Query
+// Routes on reqQuery.Path:
+//
+//	/key, /store               raw key in reqQuery.Data, forwarded to MerkleEyes
+//	/account/<address hex>     go-wire encoded types.Account
+//	/plugin/<name>/<subpath>   answered by the plugin, see types.Querier
 func (app *Basecoin) Query(reqQuery wrsp.RequestQuery) (resQuery wrsp.ResponseQuery) {
-	if len(reqQuery.Data) == 0 {
+	switch prefix, suffix := splitPath(reqQuery.Path); prefix {
+	case "", "key", "store":
+		return app.queryKey(reqQuery.Data, reqQuery.Prove)
+	case "account":
+		addr, err := hex.DecodeString(suffix)
+		if err != nil {
+			resQuery.Log = "Invalid address hex: " + err.Error()
+			resQuery.Code = wrsp.CodeType_EncodingError
+			return
+		}
+		return app.queryKey(sm.AccountKey(addr), reqQuery.Prove)
+	case "plugin":
+		return app.queryPlugin(suffix, reqQuery)
+	default:
+		resQuery.Log = "Unknown query path " + reqQuery.Path
+		resQuery.Code = wrsp.CodeType_UnknownRequest
+		return
+	}
+}
+
+func (app *Basecoin) queryKey(key []byte, prove bool) (resQuery wrsp.ResponseQuery) {
+	if len(key) == 0 {
 		resQuery.Log = "Query cannot be zero length"
 		resQuery.Code = wrsp.CodeType_EncodingError
 		return
 	}
 
-	resQuery, err := app.eyesCli.QuerySync(reqQuery)
+	resQuery, err := app.eyesCli.QuerySync(wrsp.RequestQuery{
+		Path:  "/key",
+		Data:  key,
+		Prove: prove,
+	})
 	if err != nil {
 		resQuery.Log = "Failed to query MerkleEyes: " + err.Error()
 		resQuery.Code = wrsp.CodeType_InternalError
 		return
 	}
+	// Clients need the key to verify the proof
+	resQuery.Key = key
+	return
+}
+
+// If the plugin sets resQuery.Key, it is returned under the plugin's prefix,
+// and if a proof was requested, with the raw stored value and its proof.
+func (app *Basecoin) queryPlugin(path string, reqQuery wrsp.RequestQuery) (resQuery wrsp.ResponseQuery) {
+	name, subpath := splitPath(path)
+	plugin := app.plugins.GetByName(name)
+	if plugin == nil {
+		resQuery.Log = "Invalid plugin name: " + name
+		resQuery.Code = wrsp.CodeType_UnknownRequest
+		return
+	}
+	querier, ok := plugin.(types.Querier)
+	if !ok {
+		resQuery.Log = Fmt("Plugin %v does not support queries", name)
+		resQuery.Code = wrsp.CodeType_UnknownRequest
+		return
+	}
+
+	// Queries read the committed state, like the proofs of queryKey.
+	// They are read-only, so the cache is never synced.
+	reqQuery.Path = "/" + subpath
+	committed := sm.NewCommittedStore(app.eyesCli)
+	store := sm.NewPluginStore(types.NewKVCache(committed), app.plugins, plugin)
+	resQuery = querier.Query(store, reqQuery)
+	if err := committed.Err(); err != nil {
+		resQuery = wrsp.ResponseQuery{}
+		resQuery.Log = "Failed to query MerkleEyes: " + err.Error()
+		resQuery.Code = wrsp.CodeType_InternalError
+		return
+	}
+	if len(resQuery.Key) > 0 {
+		resQuery.Key = append(store.Prefix(), resQuery.Key...)
+	}
+	if resQuery.Code.IsOK() && reqQuery.Prove && len(resQuery.Key) > 0 {
+		return app.queryKey(resQuery.Key, true)
+	}
 	return
 }
 
@@ -151,34 +270,43 @@ func (app *Basecoin) Commit() (res wrsp.Result) {
 	if res.IsErr() {
 		PanicSanity("Error getting hash: " + res.Error())
 	}
-	return hash, "Success"
+	return res
 }
 
 // TMSP::InitChain
 func (app *Basecoin) InitChain(validators []*wrsp.Validator) {
 	for _, plugin := range app.plugins.GetList() {
-		plugin.InitChain(app.state, validators)
+		plugin.InitChain(sm.NewPluginStore(app.state, app.plugins, plugin), validators)
 	}
 }
 
 // TMSP::BeginBlock
 func (app *Basecoin) BeginBlock(height uint64) {
+	app.evsw.FireEvent(types.EventStringBeginBlock(), types.EventDataBlock{height})
+	sm.SetBlockHeight(app.state, height)
+	app.migrate(height)
 	for _, plugin := range app.plugins.GetList() {
-		plugin.BeginBlock(app.state, height)
+		plugin.BeginBlock(sm.NewPluginStoreWithEvents(app.state, app.plugins, plugin, nil, app.evsw), height)
 	}
 }
 
 // TMSP::EndBlock
 func (app *Basecoin) EndBlock(height uint64) (diffs []*wrsp.Validator) {
 	for _, plugin := range app.plugins.GetList() {
-		moreDiffs := plugin.EndBlock(app.state, height)
+		moreDiffs := plugin.EndBlock(sm.NewPluginStoreWithEvents(app.state, app.plugins, plugin, nil, app.evsw), height)
 		diffs = append(diffs, moreDiffs...)
 	}
+	app.evsw.FireEvent(types.EventStringEndBlock(), types.EventDataBlock{height})
 	return
 }
 
 //----------------------------------------
 
+// Splits a query path after its leading '/', at the next '/'.
+func splitPath(path string) (prefix string, suffix string) {
+	return splitKey(strings.TrimPrefix(path, "/"))
+}
+
 // Splits the string at the first '/'.
 // if there are none, the second string is nil.
 func splitKey(key string) (prefix string, suffix string) {
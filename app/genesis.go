@@ -1,63 +1,386 @@
 package app
 
 import (
+	"bytes"
+	"encoding/hex"
 	"encoding/json"
-	"fmt"
-	"reflect"
+	"sort"
 
 	"github.com/pkg/errors"
+	sm "github.com/tepleton/basecoin/state"
+	"github.com/tepleton/basecoin/types"
 	cmn "github.com/tepleton/go-common"
+	"github.com/tepleton/go-crypto"
+	"github.com/tepleton/go-wire"
 )
 
-func (app *Basecoin) LoadGenesis(path string) error {
-	kvz, err := loadGenesis(path)
+// Genesis is the document the app's state starts from.
+//
+//	{
+//	  "chain_id": "test_chain_id",
+//	  "accounts": [
+//	    {"pub_key": [1, "67D3B5EA..."], "coins": [{"denom": "mycoin", "amount": 1000}]}
+//	  ],
+//	  "plugins": {
+//	    "IBC": {"registration": "allowlist"}
+//	  }
+//	}
+type Genesis struct {
+	ChainID      string                     `json:"chain_id"`
+	Accounts     []GenesisAccount           `json:"accounts"`
+	TotalSupply  types.Coins                `json:"total_supply,omitempty"` // If set, the balances must add up to it
+	Gas          *types.GasConfig           `json:"gas,omitempty"`
+	MinFees      types.Coins                `json:"min_fees,omitempty"`
+	MinGasPrices types.Coins                `json:"min_gas_prices,omitempty"`
+	Plugins      map[string]json.RawMessage `json:"plugins,omitempty"`       // By plugin name, see types.GenesisInitializer
+	PluginStores map[string][]GenesisKV     `json:"plugin_stores,omitempty"` // By plugin name, see types.GenesisExporter
+}
+
+// GenesisKV is a key and value of a plugin's store, hex encoded.
+type GenesisKV struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// GenesisAccount is JSON encoded with go-wire, like the "base/account" option.
+type GenesisAccount struct {
+	Address  []byte        `json:"address"` // May be omitted if PubKey is set
+	PubKey   crypto.PubKey `json:"pub_key"` // May be nil, like for a module account
+	Sequence int           `json:"sequence"`
+	Balance  types.Coins   `json:"coins"`
+}
+
+type wireGenesisAccount GenesisAccount
+
+func (acc *GenesisAccount) UnmarshalJSON(data []byte) (err error) {
+	wire.ReadJSONPtr((*wireGenesisAccount)(acc), data, &err)
+	return err
+}
+
+func (acc GenesisAccount) MarshalJSON() ([]byte, error) {
+	return wire.JSONBytes(wireGenesisAccount(acc)), nil
+}
+
+// Returns the account's address, from its PubKey if it has one.
+func (acc GenesisAccount) GetAddress() ([]byte, error) {
+	if acc.PubKey == nil {
+		if len(acc.Address) != 20 {
+			return nil, errors.New("needs a pub_key or a 20 byte address")
+		}
+		return acc.Address, nil
+	}
+	addr := acc.PubKey.Address()
+	if len(acc.Address) > 0 && !bytes.Equal(acc.Address, addr) {
+		return nil, errors.Errorf("address %X does not match its pub_key", acc.Address)
+	}
+	return addr, nil
+}
+
+func ReadGenesis(path string) (*Genesis, error) {
+	jsonBytes, err := cmn.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading genesis file")
+	}
+	var gen Genesis
+	err = json.Unmarshal(jsonBytes, &gen)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing genesis file")
+	}
+	return &gen, nil
+}
+
+// Checks everything that doesn't depend on the registered plugins.
+func (gen *Genesis) ValidateBasic() error {
+	if gen.ChainID == "" {
+		return errors.New("genesis has no chain_id")
+	}
+	seen := make(map[string]bool)
+	for i, acc := range gen.Accounts {
+		addr, err := acc.GetAddress()
+		if err != nil {
+			return errors.Wrapf(err, "genesis account %v", i)
+		}
+		if seen[string(addr)] {
+			return errors.Errorf("genesis account %X is listed twice", addr)
+		}
+		seen[string(addr)] = true
+		if !acc.Balance.IsValid() || !acc.Balance.IsNonnegative() {
+			return errors.Errorf("genesis account %X has invalid coins %v", addr, acc.Balance)
+		}
+	}
+	supply, err := gen.Supply()
 	if err != nil {
 		return err
 	}
-	for _, kv := range kvz {
-		log := app.SetOption(kv.Key, kv.Value)
-		// TODO: remove debug output
-		fmt.Printf("Set %v=%v. Log: %v", kv.Key, kv.Value, log)
+	if gen.TotalSupply != nil && !supply.IsEqual(gen.TotalSupply) {
+		return errors.Errorf("genesis balances add up to %v, not the total_supply %v", supply, gen.TotalSupply)
+	}
+	if !gen.MinFees.IsValid() || !gen.MinFees.IsNonnegative() {
+		return errors.Errorf("genesis has invalid min_fees %v", gen.MinFees)
+	}
+	if !gen.MinGasPrices.IsValid() || !gen.MinGasPrices.IsNonnegative() {
+		return errors.Errorf("genesis has invalid min_gas_prices %v", gen.MinGasPrices)
+	}
+	for name, kvs := range gen.PluginStores {
+		for _, kv := range kvs {
+			_, errKey := hex.DecodeString(kv.Key)
+			_, errValue := hex.DecodeString(kv.Value)
+			if errKey != nil || errValue != nil || len(kv.Key) == 0 {
+				return errors.Errorf("genesis store of plugin %v has invalid key %v", name, kv.Key)
+			}
+		}
 	}
 	return nil
 }
 
-type keyValue struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+// Adds up the balances of the accounts, which must be nonnegative.
+func (gen *Genesis) Supply() (types.Coins, error) {
+	totals := make(map[string]int64)
+	for _, acc := range gen.Accounts {
+		for _, coin := range acc.Balance {
+			total := totals[coin.Denom] + coin.Amount
+			if total < totals[coin.Denom] {
+				return nil, errors.Errorf("genesis supply of %v overflows", coin.Denom)
+			}
+			totals[coin.Denom] = total
+		}
+	}
+	denoms := make([]string, 0, len(totals))
+	for denom, total := range totals {
+		if total != 0 {
+			denoms = append(denoms, denom)
+		}
+	}
+	sort.Strings(denoms)
+	supply := types.Coins{}
+	for _, denom := range denoms {
+		supply = append(supply, types.Coin{denom, totals[denom]})
+	}
+	return supply, nil
 }
 
-func loadGenesis(filePath string) (kvz []keyValue, err error) {
-	kvz_ := []interface{}{}
-	bytes, err := cmn.ReadFile(filePath)
+//----------------------------------------
+
+func (app *Basecoin) LoadGenesis(path string) error {
+	gen, err := ReadGenesis(path)
 	if err != nil {
-		return nil, errors.Wrap(err, "loading genesis file")
+		return err
 	}
-	err = json.Unmarshal(bytes, &kvz_)
+	return app.InitGenesis(gen)
+}
+
+// Validates gen, then writes it to the state.
+// A plugin that implements types.GenesisInitializer is handed its section,
+// otherwise each field of its section is set with SetOption, which must
+// succeed. If anything fails, nothing is written.
+// The state is at the latest schema versions of the registered
+// migrations, so register them first.
+func (app *Basecoin) InitGenesis(gen *Genesis) (err error) {
+	err = gen.ValidateBasic()
 	if err != nil {
-		return nil, errors.Wrap(err, "parsing genesis file")
+		return err
 	}
-	if len(kvz_)%2 != 0 {
-		return nil, errors.New("genesis cannot have an odd number of items.  Format = [key1, value1, key2, value2, ...]")
+	options, err := app.genesisOptions(gen)
+	if err != nil {
+		return err
 	}
-	for i := 0; i < len(kvz_); i += 2 {
-		keyIfc := kvz_[i]
-		valueIfc := kvz_[i+1]
-		var key, value string
-		key, ok := keyIfc.(string)
+
+	cache := app.state.CacheWrap()
+	for _, acc := range gen.Accounts {
+		addr, _ := acc.GetAddress()
+		cache.SetAccount(addr, &types.Account{
+			PubKey:   acc.PubKey,
+			Sequence: acc.Sequence,
+			Balance:  acc.Balance,
+		})
+	}
+	app.setLatestSchemaVersions(cache)
+	app.setPluginSchemaVersions(cache)
+	defer func() {
+		if err != nil {
+			app.setPluginSchemaVersions(app.state)
+		}
+	}()
+	if gen.Gas != nil {
+		sm.SetGasConfig(cache, *gen.Gas)
+	}
+	if gen.MinFees != nil {
+		sm.SetMinFees(cache, gen.MinFees)
+	}
+	if gen.MinGasPrices != nil {
+		sm.SetMinGasPrices(cache, gen.MinGasPrices)
+	}
+	for _, plugin := range app.plugins.GetList() {
+		store := sm.NewPluginStore(cache, app.plugins, plugin)
+		for _, kv := range gen.PluginStores[plugin.Name()] {
+			key, _ := hex.DecodeString(kv.Key)
+			value, _ := hex.DecodeString(kv.Value)
+			store.Set(key, value)
+		}
+		section, ok := gen.Plugins[plugin.Name()]
 		if !ok {
-			return nil, errors.Errorf("genesis had invalid key %v of type %v", keyIfc, reflect.TypeOf(keyIfc))
+			continue
 		}
-		if value_, ok := valueIfc.(string); ok {
-			value = value_
-		} else {
-			valueBytes, err := json.Marshal(valueIfc)
+		if initer, ok := plugin.(types.GenesisInitializer); ok {
+			err := initer.InitGenesis(store, section)
 			if err != nil {
-				return nil, errors.Errorf("genesis had invalid value %v: %v", value_, err.Error())
+				return errors.Wrapf(err, "genesis of plugin %v", plugin.Name())
+			}
+			continue
+		}
+		for _, kv := range options[plugin.Name()] {
+			log := plugin.SetOption(store, kv.Key, kv.Value)
+			if log != "Success" {
+				return errors.Errorf("genesis of plugin %v, setting %v: %v", plugin.Name(), kv.Key, log)
+			}
+		}
+	}
+	cache.CacheSync()
+	app.state.SetChainID(gen.ChainID)
+	return nil
+}
+
+type keyValue struct {
+	Key   string
+	Value string
+}
+
+// Returns the options to set on the plugins without an InitGenesis,
+// by plugin name, in the order of their keys.
+// String values are set as they are, and any other value as JSON.
+func (app *Basecoin) genesisOptions(gen *Genesis) (map[string][]keyValue, error) {
+	for name := range gen.PluginStores {
+		if app.plugins.GetByName(name) == nil {
+			return nil, errors.Errorf("genesis has a store for unknown plugin %v", name)
+		}
+	}
+	names := make([]string, 0, len(gen.Plugins))
+	for name := range gen.Plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	options := make(map[string][]keyValue)
+	for _, name := range names {
+		plugin := app.plugins.GetByName(name)
+		if plugin == nil {
+			return nil, errors.Errorf("genesis has a section for unknown plugin %v", name)
+		}
+		if _, ok := plugin.(types.GenesisInitializer); ok {
+			continue
+		}
+		fields := make(map[string]json.RawMessage)
+		err := json.Unmarshal(gen.Plugins[name], &fields)
+		if err != nil {
+			return nil, errors.Wrapf(err, "genesis of plugin %v", name)
+		}
+		keys := make([]string, 0, len(fields))
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := string(fields[key])
+			var str string
+			if json.Unmarshal(fields[key], &str) == nil {
+				value = str
 			}
-			value = string(valueBytes)
+			options[name] = append(options[name], keyValue{key, value})
 		}
-		kvz = append(kvz, keyValue{key, value})
 	}
-	return kvz, nil
+	return options, nil
+}
+
+//----------------------------------------
+
+// Returns the committed state as a Genesis that InitGenesis reproduces it
+// from. A plugin that implements types.GenesisExporter exports its own
+// section, the keys of any other are exported as they are.
+// Every key must be exported, so all of the plugins must be registered.
+// A new chain starts at the latest schema versions, so all of the
+// registered migrations must have run.
+func (app *Basecoin) ExportGenesis(chainID string) (*Genesis, error) {
+	err := app.checkMigrated()
+	if err != nil {
+		return nil, err
+	}
+	gen := &Genesis{
+		ChainID:      chainID,
+		MinFees:      sm.GetMinFees(app.state),
+		MinGasPrices: sm.GetMinGasPrices(app.state),
+		Plugins:      make(map[string]json.RawMessage),
+		PluginStores: make(map[string][]GenesisKV),
+	}
+	if len(app.state.Get(sm.GasConfigKey())) > 0 {
+		config := sm.GetGasConfig(app.state)
+		gen.Gas = &config
+	}
+
+	accountPrefix := sm.AccountKey(nil)
+	iter := app.state.Iterator(nil, nil)
+	defer iter.Close()
+	for ; iter.Valid(); iter.Next() {
+		key := iter.Key()
+		switch {
+		case bytes.HasPrefix(key, accountPrefix):
+			acc, err := sm.ReadAccount(iter.Value())
+			if err != nil {
+				return nil, errors.Wrapf(err, "reading account %X", key[len(accountPrefix):])
+			}
+			gen.Accounts = append(gen.Accounts, GenesisAccount{
+				Address:  key[len(accountPrefix):],
+				PubKey:   acc.PubKey,
+				Sequence: acc.Sequence,
+				Balance:  acc.Balance,
+			})
+		case bytes.Equal(key, sm.GasConfigKey()), bytes.Equal(key, sm.MinFeesKey()),
+			bytes.Equal(key, sm.MinGasPricesKey()), bytes.Equal(key, sm.BlockHeightKey()),
+			bytes.HasPrefix(key, types.SchemaVersionKey("")):
+			// Exported above, or not part of a genesis
+		default:
+			plugin := app.pluginOfKey(key)
+			if plugin == nil {
+				return nil, errors.Errorf("key %X belongs to no registered plugin", key)
+			}
+			if _, ok := plugin.(types.GenesisExporter); ok {
+				continue
+			}
+			gen.PluginStores[plugin.Name()] = append(gen.PluginStores[plugin.Name()], GenesisKV{
+				Key:   cmn.Fmt("%X", key[len(types.PluginPrefix(plugin.Name())):]),
+				Value: cmn.Fmt("%X", iter.Value()),
+			})
+		}
+	}
+
+	for _, plugin := range app.plugins.GetList() {
+		exporter, ok := plugin.(types.GenesisExporter)
+		if !ok {
+			continue
+		}
+		section, err := exporter.ExportGenesis(sm.NewPluginStore(app.state, app.plugins, plugin))
+		if err != nil {
+			return nil, errors.Wrapf(err, "exporting plugin %v", plugin.Name())
+		}
+		gen.Plugins[plugin.Name()] = section
+	}
+
+	supply, err := gen.Supply()
+	if err != nil {
+		return nil, err
+	}
+	gen.TotalSupply = supply
+	err = gen.ValidateBasic()
+	if err != nil {
+		return nil, errors.Wrap(err, "exported genesis is invalid")
+	}
+	return gen, nil
+}
+
+func (app *Basecoin) pluginOfKey(key []byte) types.Plugin {
+	for _, plugin := range app.plugins.GetList() {
+		if bytes.HasPrefix(key, types.PluginPrefix(plugin.Name())) {
+			return plugin
+		}
+	}
+	return nil
 }
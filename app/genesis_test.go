@@ -0,0 +1,220 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	sm "github.com/tepleton/basecoin/state"
+	"github.com/tepleton/basecoin/testutils"
+	"github.com/tepleton/basecoin/types"
+	eyescli "github.com/tepleton/merkleeyes/client"
+	wrsp "github.com/tepleton/wrsp/types"
+)
+
+// Stores each option it is set with, except "bad".
+type optionPlugin struct {
+	name string
+}
+
+func (op optionPlugin) Name() string {
+	return op.name
+}
+
+func (op optionPlugin) SetOption(store types.KVStore, key string, value string) (log string) {
+	if key == "bad" {
+		return "Bad option"
+	}
+	store.Set([]byte(key), []byte(value))
+	return "Success"
+}
+
+func (op optionPlugin) RunTx(store types.KVStore, ctx types.CallContext, txBytes []byte) (res wrsp.Result) {
+	return wrsp.OK
+}
+
+func (op optionPlugin) InitChain(store types.KVStore, vals []*wrsp.Validator) {
+}
+
+func (op optionPlugin) BeginBlock(store types.KVStore, height uint64) {
+}
+
+func (op optionPlugin) EndBlock(store types.KVStore, height uint64) []*wrsp.Validator {
+	return nil
+}
+
+// Stores its genesis section at "genesis", unless it's "bad".
+type genesisPlugin struct {
+	optionPlugin
+}
+
+func (gp genesisPlugin) InitGenesis(store types.KVStore, genesis []byte) error {
+	if string(genesis) == `"bad"` {
+		return errors.New("Bad genesis")
+	}
+	store.Set([]byte("genesis"), genesis)
+	return nil
+}
+
+func (gp genesisPlugin) ExportGenesis(store types.KVStore) ([]byte, error) {
+	return store.Get([]byte("genesis")), nil
+}
+
+func TestInitGenesis(t *testing.T) {
+	eyesCli := eyescli.NewLocalClient("", 0)
+	bcApp := NewBasecoin(eyesCli)
+	options, initer := optionPlugin{"options"}, genesisPlugin{optionPlugin{"initer"}}
+	bcApp.RegisterPlugin(options)
+	bcApp.RegisterPlugin(initer)
+
+	acc := testutils.PrivAccountFromSecret("test1").Account
+	addr := acc.PubKey.Address()
+	module := types.ModuleAddress("initer")
+	newGenesis := func() Genesis {
+		return Genesis{
+			ChainID: "test_chain_id",
+			Accounts: []GenesisAccount{
+				{PubKey: acc.PubKey, Balance: types.Coins{{"", 1000}, {"gold", 5}}},
+				{Address: module, Balance: types.Coins{{"", 10}}},
+			},
+			TotalSupply: types.Coins{{"", 1010}, {"gold", 5}},
+			Plugins: map[string]json.RawMessage{
+				"options": json.RawMessage(`{"name":"foo","params":{"a":1}}`),
+				"initer":  json.RawMessage(`{"b":2}`),
+			},
+		}
+	}
+	// Goes through JSON, like a genesis file
+	initGenesis := func(gen Genesis) error {
+		jsonBytes, err := json.Marshal(gen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Genesis
+		err = json.Unmarshal(jsonBytes, &decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bcApp.InitGenesis(&decoded)
+	}
+
+	// Each of these is rejected, and writes nothing
+	invalid := map[string]func(gen *Genesis){
+		"no chain":       func(gen *Genesis) { gen.ChainID = "" },
+		"duplicate":      func(gen *Genesis) { gen.Accounts[1] = gen.Accounts[0] },
+		"wrong address":  func(gen *Genesis) { gen.Accounts[0].Address = module },
+		"no address":     func(gen *Genesis) { gen.Accounts[1].Address = nil },
+		"unsorted coins": func(gen *Genesis) { gen.Accounts[0].Balance = types.Coins{{"gold", 5}, {"", 1000}} },
+		"negative coins": func(gen *Genesis) { gen.Accounts[1].Balance = types.Coins{{"", -10}} },
+		"supply":         func(gen *Genesis) { gen.TotalSupply = types.Coins{{"", 1000}} },
+		"unknown plugin": func(gen *Genesis) { gen.Plugins["unknown"] = json.RawMessage(`{}`) },
+		"not an object":  func(gen *Genesis) { gen.Plugins["options"] = json.RawMessage(`[]`) },
+		"bad option":     func(gen *Genesis) { gen.Plugins["options"] = json.RawMessage(`{"bad":"x"}`) },
+		"bad genesis":    func(gen *Genesis) { gen.Plugins["initer"] = json.RawMessage(`"bad"`) },
+	}
+	for name, change := range invalid {
+		gen := newGenesis()
+		change(&gen)
+		if err := initGenesis(gen); err == nil {
+			t.Errorf("Expected genesis with %v to fail", name)
+		}
+		if bcApp.state.GetAccount(addr) != nil {
+			t.Fatalf("Expected genesis with %v to write nothing", name)
+		}
+	}
+
+	err := initGenesis(newGenesis())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bcApp.state.GetChainID() != "test_chain_id" {
+		t.Errorf("Expected the chain ID to be set, got %v", bcApp.state.GetChainID())
+	}
+	if got := bcApp.state.GetAccount(addr); got == nil || !got.Balance.IsEqual(types.Coins{{"", 1000}, {"gold", 5}}) {
+		t.Errorf("Expected the account's balance, got %v", got)
+	}
+	if got := bcApp.state.GetAccount(module); got == nil || !got.Balance.IsEqual(types.Coins{{"", 10}}) {
+		t.Errorf("Expected the module account's balance, got %v", got)
+	}
+	optionStore := sm.NewPluginStore(bcApp.state, bcApp.plugins, options)
+	if string(optionStore.Get([]byte("name"))) != "foo" || string(optionStore.Get([]byte("params"))) != `{"a":1}` {
+		t.Errorf("Expected each field to be set as an option")
+	}
+	if got := sm.NewPluginStore(bcApp.state, bcApp.plugins, initer).Get([]byte("genesis")); string(got) != `{"b":2}` {
+		t.Errorf("Expected InitGenesis to get its section, got %s", got)
+	}
+}
+
+func TestExportGenesis(t *testing.T) {
+	eyesCli := eyescli.NewLocalClient("", 0)
+	bcApp := NewBasecoin(eyesCli)
+	options, initer := optionPlugin{"options"}, genesisPlugin{optionPlugin{"initer"}}
+	bcApp.RegisterPlugin(options)
+	bcApp.RegisterPlugin(initer)
+
+	acc := testutils.PrivAccountFromSecret("test1").Account
+	err := bcApp.InitGenesis(&Genesis{
+		ChainID: "test_chain_id",
+		Accounts: []GenesisAccount{
+			{PubKey: acc.PubKey, Sequence: 2, Balance: types.Coins{{"", 1000}, {"gold", 5}}},
+			{Address: sm.FeePoolAddress(), Balance: types.Coins{{"", 10}}},
+		},
+		MinFees: types.Coins{{"", 1}},
+		Plugins: map[string]json.RawMessage{
+			"options": json.RawMessage(`{"name":"foo"}`),
+			"initer":  json.RawMessage(`{"b":2}`),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcApp.BeginBlock(1)
+	bcApp.Commit()
+
+	// Exports the state through JSON
+	export := func(bcApp *Basecoin) []byte {
+		gen, err := bcApp.ExportGenesis("test_chain_id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		jsonBytes, err := json.Marshal(gen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jsonBytes
+	}
+	exported := export(bcApp)
+
+	// A fresh chain started from the export has the same state
+	gen := new(Genesis)
+	err = json.Unmarshal(exported, gen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gen.TotalSupply.IsEqual(types.Coins{{"", 1010}, {"gold", 5}}) {
+		t.Errorf("Expected the total supply to be exported, got %v", gen.TotalSupply)
+	}
+	if len(gen.PluginStores["options"]) != 1 || gen.PluginStores["initer"] != nil {
+		t.Errorf("Expected only the plugin without ExportGenesis to export its keys, got %v", gen.PluginStores)
+	}
+	freshApp := NewBasecoin(eyescli.NewLocalClient("", 0))
+	freshApp.RegisterPlugin(options)
+	freshApp.RegisterPlugin(initer)
+	err = freshApp.InitGenesis(gen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := freshApp.state.GetAccount(acc.PubKey.Address()); got == nil || got.Sequence != 2 {
+		t.Errorf("Expected the account's sequence, got %v", got)
+	}
+	if again := export(freshApp); string(again) != string(exported) {
+		t.Errorf("Expected the same export, got\n%s\nand\n%s", exported, again)
+	}
+
+	// The keys of a plugin that isn't registered can't be exported
+	partialApp := NewBasecoin(eyesCli)
+	partialApp.RegisterPlugin(options)
+	if _, err := partialApp.ExportGenesis("test_chain_id"); err == nil {
+		t.Errorf("Expected the initer plugin's keys to fail the export")
+	}
+}
@@ -0,0 +1,127 @@
+package app
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+
+	sm "github.com/tepleton/basecoin/state"
+	"github.com/tepleton/basecoin/types"
+	. "github.com/tepleton/go-common"
+)
+
+// Registers a migration to run in BeginBlock, see types.Migration.
+// Its Module is PluginNameBase or a registered plugin.
+// Register migrations before InitGenesis, which starts a new chain
+// at their latest versions.
+func (app *Basecoin) RegisterMigration(migration types.Migration) {
+	if migration.Module != PluginNameBase && app.plugins.GetByName(migration.Module) == nil {
+		PanicSanity("Migration of unknown plugin " + migration.Module)
+	}
+	app.migrations.RegisterMigration(migration)
+}
+
+// Runs the migrations due by height that haven't run yet, in order.
+// Each writes its keys and the module's new schema version together.
+func (app *Basecoin) migrate(height uint64) {
+	for _, migration := range app.migrations.GetList() {
+		if height < migration.Height || types.GetSchemaVersion(app.state, migration.Module) >= migration.Version {
+			continue
+		}
+		cache := app.state.CacheWrap()
+		var store types.KVStore = cache
+		if migration.Module != PluginNameBase {
+			store = sm.NewPluginStore(cache, app.plugins, app.plugins.GetByName(migration.Module))
+		}
+		err := migration.Migrate(store)
+		if err != nil {
+			PanicSanity(Fmt("Migration %v of %v at height %v: %v", migration.Version, migration.Module, height, err))
+		}
+		types.SetSchemaVersion(cache, migration.Module, migration.Version)
+		cache.CacheSync()
+		app.setPluginSchemaVersions(app.state)
+	}
+}
+
+// PluginKeysMigration moves the keys of the plugins from the root of the
+// app's store, where they were stored before each plugin's keys were
+// under its types.PluginPrefix, at height. Each root key outside of
+// "base/" goes to the first registered types.LegacyKeyOwner that owns
+// it, and keys no plugin owns are left where they are.
+// Until it runs, the plugins' stores are the whole of the app's store,
+// as on the old chain. A new chain starts with it run, at any height.
+func (app *Basecoin) PluginKeysMigration(height uint64) types.Migration {
+	return types.Migration{
+		Module:  PluginNameBase,
+		Version: 1,
+		Height:  height,
+		Migrate: func(store types.KVStore) error {
+			var keys, values [][]byte
+			iter := store.Iterator(nil, nil)
+			for ; iter.Valid(); iter.Next() {
+				key := iter.Key()
+				if bytes.HasPrefix(key, []byte("base/")) || bytes.HasPrefix(key, []byte("plugin/")) {
+					continue
+				}
+				keys = append(keys, key)
+				values = append(values, iter.Value())
+			}
+			iter.Close()
+
+			for i, key := range keys {
+				owner := app.legacyKeyOwner(key)
+				if owner == "" {
+					continue
+				}
+				store.Set(append(types.PluginPrefix(owner), key...), values[i])
+				store.Delete(key)
+			}
+			return nil
+		},
+	}
+}
+
+// Returns "" if no plugin owns key.
+func (app *Basecoin) legacyKeyOwner(key []byte) string {
+	for _, plugin := range app.plugins.GetList() {
+		if owner, ok := plugin.(types.LegacyKeyOwner); ok && owner.OwnsLegacyKey(key) {
+			return plugin.Name()
+		}
+	}
+	return ""
+}
+
+// Tells each plugin that implements types.SchemaVersioner its schema
+// version in store, and the plugins whether their keys are prefixed.
+func (app *Basecoin) setPluginSchemaVersions(store types.KVReader) {
+	app.plugins.SetPrefixed(types.GetSchemaVersion(store, PluginNameBase) >= types.PrefixedKeysVersion)
+	for _, plugin := range app.plugins.GetList() {
+		if versioner, ok := plugin.(types.SchemaVersioner); ok {
+			versioner.SetSchemaVersion(types.GetSchemaVersion(store, plugin.Name()))
+		}
+	}
+}
+
+// For a new chain, whose state is written in the latest encodings,
+// with the plugins' keys under their prefixes.
+func (app *Basecoin) setLatestSchemaVersions(store types.KVStore) {
+	types.SetSchemaVersion(store, PluginNameBase, types.PrefixedKeysVersion)
+	for _, migration := range app.migrations.GetList() {
+		types.SetSchemaVersion(store, migration.Module, migration.Version)
+	}
+}
+
+// Returns an error if a registered migration hasn't run yet,
+// or the plugins' keys aren't under their prefixes.
+func (app *Basecoin) checkMigrated() error {
+	if !app.plugins.IsPrefixed() {
+		return errors.New("the plugins' keys aren't under their prefixes, see PluginKeysMigration")
+	}
+	for _, migration := range app.migrations.GetList() {
+		if types.GetSchemaVersion(app.state, migration.Module) < migration.Version {
+			return errors.Errorf("migration %v of %v, at height %v, hasn't run yet",
+				migration.Version, migration.Module, migration.Height)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	sm "github.com/tepleton/basecoin/state"
+	"github.com/tepleton/basecoin/testutils"
+	"github.com/tepleton/basecoin/types"
+	eyescli "github.com/tepleton/merkleeyes/client"
+)
+
+// Records the schema version the app sets.
+type versionedPlugin struct {
+	optionPlugin
+	version uint64
+}
+
+func (vp *versionedPlugin) SetSchemaVersion(version uint64) {
+	vp.version = version
+}
+
+// Owns the legacy keys under "options/".
+type legacyPlugin struct {
+	optionPlugin
+}
+
+func (lp legacyPlugin) OwnsLegacyKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte("options/"))
+}
+
+func TestPluginKeysMigration(t *testing.T) {
+	bcApp := NewBasecoin(eyescli.NewLocalClient("", 0))
+	legacy := legacyPlugin{optionPlugin{"options"}}
+	bcApp.RegisterPlugin(legacy)
+	bcApp.RegisterMigration(bcApp.PluginKeysMigration(2))
+	bcApp.state.Set([]byte("options/a"), []byte("1"))
+	bcApp.state.Set([]byte("other"), []byte("2"))
+	acc := testutils.PrivAccountFromSecret("test1").Account
+	addr := acc.PubKey.Address()
+	bcApp.state.SetAccount(addr, &acc)
+	before := bcApp.state.Get(sm.AccountKey(addr))
+
+	// Until the migration, the plugin's store is the app's, as on the old chain
+	bcApp.BeginBlock(1)
+	store := sm.NewPluginStore(bcApp.state, bcApp.plugins, legacy)
+	store.Set([]byte("options/b"), []byte("3"))
+	if string(bcApp.state.Get([]byte("options/b"))) != "3" {
+		t.Fatalf("Expected the plugin's keys to be unprefixed before the migration")
+	}
+
+	bcApp.BeginBlock(2)
+	store = sm.NewPluginStore(bcApp.state, bcApp.plugins, legacy)
+	if string(store.Get([]byte("options/a"))) != "1" || bcApp.state.Get([]byte("options/a")) != nil {
+		t.Errorf("Expected the plugin's key to be moved under its prefix")
+	}
+	if string(bcApp.state.Get([]byte("other"))) != "2" {
+		t.Errorf("Expected the key no plugin owns to be left")
+	}
+	if !bytes.Equal(bcApp.state.Get(sm.AccountKey(addr)), before) || types.GetSchemaVersion(bcApp.state, PluginNameBase) != 1 {
+		t.Errorf("Expected only the plugin's keys to be moved")
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	eyesCli := eyescli.NewLocalClient("", 0)
+	bcApp := NewBasecoin(eyesCli)
+	options := &versionedPlugin{optionPlugin: optionPlugin{"options"}}
+	bcApp.RegisterPlugin(options)
+	err := bcApp.InitGenesis(&Genesis{
+		ChainID: "test_chain_id",
+		Plugins: map[string]json.RawMessage{
+			"options": json.RawMessage(`{"a":"1","b":"2"}`),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Registered after the genesis, like on a live chain
+	var runs int
+	bcApp.RegisterMigration(types.Migration{
+		Module:  "options",
+		Version: 1,
+		Height:  2,
+		Migrate: func(store types.KVStore) error {
+			runs++
+			return types.MigrateKeys(store, nil, func(key, value []byte) ([]byte, error) {
+				return append(value, '0'), nil
+			})
+		},
+	})
+	store := sm.NewPluginStore(bcApp.state, bcApp.plugins, options)
+	bcApp.BeginBlock(1)
+	if runs != 0 || store.SchemaVersion() != 0 || options.version != 0 {
+		t.Fatalf("Expected no migration before its height")
+	}
+	if _, err := bcApp.ExportGenesis("test_chain_id"); err == nil {
+		t.Errorf("Expected the export to fail before the migration")
+	}
+
+	bcApp.BeginBlock(2)
+	bcApp.BeginBlock(3)
+	if runs != 1 || store.SchemaVersion() != 1 || options.version != 1 {
+		t.Fatalf("Expected the migration to run once, got %v runs", runs)
+	}
+	if string(store.Get([]byte("a"))) != "10" || string(store.Get([]byte("b"))) != "20" {
+		t.Errorf("Expected the plugin's keys to be rewritten")
+	}
+	if _, err := bcApp.ExportGenesis("test_chain_id"); err != nil {
+		t.Errorf("Expected the export to succeed after the migration, got %v", err)
+	}
+
+	// A failing migration halts the chain, and writes nothing
+	bcApp.RegisterMigration(types.Migration{
+		Module:  "options",
+		Version: 2,
+		Height:  4,
+		Migrate: func(store types.KVStore) error {
+			types.MigrateKeys(store, nil, func(key, value []byte) ([]byte, error) {
+				return nil, nil
+			})
+			return errors.New("Bad migration")
+		},
+	})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected the failing migration to panic")
+			}
+		}()
+		bcApp.BeginBlock(4)
+	}()
+	if string(store.Get([]byte("a"))) != "10" || store.SchemaVersion() != 1 {
+		t.Errorf("Expected the failing migration to write nothing")
+	}
+
+	// A new chain starts at the latest versions
+	freshApp := NewBasecoin(eyescli.NewLocalClient("", 0))
+	fresh := &versionedPlugin{optionPlugin: optionPlugin{"options"}}
+	freshApp.RegisterPlugin(fresh)
+	freshApp.RegisterMigration(types.Migration{
+		Module:  "options",
+		Version: 1,
+		Height:  2,
+		Migrate: func(store types.KVStore) error {
+			t.Fatal("Expected a new chain not to be migrated")
+			return nil
+		},
+	})
+	err = freshApp.InitGenesis(&Genesis{ChainID: "test_chain_id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	freshApp.BeginBlock(2)
+	if v := types.GetSchemaVersion(freshApp.state, "options"); v != 1 || fresh.version != 1 {
+		t.Errorf("Expected schema version 1, got %v and %v", v, fresh.version)
+	}
+	if !freshApp.plugins.IsPrefixed() {
+		t.Errorf("Expected a new chain's plugin keys to be prefixed")
+	}
+}
@@ -1,13 +1,17 @@
 package app
 
 import (
+	"math"
 	"testing"
 
+	sm "github.com/tepleton/basecoin/state"
 	"github.com/tepleton/basecoin/testutils"
 	"github.com/tepleton/basecoin/types"
 	cmn "github.com/tepleton/go-common"
+	"github.com/tepleton/go-events"
 	"github.com/tepleton/go-wire"
 	eyescli "github.com/tepleton/merkleeyes/client"
+	wrsp "github.com/tepleton/wrsp/types"
 )
 
 func TestSendTx(t *testing.T) {
@@ -166,3 +170,275 @@ func TestSequence(t *testing.T) {
 		}
 	}
 }
+
+func TestMinFee(t *testing.T) {
+	eyesCli := eyescli.NewLocalClient("", 0)
+	chainID := "test_chain_id"
+	bcApp := NewBasecoin(eyesCli)
+	bcApp.SetOption("base/chainID", chainID)
+	t.Log(bcApp.SetOption("base/minFee", `[{"denom": "", "amount": 5}]`))
+
+	test1PrivAcc := testutils.PrivAccountFromSecret("test1")
+	test2PrivAcc := testutils.PrivAccountFromSecret("test2")
+
+	// Seed Basecoin with account
+	test1Acc := test1PrivAcc.Account
+	test1Acc.Balance = types.Coins{{"", 1000}}
+	t.Log(bcApp.SetOption("base/account", string(wire.JSONBytes(test1Acc))))
+
+	deliverSendTx := func(fee, gas int64, sequence int) wrsp.Result {
+		tx := &types.SendTx{
+			Gas: gas,
+			Fee: types.Coin{"", fee},
+			Inputs: []types.TxInput{
+				types.NewTxInput(test1PrivAcc.Account.PubKey, types.Coins{{"", 1 + fee}}, sequence),
+			},
+			Outputs: []types.TxOutput{
+				types.TxOutput{
+					Address: test2PrivAcc.Account.PubKey.Address(),
+					Coins:   types.Coins{{"", 1}},
+				},
+			},
+		}
+		tx.Inputs[0].Signature = test1PrivAcc.PrivKey.Sign(tx.SignBytes(chainID))
+		txBytes := wire.BinaryBytes(struct{ types.Tx }{tx})
+		return bcApp.DeliverTx(txBytes)
+	}
+
+	// Fee below the minimum is rejected
+	res := deliverSendTx(2, 0, 1)
+	if res.Code != wrsp.CodeType_BaseInsufficientFees {
+		t.Errorf("Expected insufficient fees, got %v", res)
+	}
+
+	// Fee at the minimum goes to the fee pool
+	res = deliverSendTx(5, 0, 1)
+	if res.IsErr() {
+		t.Errorf("Failed: %v", res.Error())
+	}
+	poolAcc := bcApp.state.GetAccount(sm.FeePoolAddress())
+	if poolAcc == nil || !poolAcc.Balance.IsEqual(types.Coins{{"", 5}}) {
+		t.Errorf("Expected fee pool to hold 5, got %v", poolAcc)
+	}
+
+	// The fee must also pay for the gas at the minimum gas price
+	t.Log(bcApp.SetOption("base/minGasPrice", `[{"denom": "", "amount": 2}]`))
+	res = deliverSendTx(5, 3, 2)
+	if res.Code != types.ErrInsufficientGasPrice.Code {
+		t.Errorf("Expected insufficient gas price, got %v", res)
+	}
+	// Gas whose price overflows an int64 is not paid for by a small fee
+	res = deliverSendTx(5, math.MaxInt64/2+1, 2)
+	if res.Code != types.ErrInsufficientGasPrice.Code {
+		t.Errorf("Expected insufficient gas price, got %v", res)
+	}
+	res = deliverSendTx(5, 2, 2)
+	if res.IsErr() {
+		t.Errorf("Failed: %v", res.Error())
+	}
+}
+
+func TestSendTxEvents(t *testing.T) {
+	eyesCli := eyescli.NewLocalClient("", 0)
+	chainID := "test_chain_id"
+	bcApp := NewBasecoin(eyesCli)
+	bcApp.SetOption("base/chainID", chainID)
+
+	test1PrivAcc := testutils.PrivAccountFromSecret("test1")
+	test2PrivAcc := testutils.PrivAccountFromSecret("test2")
+	test1Acc := test1PrivAcc.Account
+	test1Acc.Balance = types.Coins{{"", 1000}}
+	t.Log(bcApp.SetOption("base/account", string(wire.JSONBytes(test1Acc))))
+
+	// Listen for coins credited to test2
+	received := make(chan types.EventDataTx, 1)
+	bcApp.EventSwitch().AddListenerForEvent("test", types.EventStringAccOutput(test2PrivAcc.Account.PubKey.Address()),
+		func(data events.EventData) {
+			received <- data.(types.EventDataTx)
+		})
+
+	tx := &types.SendTx{
+		Gas: 0,
+		Fee: types.Coin{"", 0},
+		Inputs: []types.TxInput{
+			types.NewTxInput(test1PrivAcc.Account.PubKey, types.Coins{{"", 1}}, 1),
+		},
+		Outputs: []types.TxOutput{
+			types.TxOutput{
+				Address: test2PrivAcc.Account.PubKey.Address(),
+				Coins:   types.Coins{{"", 1}},
+			},
+		},
+	}
+	tx.Inputs[0].Signature = test1PrivAcc.PrivKey.Sign(tx.SignBytes(chainID))
+	res := bcApp.DeliverTx(wire.BinaryBytes(struct{ types.Tx }{tx}))
+	if res.IsErr() {
+		t.Fatalf("Failed: %v", res.Error())
+	}
+
+	select {
+	case evData := <-received:
+		sendTx, ok := evData.Tx.(*types.SendTx)
+		if !ok || !sendTx.Outputs[0].Coins.IsEqual(types.Coins{{"", 1}}) {
+			t.Errorf("Expected event for the delivered tx, got %v", evData.Tx)
+		}
+	default:
+		t.Error("Expected an output event for test2")
+	}
+}
+
+// Answers /<key> with the value of key.
+type querierPlugin struct {
+	optionPlugin
+}
+
+func (qp querierPlugin) Query(store types.KVStore, reqQuery wrsp.RequestQuery) (resQuery wrsp.ResponseQuery) {
+	resQuery.Key = []byte(reqQuery.Path[1:])
+	resQuery.Value = store.Get(resQuery.Key)
+	return
+}
+
+func TestQueryCommitted(t *testing.T) {
+	eyesCli := eyescli.NewLocalClient("", 0)
+	bcApp := NewBasecoin(eyesCli)
+	bcApp.RegisterPlugin(querierPlugin{optionPlugin{"querier"}})
+	bcApp.SetOption("querier/a", "1")
+
+	// Queries don't see the writes since the last commit
+	resQuery := bcApp.Query(wrsp.RequestQuery{Path: "/plugin/querier/a"})
+	if !resQuery.Code.IsOK() || len(resQuery.Value) != 0 {
+		t.Errorf("Expected no value before the commit, got %v", resQuery)
+	}
+	bcApp.Commit()
+	resQuery = bcApp.Query(wrsp.RequestQuery{Path: "/plugin/querier/a"})
+	if string(resQuery.Value) != "1" {
+		t.Errorf("Expected the committed value, got %v", resQuery)
+	}
+	resQuery = bcApp.Query(wrsp.RequestQuery{Path: "/plugin/querier/a", Prove: true})
+	if string(resQuery.Value) != "1" || len(resQuery.Proof) == 0 {
+		t.Errorf("Expected the committed value with its proof, got %v", resQuery)
+	}
+}
+
+// Writes a key and pays its coins to its module account, then writes
+// until it runs out of gas.
+type gasPlugin struct {
+	optionPlugin
+}
+
+func (gp gasPlugin) RunTx(store types.KVStore, ctx types.CallContext, txBytes []byte) (res wrsp.Result) {
+	store.Set([]byte("a"), []byte("1"))
+	ctx.Send(types.ModuleAddress(gp.name), ctx.Coins())
+	for i := 0; ; i++ {
+		store.Set([]byte(cmn.Fmt("%v", i)), []byte("x"))
+	}
+}
+
+func TestAppTxOutOfGas(t *testing.T) {
+	eyesCli := eyescli.NewLocalClient("", 0)
+	chainID := "test_chain_id"
+	bcApp := NewBasecoin(eyesCli)
+	bcApp.SetOption("base/chainID", chainID)
+	t.Log(bcApp.SetOption("base/gas", `{"set_cost": 10}`))
+	plugin := gasPlugin{optionPlugin{"gas"}}
+	bcApp.RegisterPlugin(plugin)
+
+	test1PrivAcc := testutils.PrivAccountFromSecret("test1")
+	test1Acc := test1PrivAcc.Account
+	test1Acc.Balance = types.Coins{{"", 1000}}
+	t.Log(bcApp.SetOption("base/account", string(wire.JSONBytes(test1Acc))))
+
+	tx := &types.AppTx{
+		Gas:   100,
+		Fee:   types.Coin{"", 5},
+		Name:  "gas",
+		Input: types.NewTxInput(test1PrivAcc.Account.PubKey, types.Coins{{"", 15}}, 1),
+	}
+	tx.Input.Signature = test1PrivAcc.Sign(tx.SignBytes(chainID))
+	paid := 0
+	bcApp.EventSwitch().AddListenerForEvent("test", types.EventStringAccOutput(types.ModuleAddress("gas")),
+		func(data events.EventData) {
+			paid++
+		})
+	res := bcApp.DeliverTx(wire.BinaryBytes(struct{ types.Tx }{tx}))
+	if res.Code != types.ErrOutOfGas.Code {
+		t.Fatalf("Expected out of gas, got %v", res)
+	}
+	if paid != 0 {
+		t.Errorf("Expected the reverted payment's event to be dropped")
+	}
+
+	// The plugin's writes are reverted and the coins returned,
+	// but the fee is charged and the sequence used
+	if sm.NewPluginStore(bcApp.state, bcApp.plugins, plugin).Get([]byte("a")) != nil {
+		t.Errorf("Expected the plugin's write to be reverted")
+	}
+	if modAcc := bcApp.state.GetAccount(types.ModuleAddress("gas")); modAcc != nil && !modAcc.Balance.IsZero() {
+		t.Errorf("Expected the payment to be reverted, got %v", modAcc)
+	}
+	acc := bcApp.state.GetAccount(test1Acc.PubKey.Address())
+	if !acc.Balance.IsEqual(types.Coins{{"", 995}}) || acc.Sequence != 1 {
+		t.Errorf("Expected the coins returned and the fee taken, got %v", acc)
+	}
+	poolAcc := bcApp.state.GetAccount(sm.FeePoolAddress())
+	if poolAcc == nil || !poolAcc.Balance.IsEqual(types.Coins{{"", 5}}) {
+		t.Errorf("Expected fee pool to hold 5, got %v", poolAcc)
+	}
+}
+
+// Pays 5 of the tx's coins to its module account and refunds the rest.
+type payPlugin struct {
+	optionPlugin
+}
+
+func (pp payPlugin) RunTx(store types.KVStore, ctx types.CallContext, txBytes []byte) (res wrsp.Result) {
+	res = ctx.Send(types.ModuleAddress(pp.name), types.Coins{{"", 5}})
+	if res.IsErr() {
+		return res
+	}
+	return ctx.Refund()
+}
+
+func TestAppTxBankEvents(t *testing.T) {
+	eyesCli := eyescli.NewLocalClient("", 0)
+	chainID := "test_chain_id"
+	bcApp := NewBasecoin(eyesCli)
+	bcApp.SetOption("base/chainID", chainID)
+	bcApp.RegisterPlugin(payPlugin{optionPlugin{"pay"}})
+
+	test1PrivAcc := testutils.PrivAccountFromSecret("test1")
+	test1Acc := test1PrivAcc.Account
+	test1Acc.Balance = types.Coins{{"", 1000}}
+	t.Log(bcApp.SetOption("base/account", string(wire.JSONBytes(test1Acc))))
+
+	// The plugin's payouts fire the events of the accounts they credit
+	outputs := make(chan types.EventDataTx, 2)
+	for _, addr := range [][]byte{types.ModuleAddress("pay"), test1Acc.PubKey.Address()} {
+		bcApp.EventSwitch().AddListenerForEvent("test", types.EventStringAccOutput(addr),
+			func(data events.EventData) {
+				outputs <- data.(types.EventDataTx)
+			})
+	}
+
+	tx := &types.AppTx{
+		Gas:   0,
+		Fee:   types.Coin{"", 0},
+		Name:  "pay",
+		Input: types.NewTxInput(test1Acc.PubKey, types.Coins{{"", 7}}, 1),
+	}
+	tx.Input.Signature = test1PrivAcc.Sign(tx.SignBytes(chainID))
+	res := bcApp.DeliverTx(wire.BinaryBytes(struct{ types.Tx }{tx}))
+	if res.IsErr() {
+		t.Fatalf("Failed: %v", res.Error())
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case evData := <-outputs:
+			if appTx, ok := evData.Tx.(*types.AppTx); !ok || appTx.Name != "pay" {
+				t.Errorf("Expected an event for the delivered tx, got %v", evData.Tx)
+			}
+		default:
+			t.Fatalf("Expected output events for the module account and the refund, got %v", i)
+		}
+	}
+}
@@ -19,8 +19,32 @@ var (
 			genesisFlag,
 			inProcTMFlag,
 			chainIDFlag,
+			pluginKeysMigrationHeightFlag,
 			ibcPluginFlag,
+			ibcMigrationHeightFlag,
 			counterPluginFlag,
+			counterMigrationHeightFlag,
+		},
+	}
+
+	exportCmd = cli.Command{
+		Name:      "export",
+		Usage:     "Print the committed state as a genesis file, with basecoin stopped",
+		ArgsUsage: "",
+		Description: "Only the last committed state is kept, so it is the one exported. A plugin without " +
+			"ExportGenesis is exported as its raw keys, which only load into a basecoin with the same key layout.",
+		Action: func(c *cli.Context) error {
+			return cmdExport(c)
+		},
+		Flags: []cli.Flag{
+			eyesFlag,
+			eyesDBFlag,
+			chainIDFlag,
+			pluginKeysMigrationHeightFlag,
+			ibcPluginFlag,
+			ibcMigrationHeightFlag,
+			counterPluginFlag,
+			counterMigrationHeightFlag,
 		},
 	}
 
@@ -107,6 +131,7 @@ var (
 			ibcRegisterTxCmd,
 			ibcUpdateTxCmd,
 			ibcPacketTxCmd,
+			ibcConnectionTxCmd,
 		},
 	}
 
@@ -131,6 +156,7 @@ var (
 		Flags: []cli.Flag{
 			ibcHeaderFlag,
 			ibcCommitFlag,
+			ibcValidatorsFlag,
 		},
 	}
 
@@ -138,11 +164,13 @@ var (
 		Name:  "packet",
 		Usage: "Send a new packet via IBC",
 		Flags: []cli.Flag{
-		//
+			//
 		},
 		Subcommands: []cli.Command{
 			ibcPacketCreateTx,
 			ibcPacketPostTx,
+			ibcPacketAckTx,
+			ibcPacketTimeoutTx,
 		},
 	}
 
@@ -157,7 +185,9 @@ var (
 			ibcToFlag,
 			ibcTypeFlag,
 			ibcPayloadFlag,
-			ibcSequenceFlag,
+			ibcRecipientFlag,
+			ibcTimeoutFlag,
+			ibcRelayFeeFlag,
 		},
 	}
 
@@ -175,6 +205,79 @@ var (
 		},
 	}
 
+	ibcPacketAckTx = cli.Command{
+		Name:  "ack",
+		Usage: "Deliver the acknowledgement of an IBC packet back to its source chain",
+		Action: func(c *cli.Context) error {
+			return cmdIBCPacketAckTx(c)
+		},
+		Flags: []cli.Flag{
+			ibcFromFlag,
+			ibcHeightFlag,
+			ibcPacketFlag,
+			ibcAckFlag,
+			ibcProofFlag,
+		},
+	}
+
+	ibcPacketTimeoutTx = cli.Command{
+		Name:  "timeout",
+		Usage: "Prove an IBC packet timed out, to refund it on its source chain",
+		Action: func(c *cli.Context) error {
+			return cmdIBCPacketTimeoutTx(c)
+		},
+		Flags: []cli.Flag{
+			ibcHeightFlag,
+			ibcPacketFlag,
+			ibcProofFlag,
+		},
+	}
+
+	ibcConnectionTxCmd = cli.Command{
+		Name:  "connection",
+		Usage: "Open or close an IBC connection",
+		Flags: []cli.Flag{
+			//
+		},
+		Subcommands: []cli.Command{
+			ibcConnectionOpenTx,
+			ibcConnectionCloseTx,
+		},
+	}
+
+	ibcConnectionOpenTx = cli.Command{
+		Name:  "open",
+		Usage: "Open a connection for packets from one chain to another, on the source chain or as proven from it",
+		Action: func(c *cli.Context) error {
+			return cmdIBCConnectionOpenTx(c)
+		},
+		Flags: []cli.Flag{
+			ibcFromFlag,
+			ibcToFlag,
+			ibcOrderedFlag,
+			ibcProvenFromFlag,
+			ibcHeightFlag,
+			ibcConnectionFlag,
+			ibcProofFlag,
+		},
+	}
+
+	ibcConnectionCloseTx = cli.Command{
+		Name:  "close",
+		Usage: "Close a connection, on the source chain or as proven from it",
+		Action: func(c *cli.Context) error {
+			return cmdIBCConnectionCloseTx(c)
+		},
+		Flags: []cli.Flag{
+			ibcFromFlag,
+			ibcToFlag,
+			ibcProvenFromFlag,
+			ibcHeightFlag,
+			ibcConnectionFlag,
+			ibcProofFlag,
+		},
+	}
+
 	queryCmd = cli.Command{
 		Name:      "query",
 		Usage:     "Query the merkle tree",
@@ -184,6 +287,8 @@ var (
 		},
 		Flags: []cli.Flag{
 			nodeFlag,
+			verifyFlag,
+			trustFlag,
 		},
 	}
 
@@ -196,6 +301,21 @@ var (
 		},
 		Flags: []cli.Flag{
 			nodeFlag,
+			verifyFlag,
+			trustFlag,
+			pluginAccountFlag,
+		},
+	}
+
+	trustCmd = cli.Command{
+		Name:      "trust",
+		Usage:     "Trust the validators in a genesis file, for query --verify",
+		ArgsUsage: "<genesis file>",
+		Action: func(c *cli.Context) error {
+			return cmdTrust(c)
+		},
+		Flags: []cli.Flag{
+			trustFlag,
 		},
 	}
 
@@ -224,4 +344,30 @@ var (
 			rootFlag,
 		},
 	}
+
+	relayCmd = cli.Command{
+		Name:  "relay",
+		Usage: "Relay IBC packets between two chains",
+		Action: func(c *cli.Context) error {
+			return cmdRelay(c)
+		},
+		Flags: []cli.Flag{
+			relayNode1Flag,
+			relayChainID1Flag,
+			relayNode2Flag,
+			relayChainID2Flag,
+			relayViaFlag,
+
+			fromFlag,
+
+			amountFlag,
+			coinFlag,
+			gasFlag,
+			feeFlag,
+
+			relayProgressFlag,
+			relayIntervalFlag,
+			relayRetriesFlag,
+		},
+	}
 )
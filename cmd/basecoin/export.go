@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/urfave/cli"
+
+	cmn "github.com/tepleton/go-common"
+
+	"github.com/tepleton/basecoin/app"
+)
+
+// Exports the last committed state, the only one kept.
+func cmdExport(c *cli.Context) error {
+	eyesCli, err := connectEyes(c)
+	if err != nil {
+		return err
+	}
+
+	basecoinApp := app.NewBasecoin(eyesCli)
+	registerPlugins(c, basecoinApp)
+	gen, err := basecoinApp.ExportGenesis(c.String("chain_id"))
+	if err != nil {
+		return errors.New(cmn.Fmt("%+v", err))
+	}
+	genBytes, err := json.MarshalIndent(gen, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(genBytes))
+	return nil
+}
@@ -47,6 +47,24 @@ var (
 		Name:  "counter-plugin",
 		Usage: "Enable the counter plugin",
 	}
+
+	counterMigrationHeightFlag = cli.IntFlag{
+		Name:  "counter-migration-height",
+		Usage: "Height at which to version the counter plugin's state, or 0 to leave it unversioned. A new chain starts versioned with any height",
+		Value: 0,
+	}
+
+	pluginKeysMigrationHeightFlag = cli.IntFlag{
+		Name:  "plugin-keys-migration-height",
+		Usage: "Height at which to move the plugins' keys under their prefixes, for a chain started before they were, or 0 to leave them. A new chain starts with them moved with any height",
+		Value: 0,
+	}
+
+	ibcMigrationHeightFlag = cli.IntFlag{
+		Name:  "ibc-migration-height",
+		Usage: "Height at which to zero pad the heights of the ibc plugin's header keys, for a chain started before they were padded, or 0 to leave them. A new chain starts padded with any height",
+		Value: 0,
+	}
 )
 
 // tx flags
@@ -150,6 +168,12 @@ var (
 		Value: "",
 	}
 
+	ibcValidatorsFlag = cli.StringFlag{
+		Name:  "validators",
+		Usage: "hex-encoded validator set that signed the header, if it changed",
+		Value: "",
+	}
+
 	ibcFromFlag = cli.StringFlag{
 		Name:  "from",
 		Usage: "Source ChainID",
@@ -186,12 +210,47 @@ var (
 		Value: "",
 	}
 
-	ibcSequenceFlag = cli.IntFlag{
-		Name:  "sequence",
-		Usage: "sequence number for IBC packet",
+	ibcRecipientFlag = cli.StringFlag{
+		Name:  "recipient",
+		Usage: "Destination address for a coin packet, which sends the tx's --amount of --coin",
+		Value: "",
+	}
+
+	ibcTimeoutFlag = cli.IntFlag{
+		Name:  "timeout",
+		Usage: "Last height of the destination chain the packet may be posted in (0 for none)",
+		Value: 0,
+	}
+
+	ibcRelayFeeFlag = cli.IntFlag{
+		Name:  "relay_fee",
+		Usage: "Amount of --coin paid to whoever relays the packet, out of the tx's --amount",
 		Value: 0,
 	}
 
+	ibcAckFlag = cli.StringFlag{
+		Name:  "ack",
+		Usage: "hex-encoded acknowledgement of an IBC packet",
+		Value: "",
+	}
+
+	ibcOrderedFlag = cli.BoolFlag{
+		Name:  "ordered",
+		Usage: "Require ingress packets to be posted in sequence order",
+	}
+
+	ibcProvenFromFlag = cli.StringFlag{
+		Name:  "proven_from",
+		Usage: "ChainID the source chain's connection is proven from, the source or its hub, on any other chain",
+		Value: "",
+	}
+
+	ibcConnectionFlag = cli.StringFlag{
+		Name:  "connection",
+		Usage: "hex-encoded connection of the source chain, with --proven_from",
+		Value: "",
+	}
+
 	ibcHeightFlag = cli.IntFlag{
 		Name:  "height",
 		Usage: "Height the packet became egress in source chain",
@@ -201,6 +260,22 @@ var (
 
 // proof flags
 var (
+	verifyFlag = cli.BoolFlag{
+		Name:  "verify",
+		Usage: "Verify the result with a proof against a header signed by trusted validators",
+	}
+
+	trustFlag = cli.StringFlag{
+		Name:  "trust",
+		Usage: "File holding the trusted validator set",
+		Value: "trust.json",
+	}
+
+	pluginAccountFlag = cli.BoolFlag{
+		Name:  "plugin",
+		Usage: "Get the module account of the plugin named by the argument",
+	}
+
 	proofFlag = cli.StringFlag{
 		Name:  "proof",
 		Usage: "hex-encoded IAVL proof",
@@ -225,3 +300,54 @@ var (
 		Value: "",
 	}
 )
+
+// relay flags
+var (
+	relayNode1Flag = cli.StringFlag{
+		Name:  "node1",
+		Value: "tcp://localhost:46657",
+		Usage: "Tendermint RPC address of the first chain",
+	}
+
+	relayChainID1Flag = cli.StringFlag{
+		Name:  "chain_id1",
+		Value: "",
+		Usage: "ChainID of the first chain",
+	}
+
+	relayNode2Flag = cli.StringFlag{
+		Name:  "node2",
+		Value: "tcp://localhost:46667",
+		Usage: "Tendermint RPC address of the second chain",
+	}
+
+	relayChainID2Flag = cli.StringFlag{
+		Name:  "chain_id2",
+		Value: "",
+		Usage: "ChainID of the second chain",
+	}
+
+	relayViaFlag = cli.StringFlag{
+		Name:  "via",
+		Value: "",
+		Usage: "Comma separated ChainIDs the first chain's packets reach through the second, as a hub. Each must set the hub with the IBC/hub option",
+	}
+
+	relayProgressFlag = cli.StringFlag{
+		Name:  "progress",
+		Value: "relay.json",
+		Usage: "File recording the next packet to relay on each connection",
+	}
+
+	relayIntervalFlag = cli.IntFlag{
+		Name:  "interval",
+		Value: 1,
+		Usage: "Seconds to wait between polling the chains, and between retries",
+	}
+
+	relayRetriesFlag = cli.IntFlag{
+		Name:  "retries",
+		Value: 3,
+		Usage: "Times to retry relaying a packet before moving on to the next poll",
+	}
+)
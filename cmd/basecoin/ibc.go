@@ -9,6 +9,7 @@ import (
 	"github.com/urfave/cli"
 
 	"github.com/tepleton/basecoin/plugins/ibc"
+	"github.com/tepleton/basecoin/types"
 
 	cmn "github.com/tepleton/go-common"
 	"github.com/tepleton/go-merkle"
@@ -65,9 +66,21 @@ func cmdIBCUpdateTx(c *cli.Context) error {
 		return errors.New(cmn.Fmt("Error unmarshalling commit: %v", err))
 	}
 
+	var validators []*tmtypes.Validator
+	if c.String("validators") != "" {
+		validatorsBytes, err := hex.DecodeString(stripHex(c.String("validators")))
+		if err != nil {
+			return errors.New(cmn.Fmt("Validators (%v) is invalid hex: %v", c.String("validators"), err))
+		}
+		if err := wire.ReadBinaryBytes(validatorsBytes, &validators); err != nil {
+			return errors.New(cmn.Fmt("Error unmarshalling validators: %v", err))
+		}
+	}
+
 	ibcTx := ibc.IBCUpdateChainTx{
-		Header: *header,
-		Commit: *commit,
+		Header:     *header,
+		Commit:     *commit,
+		Validators: validators,
 	}
 
 	fmt.Println("IBCTx:", string(wire.JSONBytes(ibcTx)))
@@ -89,19 +102,33 @@ func cmdIBCPacketCreateTx(c *cli.Context) error {
 		return errors.New(cmn.Fmt("Payload (%v) is invalid hex: %v", c.String("payload"), err))
 	}
 
-	sequence, err := getIBCSequence(c)
-	if err != nil {
-		return err
+	// Send the AppTx's coins to --recipient
+	if packetType == ibc.PacketTypeCoin && c.String("recipient") != "" {
+		recipient, err := hex.DecodeString(stripHex(c.String("recipient")))
+		if err != nil {
+			return errors.New(cmn.Fmt("Recipient (%v) is invalid hex: %v", c.String("recipient"), err))
+		}
+		appCtx := c.Parent().Parent()
+		payloadBytes = wire.BinaryBytes(ibc.CoinsPayload{
+			Recipient: recipient,
+			Coins:     types.Coins{types.Coin{appCtx.String("coin"), int64(appCtx.Int("amount"))}},
+		})
+	}
+
+	var relayFee types.Coins
+	if c.Int("relay_fee") > 0 {
+		relayFee = types.Coins{types.Coin{c.Parent().Parent().String("coin"), int64(c.Int("relay_fee"))}}
 	}
 
 	ibcTx := ibc.IBCPacketCreateTx{
 		Packet: ibc.Packet{
-			SrcChainID: fromChain,
-			DstChainID: toChain,
-			Sequence:   sequence,
-			Type:       packetType,
-			Payload:    payloadBytes,
+			SrcChainID:    fromChain,
+			DstChainID:    toChain,
+			TimeoutHeight: uint64(c.Int("timeout")),
+			Type:          packetType,
+			Payload:       payloadBytes,
 		},
+		Fee: relayFee,
 	}
 
 	fmt.Println("IBCTx:", string(wire.JSONBytes(ibcTx)))
@@ -110,7 +137,7 @@ func cmdIBCPacketCreateTx(c *cli.Context) error {
 		ibc.IBCTx `json:"unwrap"`
 	}{ibcTx}))
 
-	return appTx(c.Parent(), "IBC", data)
+	return appTx(c.Parent().Parent(), "IBC", data)
 }
 
 func cmdIBCPacketPostTx(c *cli.Context) error {
@@ -148,14 +175,159 @@ func cmdIBCPacketPostTx(c *cli.Context) error {
 		ibc.IBCTx `json:"unwrap"`
 	}{ibcTx}))
 
-	return appTx(c.Parent(), "IBC", data)
+	return appTx(c.Parent().Parent(), "IBC", data)
+}
+
+func cmdIBCPacketAckTx(c *cli.Context) error {
+	fromHeight := c.Int("height")
+
+	packetBytes, err := hex.DecodeString(stripHex(c.String("packet")))
+	if err != nil {
+		return errors.New(cmn.Fmt("Packet (%v) is invalid hex: %v", c.String("packet"), err))
+	}
+	ackBytes, err := hex.DecodeString(stripHex(c.String("ack")))
+	if err != nil {
+		return errors.New(cmn.Fmt("Ack (%v) is invalid hex: %v", c.String("ack"), err))
+	}
+	proofBytes, err := hex.DecodeString(stripHex(c.String("proof")))
+	if err != nil {
+		return errors.New(cmn.Fmt("Proof (%v) is invalid hex: %v", c.String("proof"), err))
+	}
+
+	var packet ibc.Packet
+	var ack ibc.PacketAck
+	var proof merkle.IAVLProof
+
+	if err := wire.ReadBinaryBytes(packetBytes, &packet); err != nil {
+		return errors.New(cmn.Fmt("Error unmarshalling packet: %v", err))
+	}
+	if err := wire.ReadBinaryBytes(ackBytes, &ack); err != nil {
+		return errors.New(cmn.Fmt("Error unmarshalling ack: %v", err))
+	}
+	if err := wire.ReadBinaryBytes(proofBytes, &proof); err != nil {
+		return errors.New(cmn.Fmt("Error unmarshalling proof: %v", err))
+	}
+
+	ibcTx := ibc.IBCPacketAckTx{
+		FromChainID:     c.String("from"),
+		FromChainHeight: uint64(fromHeight),
+		Packet:          packet,
+		Ack:             ack,
+		Proof:           proof,
+	}
+
+	fmt.Println("IBCTx:", string(wire.JSONBytes(ibcTx)))
+
+	data := []byte(wire.BinaryBytes(struct {
+		ibc.IBCTx `json:"unwrap"`
+	}{ibcTx}))
+
+	return appTx(c.Parent().Parent(), "IBC", data)
+}
+
+func cmdIBCPacketTimeoutTx(c *cli.Context) error {
+	fromHeight := c.Int("height")
+
+	packetBytes, err := hex.DecodeString(stripHex(c.String("packet")))
+	if err != nil {
+		return errors.New(cmn.Fmt("Packet (%v) is invalid hex: %v", c.String("packet"), err))
+	}
+	proofBytes, err := hex.DecodeString(stripHex(c.String("proof")))
+	if err != nil {
+		return errors.New(cmn.Fmt("Proof (%v) is invalid hex: %v", c.String("proof"), err))
+	}
+
+	var packet ibc.Packet
+	var proof ibc.AbsenceProof
+
+	if err := wire.ReadBinaryBytes(packetBytes, &packet); err != nil {
+		return errors.New(cmn.Fmt("Error unmarshalling packet: %v", err))
+	}
+	if err := wire.ReadBinaryBytes(proofBytes, &proof); err != nil {
+		return errors.New(cmn.Fmt("Error unmarshalling proof: %v", err))
+	}
+
+	ibcTx := ibc.IBCPacketTimeoutTx{
+		FromChainHeight: uint64(fromHeight),
+		Packet:          packet,
+		Proof:           proof,
+	}
+
+	fmt.Println("IBCTx:", string(wire.JSONBytes(ibcTx)))
+
+	data := []byte(wire.BinaryBytes(struct {
+		ibc.IBCTx `json:"unwrap"`
+	}{ibcTx}))
+
+	return appTx(c.Parent().Parent(), "IBC", data)
 }
 
-func getIBCSequence(c *cli.Context) (uint64, error) {
-	if c.IsSet("sequence") {
-		return uint64(c.Int("sequence")), nil
+func cmdIBCConnectionOpenTx(c *cli.Context) error {
+	connProof, err := connectionProof(c)
+	if err != nil {
+		return err
+	}
+
+	ibcTx := ibc.IBCConnectionOpenTx{
+		SrcChainID:      c.String("from"),
+		DstChainID:      c.String("to"),
+		Ordered:         c.Bool("ordered"),
+		ConnectionProof: connProof,
 	}
 
-	// TODO: get sequence
-	return 0, nil
+	fmt.Println("IBCTx:", string(wire.JSONBytes(ibcTx)))
+
+	data := []byte(wire.BinaryBytes(struct {
+		ibc.IBCTx `json:"unwrap"`
+	}{ibcTx}))
+
+	return appTx(c.Parent().Parent(), "IBC", data)
+}
+
+func cmdIBCConnectionCloseTx(c *cli.Context) error {
+	connProof, err := connectionProof(c)
+	if err != nil {
+		return err
+	}
+
+	ibcTx := ibc.IBCConnectionCloseTx{
+		SrcChainID:      c.String("from"),
+		DstChainID:      c.String("to"),
+		ConnectionProof: connProof,
+	}
+
+	fmt.Println("IBCTx:", string(wire.JSONBytes(ibcTx)))
+
+	data := []byte(wire.BinaryBytes(struct {
+		ibc.IBCTx `json:"unwrap"`
+	}{ibcTx}))
+
+	return appTx(c.Parent().Parent(), "IBC", data)
+}
+
+// The source chain's connection, proven from --proven_from, which a chain
+// other than the source opens or closes it with. Empty on the source.
+func connectionProof(c *cli.Context) (connProof ibc.ConnectionProof, err error) {
+	connProof.FromChainID = c.String("proven_from")
+	if connProof.FromChainID == "" {
+		return connProof, nil
+	}
+	connProof.FromChainHeight = uint64(c.Int("height"))
+
+	connBytes, err := hex.DecodeString(stripHex(c.String("connection")))
+	if err != nil {
+		return connProof, errors.New(cmn.Fmt("Connection (%v) is invalid hex: %v", c.String("connection"), err))
+	}
+	proofBytes, err := hex.DecodeString(stripHex(c.String("proof")))
+	if err != nil {
+		return connProof, errors.New(cmn.Fmt("Proof (%v) is invalid hex: %v", c.String("proof"), err))
+	}
+
+	if err := wire.ReadBinaryBytes(connBytes, &connProof.Connection); err != nil {
+		return connProof, errors.New(cmn.Fmt("Error unmarshalling connection: %v", err))
+	}
+	if err := wire.ReadBinaryBytes(proofBytes, &connProof.Proof); err != nil {
+		return connProof, errors.New(cmn.Fmt("Error unmarshalling proof: %v", err))
+	}
+	return connProof, nil
 }
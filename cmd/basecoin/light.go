@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/urfave/cli"
+
+	wrsp "github.com/tepleton/wrsp/types"
+	"github.com/tepleton/basecoin/plugins/ibc"
+	cmn "github.com/tepleton/go-common"
+	client "github.com/tepleton/go-rpc/client"
+	"github.com/tepleton/go-merkle"
+	"github.com/tepleton/go-wire"
+	ctypes "github.com/tepleton/tepleton/rpc/core/types"
+	tmtypes "github.com/tepleton/tepleton/types"
+)
+
+// TrustedState is the light client's view of a chain,
+// persisted to the --trust file between runs.
+type TrustedState struct {
+	ChainID    string               `json:"chain_id"`
+	Height     int                  `json:"height"`
+	Validators []*tmtypes.Validator `json:"validators"`
+}
+
+func cmdTrust(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		return errors.New("trust command requires an argument ([genesis file])")
+	}
+	genesisFile := c.Args()[0]
+
+	genesisBytes, err := ioutil.ReadFile(genesisFile)
+	if err != nil {
+		return errors.New(cmn.Fmt("Error reading genesis file %v: %v", genesisFile, err))
+	}
+	var genDoc *tmtypes.GenesisDoc
+	wire.ReadJSONPtr(&genDoc, genesisBytes, &err)
+	if err != nil {
+		return errors.New(cmn.Fmt("Error parsing genesis file %v: %v", genesisFile, err))
+	}
+
+	trusted := &TrustedState{
+		ChainID:    genDoc.ChainID,
+		Height:     0,
+		Validators: make([]*tmtypes.Validator, len(genDoc.Validators)),
+	}
+	for i, val := range genDoc.Validators {
+		trusted.Validators[i] = tmtypes.NewValidator(val.PubKey, val.Amount)
+	}
+
+	if err := saveTrustedState(c.String("trust"), trusted); err != nil {
+		return err
+	}
+	fmt.Println("Trusting", string(wire.JSONBytes(trusted)))
+	return nil
+}
+
+func loadTrustedState(trustFile string) (*TrustedState, error) {
+	trustBytes, err := ioutil.ReadFile(trustFile)
+	if err != nil {
+		return nil, errors.New(cmn.Fmt("Error reading trust file %v (see `basecoin trust`): %v", trustFile, err))
+	}
+	var trusted *TrustedState
+	wire.ReadJSONPtr(&trusted, trustBytes, &err)
+	if err != nil {
+		return nil, errors.New(cmn.Fmt("Error parsing trust file %v: %v", trustFile, err))
+	}
+	return trusted, nil
+}
+
+func saveTrustedState(trustFile string, trusted *TrustedState) error {
+	err := ioutil.WriteFile(trustFile, wire.JSONBytesPretty(trusted), 0600)
+	if err != nil {
+		return errors.New(cmn.Fmt("Error writing trust file %v: %v", trustFile, err))
+	}
+	return nil
+}
+
+//--------------------------------------------------------------------------------
+
+// Verifies the query's proof of key against the AppHash of a header whose
+// commit is checked against the trusted validators, then advances the
+// trusted state. The state after block H is committed to in the AppHash of
+// header H+1.
+func verifyQuery(c *cli.Context, key []byte, resp *wrsp.ResponseQuery) error {
+	trustFile := c.String("trust")
+	trusted, err := loadTrustedState(trustFile)
+	if err != nil {
+		return err
+	}
+	trustedHeight := trusted.Height
+
+	header, err := trusted.Advance(&rpcChain{node: c.String("node")}, int(resp.Height)+1)
+	if err != nil {
+		return err
+	}
+	if err := verifyQueryProof(key, resp, header.AppHash); err != nil {
+		return err
+	}
+
+	if trusted.Height != trustedHeight {
+		if err := saveTrustedState(trustFile, trusted); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The node picks resp.Key, so a valid proof of another key would
+// otherwise pass for the answer to the query.
+func verifyQueryProof(key []byte, resp *wrsp.ResponseQuery, appHash []byte) error {
+	if !bytes.Equal(resp.Key, key) {
+		return errors.New(cmn.Fmt("Expected a proof for key %X, got one for %X", key, resp.Key))
+	}
+	proof, err := merkle.ReadProof(resp.Proof)
+	if err != nil {
+		return errors.New(cmn.Fmt("Error unmarshalling proof: %v", err))
+	}
+	if !proof.Verify(resp.Key, resp.Value, appHash) {
+		return errors.New(cmn.Fmt("Proof for key %X does not verify against AppHash %X", resp.Key, appHash))
+	}
+	return nil
+}
+
+// HeaderSource is a chain's signed headers, and the validators that
+// signed them.
+type HeaderSource interface {
+	HeaderAndCommit(height int) (*tmtypes.Header, *tmtypes.Commit, error)
+	// The validator set of the block at height.
+	Validators(height int) ([]*tmtypes.Validator, error)
+}
+
+// Verifies source's header at height and returns it. The trusted state
+// advances to it, never backwards. If the validator set changed too much
+// for the trusted validators to vouch for the header, the headers in
+// between are verified first, halving the gap each time, so the trusted
+// state follows the set's changes.
+func (trusted *TrustedState) Advance(source HeaderSource, height int) (*tmtypes.Header, error) {
+	header, commit, err := source.HeaderAndCommit(height)
+	if err != nil {
+		return nil, err
+	}
+	var vals []*tmtypes.Validator
+	if !bytes.Equal(tmtypes.NewValidatorSet(trusted.Validators).Hash(), header.ValidatorsHash) {
+		vals, err = source.Validators(height)
+		if err != nil {
+			return nil, err
+		}
+	}
+	valSet, err := trusted.VerifyHeader(header, commit, vals)
+	if _, ok := err.(ibc.ErrTrustedPowerTooLow); ok && height > trusted.Height+1 {
+		if _, err := trusted.Advance(source, (trusted.Height+height)/2); err != nil {
+			return nil, err
+		}
+		return trusted.Advance(source, height)
+	}
+	if err != nil {
+		return nil, errors.New(cmn.Fmt("Header at height %v does not verify: %v", height, err))
+	}
+
+	if height > trusted.Height {
+		trusted.Height = height
+		trusted.Validators = valSet.Validators
+	}
+	return header, nil
+}
+
+// Returns the validator set that signed the header, vals, or the trusted
+// set if vals is empty. See ibc.VerifyCommit.
+func (trusted *TrustedState) VerifyHeader(header *tmtypes.Header, commit *tmtypes.Commit, vals []*tmtypes.Validator) (*tmtypes.ValidatorSet, error) {
+	return ibc.VerifyCommit(trusted.ChainID, trusted.Validators, header, commit, vals)
+}
+
+//--------------------------------------------------------------------------------
+
+// The commit for block H is the LastCommit of block H+1,
+// so wait a little for it if the chain hasn't got there yet.
+func getHeaderAndCommit(tmAddr string, height int) (*tmtypes.Header, *tmtypes.Commit, error) {
+	block, err := getBlockRetry(tmAddr, height)
+	if err != nil {
+		return nil, nil, err
+	}
+	nextBlock, err := getBlockRetry(tmAddr, height+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	return block.Header, nextBlock.LastCommit, nil
+}
+
+func getBlockRetry(tmAddr string, height int) (block *tmtypes.Block, err error) {
+	for i := 0; i < 10; i++ {
+		block, err = getBlock(tmAddr, height)
+		if err == nil && block != nil {
+			return block, nil
+		}
+		time.Sleep(time.Second)
+	}
+	return nil, errors.New(cmn.Fmt("Error getting block %v: %v", height, err))
+}
+
+// The validator set of the block at height, which signed its header.
+func getValidators(tmAddr string, height int) ([]*tmtypes.Validator, error) {
+	tmResult := new(ctypes.TMResult)
+	clientURI := client.NewClientURI(tmAddr)
+
+	_, err := clientURI.Call("validators", map[string]interface{}{"height": height}, tmResult)
+	if err != nil {
+		return nil, errors.New(cmn.Fmt("Error calling /validators: %v", err))
+	}
+	res := (*tmResult).(*ctypes.ResultValidators)
+	if res.BlockHeight != height {
+		return nil, errors.New(cmn.Fmt("Expected the validators at height %v, got those at %v", height, res.BlockHeight))
+	}
+	return res.Validators, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tepleton/basecoin/state"
+	"github.com/tepleton/basecoin/testutils"
+	"github.com/tepleton/basecoin/types"
+	cmn "github.com/tepleton/go-common"
+	tmtypes "github.com/tepleton/tepleton/types"
+)
+
+func TestVerifyQueryProof(t *testing.T) {
+	ac := newAppChain(t, "test_chain")
+	addr := ac.privAcc.Account.PubKey.Address()
+	resp, err := ac.Query(cmn.Fmt("/account/%X", addr), nil, true)
+	assert.Nil(t, err)
+	header, _, err := ac.HeaderAndCommit(int(resp.Height) + 1)
+	assert.Nil(t, err)
+	assert.Nil(t, verifyQueryProof(state.AccountKey(addr), resp, header.AppHash))
+
+	// A valid proof of another key doesn't answer the query
+	other := types.ModuleAddress("other")
+	assert.NotNil(t, verifyQueryProof(state.AccountKey(other), resp, header.AppHash))
+
+	// Nor does a changed value
+	resp.Value = append([]byte{}, resp.Value...)
+	resp.Value[len(resp.Value)-1]++
+	assert.NotNil(t, verifyQueryProof(state.AccountKey(addr), resp, header.AppHash))
+}
+
+// A chain whose validator set changes by one of four at every height:
+// the block at height H is signed by signers H to H+3.
+type rotatingChain struct {
+	chainID string
+	signers []types.PrivAccount
+}
+
+func newRotatingChain(chainID, secret string, height int) *rotatingChain {
+	rc := &rotatingChain{chainID: chainID}
+	for i := 0; i < height+4; i++ {
+		rc.signers = append(rc.signers, testutils.PrivAccountFromSecret(cmn.Fmt("%v_%v", secret, i)))
+	}
+	return rc
+}
+
+func (rc *rotatingChain) Validators(height int) ([]*tmtypes.Validator, error) {
+	var vals []*tmtypes.Validator
+	for _, signer := range rc.signers[height : height+4] {
+		vals = append(vals, tmtypes.NewValidator(signer.Account.PubKey, 1))
+	}
+	return vals, nil
+}
+
+func (rc *rotatingChain) HeaderAndCommit(height int) (*tmtypes.Header, *tmtypes.Commit, error) {
+	vals, _ := rc.Validators(height)
+	header := &tmtypes.Header{ChainID: rc.chainID, Height: height}
+	return header, signHeader(header, vals, rc.signers[height:height+4]), nil
+}
+
+func TestTrustedStateAdvance(t *testing.T) {
+	chain := newRotatingChain("test_chain", "val", 8)
+	genesisVals, _ := chain.Validators(0)
+	trusted := &TrustedState{ChainID: "test_chain", Validators: genesisVals}
+
+	// None of the genesis validators signed block 4, so the trusted state
+	// follows the set through the blocks in between
+	header, err := trusted.Advance(chain, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, header.Height)
+	assert.Equal(t, 4, trusted.Height)
+	assert.True(t, bytes.Equal(header.ValidatorsHash, tmtypes.NewValidatorSet(trusted.Validators).Hash()))
+
+	// A smaller change is trusted directly
+	_, err = trusted.Advance(chain, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, trusted.Height)
+
+	// Blocks signed by validators the trusted state never led to are refused
+	rogue := newRotatingChain("test_chain", "rogue", 8)
+	_, err = trusted.Advance(rogue, 8)
+	assert.NotNil(t, err)
+	assert.Equal(t, 5, trusted.Height)
+}
@@ -0,0 +1,7 @@
+package main
+
+import (
+	"github.com/tepleton/go-logger"
+)
+
+var log = logger.New("module", "main")
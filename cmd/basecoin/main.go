@@ -13,6 +13,7 @@ func main() {
 	app.Version = "0.1.0"
 	app.Commands = []cli.Command{
 		startCmd,
+		exportCmd,
 		sendTxCmd,
 		appTxCmd,
 		ibcCmd,
@@ -20,6 +21,8 @@ func main() {
 		verifyCmd,
 		blockCmd,
 		accountCmd,
+		trustCmd,
+		relayCmd,
 	}
 	app.Run(os.Args)
 }
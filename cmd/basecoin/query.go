@@ -8,6 +8,8 @@ import (
 
 	"github.com/urfave/cli"
 
+	"github.com/tepleton/basecoin/state"
+	"github.com/tepleton/basecoin/types"
 	cmn "github.com/tepleton/go-common"
 	"github.com/tepleton/go-merkle"
 	"github.com/tepleton/go-wire"
@@ -29,7 +31,7 @@ func cmdQuery(c *cli.Context) error {
 		}
 	}
 
-	resp, err := query(c.String("node"), key)
+	resp, err := query(c.String("node"), "/key", key)
 	if err != nil {
 		return err
 	}
@@ -37,6 +39,11 @@ func cmdQuery(c *cli.Context) error {
 	if !resp.Code.IsOK() {
 		return errors.New(cmn.Fmt("Query for key (%v) returned non-zero code (%v): %v", keyString, resp.Code, resp.Log))
 	}
+	if c.Bool("verify") {
+		if err := verifyQuery(c, key, resp); err != nil {
+			return err
+		}
+	}
 
 	val := resp.Value
 	proof := resp.Proof
@@ -55,18 +62,32 @@ func cmdAccount(c *cli.Context) error {
 	if len(c.Args()) != 1 {
 		return errors.New("account command requires an argument ([address])")
 	}
-	addrHex := stripHex(c.Args()[0])
+	var addr []byte
+	if c.Bool("plugin") {
+		addr = types.ModuleAddress(c.Args()[0])
+	} else {
+		// convert destination address to bytes
+		addrHex := stripHex(c.Args()[0])
+		var err error
+		addr, err = hex.DecodeString(addrHex)
+		if err != nil {
+			return errors.New(cmn.Fmt("Account address (%v) is invalid hex: %v", addrHex, err))
+		}
+	}
 
-	// convert destination address to bytes
-	addr, err := hex.DecodeString(addrHex)
+	resp, err := queryAcc(c.String("node"), addr)
 	if err != nil {
-		return errors.New(cmn.Fmt("Account address (%v) is invalid hex: %v", addrHex, err))
+		return err
 	}
-
-	acc, err := getAcc(c.String("node"), addr)
+	acc, err := readAcc(addr, resp)
 	if err != nil {
 		return err
 	}
+	if c.Bool("verify") {
+		if err := verifyQuery(c, state.AccountKey(addr), resp); err != nil {
+			return err
+		}
+	}
 	fmt.Println(string(wire.JSONBytes(acc)))
 	return nil
 }
@@ -81,11 +102,11 @@ func cmdBlock(c *cli.Context) error {
 		return errors.New(cmn.Fmt("Height must be an int, got %v: %v", heightString, err))
 	}
 
-	block, err := getBlock(c, height)
+	block, err := getBlock(c.String("node"), height)
 	if err != nil {
 		return err
 	}
-	nextBlock, err := getBlock(c, height+1)
+	nextBlock, err := getBlock(c.String("node"), height+1)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/tepleton/basecoin/plugins/ibc"
+	"github.com/tepleton/basecoin/types"
+
+	wrsp "github.com/tepleton/wrsp/types"
+	cmn "github.com/tepleton/go-common"
+	"github.com/tepleton/go-merkle"
+	"github.com/tepleton/go-wire"
+	tmtypes "github.com/tepleton/tepleton/types"
+)
+
+func cmdRelay(c *cli.Context) error {
+	if c.String("chain_id1") == "" || c.String("chain_id2") == "" {
+		return errors.New("relay requires --chain_id1 and --chain_id2")
+	}
+	if c.Int("amount") <= 0 {
+		return errors.New("relay requires an --amount of --coin to send with each tx")
+	}
+	if _, err := os.Stat(c.String("from")); err != nil {
+		return errors.New(cmn.Fmt("Error reading the relayer's key: %v", err))
+	}
+	privVal := tmtypes.LoadPrivValidator(c.String("from"))
+	newChain := func(node, chainID string) *rpcChain {
+		return &rpcChain{
+			node:    node,
+			chainID: chainID,
+			privVal: privVal,
+			coin:    c.String("coin"),
+			amount:  int64(c.Int("amount")),
+			gas:     int64(c.Int("gas")),
+			fee:     int64(c.Int("fee")),
+		}
+	}
+	interval := time.Duration(c.Int("interval")) * time.Second
+
+	relayer, err := NewRelayer(
+		newChain(c.String("node1"), c.String("chain_id1")),
+		newChain(c.String("node2"), c.String("chain_id2")),
+		c.String("progress"),
+		c.Int("retries"),
+		interval,
+	)
+	if err != nil {
+		return err
+	}
+	if via := c.String("via"); via != "" {
+		relayer.SetHub(strings.Split(via, ","))
+	}
+	for {
+		err := relayer.RelayOnce()
+		if !isRetryable(err) {
+			return err
+		}
+		if err != nil {
+			log.Warn("Relaying failed, trying again next round", "error", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// errNotRetryable is an error that trying again won't fix, like a chain
+// that isn't registered or a key the chain rejects, which stops the relayer.
+type errNotRetryable struct {
+	error
+}
+
+func isRetryable(err error) bool {
+	_, ok := err.(errNotRetryable)
+	return !ok
+}
+
+// Prefixes err with msg, keeping whether it's retryable.
+func prefixError(msg string, err error) error {
+	prefixed := errors.New(msg + err.Error())
+	if !isRetryable(err) {
+		return errNotRetryable{prefixed}
+	}
+	return prefixed
+}
+
+//--------------------------------------------------------------------------------
+
+// RelayChain is the relayer's view of one of its chains.
+type RelayChain interface {
+	ChainID() string
+
+	// See app.Basecoin.Query for the paths.
+	// resp.Height is the height of the queried state, which is committed to
+	// in the AppHash of the next header.
+	Query(path string, data []byte, prove bool) (*wrsp.ResponseQuery, error)
+
+	HeaderSource
+
+	// Returns once the tx is committed, or rejected.
+	BroadcastIBCTx(tx ibc.IBCTx) (wrsp.Result, error)
+}
+
+// RelayProgress is the next egress packet to relay on each connection,
+// and the next packet forwarded by a hub, persisted to the --progress file
+// after every packet.
+type RelayProgress struct {
+	Routes []*RelayRoute `json:"routes"`
+}
+
+type RelayRoute struct {
+	SrcChainID   string `json:"src_chain_id"`
+	DstChainID   string `json:"dst_chain_id"`
+	NextSequence uint64 `json:"next_sequence"`
+	NextForward  uint64 `json:"next_forward"`
+}
+
+// Adds the route if it's new.
+func (progress *RelayProgress) route(srcChainID, dstChainID string) *RelayRoute {
+	for _, route := range progress.Routes {
+		if route.SrcChainID == srcChainID && route.DstChainID == dstChainID {
+			return route
+		}
+	}
+	route := &RelayRoute{SrcChainID: srcChainID, DstChainID: dstChainID}
+	progress.Routes = append(progress.Routes, route)
+	return route
+}
+
+// Starts from scratch if the file doesn't exist.
+func loadRelayProgress(progressFile string) (*RelayProgress, error) {
+	progressBytes, err := ioutil.ReadFile(progressFile)
+	if os.IsNotExist(err) {
+		return &RelayProgress{}, nil
+	}
+	if err != nil {
+		return nil, errors.New(cmn.Fmt("Error reading progress file %v: %v", progressFile, err))
+	}
+	var progress *RelayProgress
+	wire.ReadJSONPtr(&progress, progressBytes, &err)
+	if err != nil {
+		return nil, errors.New(cmn.Fmt("Error parsing progress file %v: %v", progressFile, err))
+	}
+	return progress, nil
+}
+
+func saveRelayProgress(progressFile string, progress *RelayProgress) error {
+	err := ioutil.WriteFile(progressFile, wire.JSONBytesPretty(progress), 0600)
+	if err != nil {
+		return errors.New(cmn.Fmt("Error writing progress file %v: %v", progressFile, err))
+	}
+	return nil
+}
+
+//--------------------------------------------------------------------------------
+
+// Relayer posts the egress packets of each chain on the other,
+// updating the other chain with the headers that prove them.
+// It relays packets sent over open connections in Sequence order,
+// then those a hub forwards in the order it received them, and opens
+// their connections on the other chain as they're needed.
+type Relayer struct {
+	chains        [2]RelayChain
+	via           []string // Chains the first chain's packets reach through the second
+	progressFile  string
+	progress      *RelayProgress
+	retries       int
+	retryInterval time.Duration
+}
+
+func NewRelayer(chain1, chain2 RelayChain, progressFile string, retries int, retryInterval time.Duration) (*Relayer, error) {
+	progress, err := loadRelayProgress(progressFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Relayer{
+		chains:        [2]RelayChain{chain1, chain2},
+		progressFile:  progressFile,
+		progress:      progress,
+		retries:       retries,
+		retryInterval: retryInterval,
+	}, nil
+}
+
+// Makes the second chain a hub for the first: the first chain's packets
+// for dstChainIDs are relayed to the second, which forwards them.
+func (r *Relayer) SetHub(dstChainIDs []string) {
+	r.via = dstChainIDs
+}
+
+// Relays every new packet in both directions.
+// A packet that still fails after the retries stops its connection until
+// the next call, so ordered connections don't skip it.
+// An error that isn't retryable is returned over any other.
+func (r *Relayer) RelayOnce() error {
+	var errs []error
+	for _, dstChainID := range append([]string{r.chains[1].ChainID()}, r.via...) {
+		errs = append(errs, r.relayEgress(r.chains[0], r.chains[1], dstChainID))
+	}
+	errs = append(errs, r.relayForwarded(r.chains[0], r.chains[1]))
+	errs = append(errs, r.relayEgress(r.chains[1], r.chains[0], r.chains[0].ChainID()))
+	errs = append(errs, r.relayForwarded(r.chains[1], r.chains[0]))
+	var first error
+	for _, err := range errs {
+		if !isRetryable(err) {
+			return err
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Relays src's packets for dstChainID to dst,
+// which is either dstChainID or its hub.
+func (r *Relayer) relayEgress(src, dst RelayChain, dstChainID string) error {
+	var conn ibc.Connection
+	_, err := queryIBC(src, &conn, false, "connection", src.ChainID(), dstChainID)
+	if err != nil {
+		return err
+	}
+	route := r.progress.route(src.ChainID(), dstChainID)
+	err = r.relayRange(&route.NextSequence, conn.EgressSequence, func(sequence uint64) error {
+		return r.relayPacket(src, dst, src.ChainID(), dstChainID, sequence)
+	})
+	if err != nil {
+		return prefixError(cmn.Fmt("Error relaying packet %v from %v to %v: ",
+			route.NextSequence, src.ChainID(), dstChainID), err)
+	}
+	return nil
+}
+
+// Relays the packets src forwards to dst, as its hub.
+func (r *Relayer) relayForwarded(src, dst RelayChain) error {
+	var forwarded uint64
+	_, err := queryIBC(src, &forwarded, false, "forward", dst.ChainID())
+	if err != nil {
+		return err
+	}
+	route := r.progress.route(src.ChainID(), dst.ChainID())
+	err = r.relayRange(&route.NextForward, forwarded, func(index uint64) error {
+		var packetRoute ibc.PacketRoute
+		_, err := queryIBC(src, &packetRoute, false, "forward", dst.ChainID(), cmn.Fmt("%v", index))
+		if err != nil {
+			return err
+		}
+		return r.relayPacket(src, dst, packetRoute.SrcChainID, dst.ChainID(), packetRoute.Sequence)
+	})
+	if err != nil {
+		return prefixError(cmn.Fmt("Error relaying forwarded packet %v from %v to %v: ",
+			route.NextForward, src.ChainID(), dst.ChainID()), err)
+	}
+	return nil
+}
+
+// Relays each of [*next, end), saving progress as *next moves on.
+func (r *Relayer) relayRange(next *uint64, end uint64, relay func(uint64) error) error {
+	for *next < end {
+		err := r.retry(func() error {
+			return relay(*next)
+		})
+		if err != nil {
+			return err
+		}
+		*next++
+		if err := saveRelayProgress(r.progressFile, r.progress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Relayer) retry(fn func() error) (err error) {
+	for i := 0; ; i++ {
+		err = fn()
+		if err == nil || i >= r.retries || !isRetryable(err) {
+			return err
+		}
+		log.Info("Retrying", "error", err)
+		time.Sleep(r.retryInterval)
+	}
+}
+
+// Posts the packet from srcChainID to dstChainID in src's egress to dst.
+// srcChainID is src unless src forwarded it, and dstChainID is dst
+// unless dst will forward it.
+func (r *Relayer) relayPacket(src, dst RelayChain, srcChainID, dstChainID string, sequence uint64) error {
+	seq := cmn.Fmt("%v", sequence)
+
+	// Another relayer may have got there first.
+	var ingress ibc.Packet
+	exists, err := queryIBC(dst, &ingress, false, "ingress", dstChainID, srcChainID, seq)
+	if err != nil || exists {
+		return err
+	}
+	if err := r.relayConnection(src, dst, srcChainID, dstChainID); err != nil {
+		return err
+	}
+
+	resp, err := src.Query(cmn.Fmt("/plugin/IBC/egress/%v/%v/%v", srcChainID, dstChainID, seq), nil, true)
+	if err != nil {
+		return err
+	}
+	if len(resp.Value) == 0 {
+		// Already acked or timed out
+		return nil
+	}
+	var packet ibc.Packet
+	err = wire.ReadBinaryBytes(resp.Value, &packet)
+	if err != nil {
+		return errors.New(cmn.Fmt("Error decoding packet: %v", err))
+	}
+	proof, err := merkle.ReadProof(resp.Proof)
+	if err != nil {
+		return errors.New(cmn.Fmt("Error unmarshalling proof: %v", err))
+	}
+
+	height := int(resp.Height) + 1
+	if err := r.updateChain(src, dst, height); err != nil {
+		return err
+	}
+
+	res, err := dst.BroadcastIBCTx(ibc.IBCPacketPostTx{
+		FromChainID:     src.ChainID(),
+		FromChainHeight: uint64(height),
+		Packet:          packet,
+		Proof:           *proof,
+	})
+	if err != nil {
+		return err
+	}
+	switch res.Code {
+	case wrsp.CodeType_OK, ibc.IBCCodePacketAlreadyExists:
+		return nil
+	case ibc.IBCCodePacketTimedOut:
+		// Nothing more to do, the source chain refunds it with a timeout proof.
+		log.Info("Packet timed out", "sequence", seq, "src", srcChainID, "dst", dstChainID)
+		return nil
+	default:
+		return errors.New(cmn.Fmt("IBCPacketPostTx failed: %v", res))
+	}
+}
+
+// Opens the connection from srcChainID to dstChainID on dst, unless it's
+// open there already, by proving it's open on src, which is srcChainID
+// or its hub.
+func (r *Relayer) relayConnection(src, dst RelayChain, srcChainID, dstChainID string) error {
+	var conn ibc.Connection
+	exists, err := queryIBC(dst, &conn, false, "connection", srcChainID, dstChainID)
+	if err != nil || (exists && conn.Open) {
+		return err
+	}
+
+	resp, err := src.Query(cmn.Fmt("/plugin/IBC/connection/%v/%v", srcChainID, dstChainID), nil, true)
+	if err != nil {
+		return err
+	}
+	if len(resp.Value) == 0 {
+		return errors.New(cmn.Fmt("No connection from %v to %v on %v", srcChainID, dstChainID, src.ChainID()))
+	}
+	var proven ibc.Connection
+	err = wire.ReadBinaryBytes(resp.Value, &proven)
+	if err != nil {
+		return errors.New(cmn.Fmt("Error decoding connection: %v", err))
+	}
+	proof, err := merkle.ReadProof(resp.Proof)
+	if err != nil {
+		return errors.New(cmn.Fmt("Error unmarshalling proof: %v", err))
+	}
+
+	height := int(resp.Height) + 1
+	if err := r.updateChain(src, dst, height); err != nil {
+		return err
+	}
+
+	res, err := dst.BroadcastIBCTx(ibc.IBCConnectionOpenTx{
+		SrcChainID: srcChainID,
+		DstChainID: dstChainID,
+		ConnectionProof: ibc.ConnectionProof{
+			FromChainID:     src.ChainID(),
+			FromChainHeight: uint64(height),
+			Connection:      proven,
+			Proof:           *proof,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if res.IsErr() && res.Code != ibc.IBCCodeConnectionOpen {
+		return errors.New(cmn.Fmt("IBCConnectionOpenTx failed: %v", res))
+	}
+	return nil
+}
+
+// Posts src's header at height on dst, unless dst already has it.
+// dst needs the validator set that signed it if the set changed since
+// the last header, and if the set changed too much for dst to trust it,
+// a header in between is posted first, as the light client does.
+func (r *Relayer) updateChain(src, dst RelayChain, height int) error {
+	var stored tmtypes.Header
+	exists, err := queryIBC(dst, &stored, false, "header", src.ChainID(), cmn.Fmt("%v", height))
+	if err != nil || exists {
+		return err
+	}
+	var chainState ibc.BlockchainState
+	exists, err = queryIBC(dst, &chainState, false, "state", src.ChainID())
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errNotRetryable{errors.New(cmn.Fmt("%v is not registered on %v", src.ChainID(), dst.ChainID()))}
+	}
+
+	header, commit, err := src.HeaderAndCommit(height)
+	if err != nil {
+		return err
+	}
+	tx := ibc.IBCUpdateChainTx{Header: *header, Commit: *commit}
+	if !bytes.Equal(tmtypes.NewValidatorSet(chainState.Validators).Hash(), header.ValidatorsHash) {
+		tx.Validators, err = src.Validators(height)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = ibc.VerifyCommit(src.ChainID(), chainState.Validators, header, commit, tx.Validators)
+	if _, ok := err.(ibc.ErrTrustedPowerTooLow); ok && uint64(height) > chainState.LastBlockHeight+1 {
+		if err := r.updateChain(src, dst, (int(chainState.LastBlockHeight)+height)/2); err != nil {
+			return err
+		}
+		return r.updateChain(src, dst, height)
+	}
+	res, err := dst.BroadcastIBCTx(tx)
+	if err != nil {
+		return err
+	}
+	if !res.IsOK() {
+		return errors.New(cmn.Fmt("IBCUpdateChainTx failed: %v", res))
+	}
+	return nil
+}
+
+// Queries /plugin/IBC/<parts...> into ptr.
+// Returns false if there's no value.
+func queryIBC(chain RelayChain, ptr interface{}, prove bool, parts ...string) (bool, error) {
+	path := "/plugin/IBC"
+	for _, part := range parts {
+		path += "/" + part
+	}
+	resp, err := chain.Query(path, nil, prove)
+	if err != nil {
+		return false, err
+	}
+	if len(resp.Value) == 0 {
+		return false, nil
+	}
+	err = wire.ReadBinaryBytes(resp.Value, ptr)
+	if err != nil {
+		return true, errors.New(cmn.Fmt("Error decoding %v: %v", path, err))
+	}
+	return true, nil
+}
+
+//--------------------------------------------------------------------------------
+
+// A chain reached over Tendermint RPC.
+// Txs are sent as AppTxs signed by privVal, with amount of coin.
+type rpcChain struct {
+	node    string
+	chainID string
+	privVal *tmtypes.PrivValidator
+	coin    string
+	amount  int64
+	gas     int64
+	fee     int64
+}
+
+func (rc *rpcChain) ChainID() string {
+	return rc.chainID
+}
+
+func (rc *rpcChain) Query(path string, data []byte, prove bool) (*wrsp.ResponseQuery, error) {
+	return queryProve(rc.node, path, data, prove)
+}
+
+func (rc *rpcChain) HeaderAndCommit(height int) (*tmtypes.Header, *tmtypes.Commit, error) {
+	return getHeaderAndCommit(rc.node, height)
+}
+
+func (rc *rpcChain) Validators(height int) ([]*tmtypes.Validator, error) {
+	return getValidators(rc.node, height)
+}
+
+// The chain not knowing the relayer's account, or rejecting its
+// signature, isn't retryable.
+func (rc *rpcChain) BroadcastIBCTx(ibcTx ibc.IBCTx) (wrsp.Result, error) {
+	response, err := queryAcc(rc.node, rc.privVal.Address)
+	if err != nil {
+		return wrsp.Result{}, err
+	}
+	acc, err := readAcc(rc.privVal.Address, response)
+	if err != nil {
+		return wrsp.Result{}, errNotRetryable{err}
+	}
+	input := types.NewTxInput(rc.privVal.PubKey, types.Coins{types.Coin{rc.coin, rc.amount}}, acc.Sequence+1)
+	tx := &types.AppTx{
+		Gas:   rc.gas,
+		Fee:   types.Coin{rc.coin, rc.fee},
+		Name:  "IBC",
+		Input: input,
+		Data:  wire.BinaryBytes(struct{ ibc.IBCTx }{ibcTx}),
+	}
+	tx.Input.Signature = rc.privVal.Sign(tx.SignBytes(rc.chainID))
+	res, err := broadcastTxCommit(rc.node, tx)
+	if err == nil && (res.Code == wrsp.CodeType_BaseInvalidSignature || res.Code == wrsp.CodeType_BaseUnknownAddress) {
+		return res, errNotRetryable{errors.New(cmn.Fmt("%v rejected the relayer's key: %v", rc.chainID, res))}
+	}
+	return res, err
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	wrsp "github.com/tepleton/wrsp/types"
+	"github.com/tepleton/basecoin/app"
+	"github.com/tepleton/basecoin/plugins/ibc"
+	"github.com/tepleton/basecoin/testutils"
+	"github.com/tepleton/basecoin/types"
+	cmn "github.com/tepleton/go-common"
+	"github.com/tepleton/go-wire"
+	eyescli "github.com/tepleton/merkleeyes/client"
+	tmtypes "github.com/tepleton/tepleton/types"
+)
+
+// An in-process basecoin app with the IBC plugin, that commits a block
+// for every tx. Header H is signed by all the validators, and has the
+// AppHash committed in block H-1, as Tendermint would.
+type appChain struct {
+	t         *testing.T
+	chainID   string
+	app       *app.Basecoin
+	genDoc    *tmtypes.GenesisDoc
+	vals      []*tmtypes.Validator
+	signers   []types.PrivAccount
+	privAcc   types.PrivAccount
+	sequence  int
+	height    int
+	appHashes map[int][]byte
+	posted    []ibc.Packet
+}
+
+func newAppChain(t *testing.T, chainID string) *appChain {
+	ac := &appChain{
+		t:         t,
+		chainID:   chainID,
+		app:       app.NewBasecoin(eyescli.NewLocalClient("", 0)),
+		genDoc:    &tmtypes.GenesisDoc{ChainID: chainID},
+		privAcc:   testutils.PrivAccountFromSecret("relayer"),
+		appHashes: make(map[int][]byte),
+	}
+	ac.app.RegisterPlugin(ibc.New(ac.app.Host()))
+	ac.app.SetOption("base/chainID", chainID)
+	acc := ac.privAcc.Account
+	acc.Balance = types.Coins{{"mycoin", 1000}}
+	ac.app.SetOption("base/account", string(wire.JSONBytes(acc)))
+
+	for i := 0; i < 4; i++ {
+		name := cmn.Fmt("%v_val_%v", chainID, i)
+		signer := testutils.PrivAccountFromSecret(name)
+		val := tmtypes.NewValidator(signer.Account.PubKey, 1)
+		ac.genDoc.Validators = append(ac.genDoc.Validators, tmtypes.GenesisValidator{
+			PubKey: val.PubKey,
+			Amount: 1,
+			Name:   name,
+		})
+		ac.vals = append(ac.vals, val)
+		ac.signers = append(ac.signers, signer)
+	}
+
+	ac.commit()
+	return ac
+}
+
+func (ac *appChain) commit() {
+	res := ac.app.Commit()
+	assert.True(ac.t, res.IsOK(), res.Log)
+	ac.height++
+	ac.appHashes[ac.height] = res.Data
+	ac.app.BeginBlock(uint64(ac.height + 1))
+}
+
+func (ac *appChain) runTx(tx ibc.IBCTx) wrsp.Result {
+	res, err := ac.BroadcastIBCTx(tx)
+	assert.Nil(ac.t, err)
+	assert.True(ac.t, res.IsOK(), res.Log)
+	return res
+}
+
+func (ac *appChain) ChainID() string {
+	return ac.chainID
+}
+
+func (ac *appChain) Query(path string, data []byte, prove bool) (*wrsp.ResponseQuery, error) {
+	resQuery := ac.app.Query(wrsp.RequestQuery{Path: path, Data: data, Prove: prove})
+	if !resQuery.Code.IsOK() {
+		return nil, errors.New(resQuery.Log)
+	}
+	resQuery.Height = uint64(ac.height)
+	return &resQuery, nil
+}
+
+func (ac *appChain) HeaderAndCommit(height int) (*tmtypes.Header, *tmtypes.Commit, error) {
+	if height < 1 || height > ac.height+1 {
+		return nil, nil, errors.New(cmn.Fmt("No block at height %v", height))
+	}
+	header := &tmtypes.Header{
+		ChainID: ac.chainID,
+		Height:  height,
+		AppHash: ac.appHashes[height-1],
+	}
+	return header, signHeader(header, ac.vals, ac.signers), nil
+}
+
+// Sets the header's ValidatorsHash to that of vals, and returns the commit
+// of signers, the keys of vals, for it.
+func signHeader(header *tmtypes.Header, vals []*tmtypes.Validator, signers []types.PrivAccount) *tmtypes.Commit {
+	valSet := tmtypes.NewValidatorSet(vals)
+	header.ValidatorsHash = valSet.Hash()
+	blockID := tmtypes.BlockID{Hash: header.Hash()}
+	commit := &tmtypes.Commit{BlockID: blockID, Precommits: make([]*tmtypes.Vote, len(valSet.Validators))}
+	for _, signer := range signers {
+		index, _ := valSet.GetByAddress(signer.Account.PubKey.Address())
+		vote := &tmtypes.Vote{
+			ValidatorAddress: signer.Account.PubKey.Address(),
+			ValidatorIndex:   index,
+			Height:           header.Height,
+			Type:             tmtypes.VoteTypePrecommit,
+			BlockID:          blockID,
+		}
+		vote.Signature = signer.PrivKey.Sign(tmtypes.SignBytes(header.ChainID, vote))
+		commit.Precommits[index] = vote
+	}
+	return commit
+}
+
+func (ac *appChain) Validators(height int) ([]*tmtypes.Validator, error) {
+	return ac.vals, nil
+}
+
+func (ac *appChain) BroadcastIBCTx(ibcTx ibc.IBCTx) (wrsp.Result, error) {
+	ac.sequence++
+	tx := &types.AppTx{
+		Fee:   types.Coin{"mycoin", 0},
+		Name:  "IBC",
+		Input: types.NewTxInput(ac.privAcc.Account.PubKey, types.Coins{{"mycoin", 1}}, ac.sequence),
+		Data:  wire.BinaryBytes(struct{ ibc.IBCTx }{ibcTx}),
+	}
+	tx.Input.Signature = ac.privAcc.Sign(tx.SignBytes(ac.chainID))
+	res := ac.app.DeliverTx(wire.BinaryBytes(struct{ types.Tx }{tx}))
+	ac.commit()
+
+	if postTx, ok := ibcTx.(ibc.IBCPacketPostTx); ok && res.IsOK() {
+		ac.posted = append(ac.posted, postTx.Packet)
+	}
+	return res, nil
+}
+
+func (ac *appChain) createPacket(dst *appChain, payload string) ibc.Packet {
+	packet := ibc.Packet{
+		SrcChainID: ac.chainID,
+		DstChainID: dst.chainID,
+		Type:       "data",
+		Payload:    []byte(payload),
+	}
+	res := ac.runTx(ibc.IBCPacketCreateTx{Packet: packet})
+	err := wire.ReadBinaryBytes(res.Data, &packet.Sequence)
+	assert.Nil(ac.t, err)
+	return packet
+}
+
+func (ac *appChain) hasIngress(packet ibc.Packet) bool {
+	var ingress ibc.Packet
+	exists, err := queryIBC(ac, &ingress, false, "ingress",
+		packet.DstChainID, packet.SrcChainID, cmn.Fmt("%v", packet.Sequence))
+	assert.Nil(ac.t, err)
+	return exists
+}
+
+// Fails the first failures txs broadcast.
+type flakyChain struct {
+	RelayChain
+	failures int
+}
+
+func (fc *flakyChain) BroadcastIBCTx(tx ibc.IBCTx) (wrsp.Result, error) {
+	if fc.failures > 0 {
+		fc.failures--
+		return wrsp.Result{}, errors.New("Connection refused")
+	}
+	return fc.RelayChain.BroadcastIBCTx(tx)
+}
+
+//----------------------------------------
+
+func TestRelay(t *testing.T) {
+	chain1, chain2 := newAppChain(t, "chain_1"), newAppChain(t, "chain_2")
+	for _, pair := range [][2]*appChain{{chain1, chain2}, {chain2, chain1}} {
+		local, remote := pair[0], pair[1]
+		local.runTx(ibc.IBCRegisterChainTx{BlockchainGenesis: ibc.BlockchainGenesis{
+			ChainID: remote.chainID,
+			Genesis: string(wire.JSONBytes(remote.genDoc)),
+		}})
+		local.runTx(ibc.IBCConnectionOpenTx{SrcChainID: local.chainID, DstChainID: remote.chainID, Ordered: true})
+	}
+
+	dir, err := ioutil.TempDir("", "relay")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	progressFile := path.Join(dir, "relay.json")
+
+	// Packets go both ways
+	packets := []ibc.Packet{
+		chain1.createPacket(chain2, "one"),
+		chain1.createPacket(chain2, "two"),
+		chain2.createPacket(chain1, "three"),
+	}
+	relayer, err := NewRelayer(chain1, chain2, progressFile, 0, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, relayer.RelayOnce())
+	assert.True(t, chain2.hasIngress(packets[0]))
+	assert.True(t, chain2.hasIngress(packets[1]))
+	assert.True(t, chain1.hasIngress(packets[2]))
+	assert.Equal(t, 2, len(chain2.posted))
+	assert.Equal(t, 1, len(chain1.posted))
+
+	// It opened their connections on the destinations, ordered like the source's
+	var conn ibc.Connection
+	_, err = queryIBC(chain2, &conn, false, "connection", chain1.chainID, chain2.chainID)
+	assert.Nil(t, err)
+	assert.True(t, conn.Open && conn.Ordered)
+
+	progress, err := loadRelayProgress(progressFile)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), progress.route(chain1.chainID, chain2.chainID).NextSequence)
+	assert.Equal(t, uint64(1), progress.route(chain2.chainID, chain1.chainID).NextSequence)
+
+	// A new relayer picks up where the last left off, retrying failed txs
+	packets = append(packets, chain1.createPacket(chain2, "four"))
+	relayer, err = NewRelayer(chain1, &flakyChain{RelayChain: chain2, failures: 2}, progressFile, 2, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, relayer.RelayOnce())
+	assert.True(t, chain2.hasIngress(packets[3]))
+	assert.Equal(t, 3, len(chain2.posted))
+
+	// Out of retries, the packet waits for the next round
+	packets = append(packets, chain1.createPacket(chain2, "five"))
+	relayer, err = NewRelayer(chain1, &flakyChain{RelayChain: chain2, failures: 1}, progressFile, 0, 0)
+	assert.Nil(t, err)
+	assert.NotNil(t, relayer.RelayOnce())
+	assert.False(t, chain2.hasIngress(packets[4]))
+	assert.Nil(t, relayer.RelayOnce())
+	assert.True(t, chain2.hasIngress(packets[4]))
+	assert.Equal(t, 4, len(chain2.posted))
+}
+
+func TestRelayNotRetryable(t *testing.T) {
+	chain1, chain2 := newAppChain(t, "chain_1"), newAppChain(t, "chain_2")
+	chain1.runTx(ibc.IBCRegisterChainTx{BlockchainGenesis: ibc.BlockchainGenesis{
+		ChainID: chain2.chainID,
+		Genesis: string(wire.JSONBytes(chain2.genDoc)),
+	}})
+	chain1.runTx(ibc.IBCConnectionOpenTx{SrcChainID: chain1.chainID, DstChainID: chain2.chainID})
+	chain1.createPacket(chain2, "one")
+
+	dir, err := ioutil.TempDir("", "relay")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// chain_2 doesn't know chain_1, which retrying won't change
+	relayer, err := NewRelayer(chain1, chain2, path.Join(dir, "relay.json"), 2, 0)
+	assert.Nil(t, err)
+	err = relayer.RelayOnce()
+	assert.NotNil(t, err)
+	assert.False(t, isRetryable(err), err)
+	assert.Equal(t, 0, len(chain2.posted))
+}
+
+func TestRelayForward(t *testing.T) {
+	src, hub, dst := newAppChain(t, "src_chain"), newAppChain(t, "hub_chain"), newAppChain(t, "dst_chain")
+	register := func(local, remote *appChain) {
+		local.runTx(ibc.IBCRegisterChainTx{BlockchainGenesis: ibc.BlockchainGenesis{
+			ChainID: remote.chainID,
+			Genesis: string(wire.JSONBytes(remote.genDoc)),
+		}})
+	}
+	register(hub, src)
+	register(hub, dst)
+	register(dst, hub)
+	dst.app.SetOption("IBC/hub", string(wire.JSONBytes(ibc.HubRoute{ChainID: src.chainID, HubChainID: hub.chainID})))
+	src.runTx(ibc.IBCConnectionOpenTx{SrcChainID: src.chainID, DstChainID: dst.chainID})
+
+	dir, err := ioutil.TempDir("", "relay")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	packet := src.createPacket(dst, "hello world")
+	srcRelayer, err := NewRelayer(src, hub, path.Join(dir, "src.json"), 0, 0)
+	assert.Nil(t, err)
+	srcRelayer.SetHub([]string{dst.chainID})
+	dstRelayer, err := NewRelayer(hub, dst, path.Join(dir, "dst.json"), 0, 0)
+	assert.Nil(t, err)
+
+	assert.Nil(t, srcRelayer.RelayOnce())
+	assert.Equal(t, 1, len(hub.posted))
+	assert.False(t, dst.hasIngress(packet))
+	assert.Nil(t, dstRelayer.RelayOnce())
+	assert.True(t, dst.hasIngress(packet))
+
+	// Nothing new to relay
+	assert.Nil(t, srcRelayer.RelayOnce())
+	assert.Nil(t, dstRelayer.RelayOnce())
+	assert.Equal(t, 1, len(hub.posted))
+	assert.Equal(t, 1, len(dst.posted))
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"sort"
 
 	"github.com/urfave/cli"
 
@@ -19,6 +20,7 @@ import (
 	"github.com/tepleton/basecoin/app"
 	"github.com/tepleton/basecoin/plugins/counter"
 	"github.com/tepleton/basecoin/plugins/ibc"
+	"github.com/tepleton/basecoin/types"
 )
 
 var config cfg.Config
@@ -28,30 +30,16 @@ const EyesCacheSize = 10000
 func cmdStart(c *cli.Context) error {
 
 	// Connect to MerkleEyes
-	var eyesCli *eyes.Client
-	if c.String("eyes") == "local" {
-		eyesCli = eyes.NewLocalClient(c.String("eyes-db"), EyesCacheSize)
-	} else {
-		var err error
-		eyesCli, err = eyes.NewClient(c.String("eyes"))
-		if err != nil {
-			return errors.New("connect to MerkleEyes: " + err.Error())
-		}
+	eyesCli, err := connectEyes(c)
+	if err != nil {
+		return err
 	}
 
 	// Create Basecoin app
 	basecoinApp := app.NewBasecoin(eyesCli)
+	registerPlugins(c, basecoinApp)
 
-	if c.Bool("counter-plugin") {
-		basecoinApp.RegisterPlugin(counter.New("counter"))
-	}
-
-	if c.Bool("ibc-plugin") {
-		basecoinApp.RegisterPlugin(ibc.New())
-
-	}
-
-	// If genesis file was specified, set key-value options
+	// If genesis file was specified, load it
 	if c.String("genesis") != "" {
 		err := basecoinApp.LoadGenesis(c.String("genesis"))
 		if err != nil {
@@ -68,6 +56,56 @@ func cmdStart(c *cli.Context) error {
 	return nil
 }
 
+func connectEyes(c *cli.Context) (*eyes.Client, error) {
+	if c.String("eyes") == "local" {
+		return eyes.NewLocalClient(c.String("eyes-db"), EyesCacheSize), nil
+	}
+	eyesCli, err := eyes.NewClient(c.String("eyes"))
+	if err != nil {
+		return nil, errors.New("connect to MerkleEyes: " + err.Error())
+	}
+	return eyesCli, nil
+}
+
+// Registers the plugins enabled by the flags, and their migrations,
+// in order of height.
+func registerPlugins(c *cli.Context, basecoinApp *app.Basecoin) {
+	var migrations []types.Migration
+	if height := c.Int("plugin-keys-migration-height"); height > 0 {
+		migrations = append(migrations, basecoinApp.PluginKeysMigration(uint64(height)))
+	}
+
+	counterPlugin := counter.New("counter")
+	if c.Bool("counter-plugin") {
+		basecoinApp.RegisterPlugin(counterPlugin)
+		if height := c.Int("counter-migration-height"); height > 0 {
+			migrations = append(migrations, counterPlugin.Migration(uint64(height)))
+		}
+	}
+
+	if c.Bool("ibc-plugin") {
+		ibcPlugin := ibc.New(basecoinApp.Host())
+		if c.Bool("counter-plugin") {
+			ibcPlugin.RegisterPacketHandler(counter.PacketTypeCounter, counterPlugin)
+		}
+		basecoinApp.RegisterPlugin(ibcPlugin)
+		if height := c.Int("ibc-migration-height"); height > 0 {
+			migrations = append(migrations, ibcPlugin.Migration(uint64(height)))
+		}
+	}
+
+	sort.Stable(migrationsByHeight(migrations))
+	for _, migration := range migrations {
+		basecoinApp.RegisterMigration(migration)
+	}
+}
+
+type migrationsByHeight []types.Migration
+
+func (m migrationsByHeight) Len() int           { return len(m) }
+func (m migrationsByHeight) Less(i, j int) bool { return m[i].Height < m[j].Height }
+func (m migrationsByHeight) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
 func startBasecoinWRSP(c *cli.Context, basecoinApp *app.Basecoin) error {
 	// Start the WRSP listener
 	svr, err := server.NewServer(c.String("address"), "socket", basecoinApp)
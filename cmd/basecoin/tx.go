@@ -10,6 +10,7 @@ import (
 	"github.com/tepleton/basecoin/plugins/counter"
 	"github.com/tepleton/basecoin/types"
 
+	wrsp "github.com/tepleton/wrsp/types"
 	cmn "github.com/tepleton/go-common"
 	client "github.com/tepleton/go-rpc/client"
 	"github.com/tepleton/go-wire"
@@ -155,6 +156,26 @@ func broadcastTx(c *cli.Context, tx types.Tx) error {
 	return nil
 }
 
+// broadcast the transaction and wait for it to be committed.
+// A rejected tx is returned as a result, not an error.
+func broadcastTxCommit(tmAddr string, tx types.Tx) (wrsp.Result, error) {
+	tmResult := new(ctypes.TMResult)
+	clientURI := client.NewClientURI(tmAddr)
+
+	txBytes := []byte(wire.BinaryBytes(struct {
+		types.Tx `json:"unwrap"`
+	}{tx}))
+	_, err := clientURI.Call("broadcast_tx_commit", map[string]interface{}{"tx": txBytes}, tmResult)
+	if err != nil {
+		return wrsp.Result{}, errors.New(cmn.Fmt("Error on broadcast tx: %v", err))
+	}
+	res := (*tmResult).(*ctypes.ResultBroadcastTxCommit)
+	if !res.CheckTx.Code.IsOK() {
+		return wrsp.Result{Code: res.CheckTx.Code, Data: res.CheckTx.Data, Log: res.CheckTx.Log}, nil
+	}
+	return wrsp.Result{Code: res.DeliverTx.Code, Data: res.DeliverTx.Data, Log: res.DeliverTx.Log}, nil
+}
+
 // if the sequence flag is set, return it;
 // else, fetch the account by querying the app and return the sequence number
 func getSeq(c *cli.Context, address []byte) (int, error) {
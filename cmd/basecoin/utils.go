@@ -6,12 +6,12 @@ import (
 
 	"github.com/urfave/cli"
 
+	"github.com/tepleton/basecoin/state"
 	"github.com/tepleton/basecoin/types"
 
 	wrsp "github.com/tepleton/wrsp/types"
 	cmn "github.com/tepleton/go-common"
 	client "github.com/tepleton/go-rpc/client"
-	"github.com/tepleton/go-wire"
 	ctypes "github.com/tepleton/tepleton/rpc/core/types"
 	tmtypes "github.com/tepleton/tepleton/types"
 )
@@ -35,14 +35,19 @@ func stripHex(s string) string {
 	return s
 }
 
-func query(tmAddr string, key []byte) (*wrsp.ResponseQuery, error) {
+// See app.Basecoin.Query for the paths.
+func query(tmAddr string, path string, data []byte) (*wrsp.ResponseQuery, error) {
+	return queryProve(tmAddr, path, data, true)
+}
+
+func queryProve(tmAddr string, path string, data []byte, prove bool) (*wrsp.ResponseQuery, error) {
 	clientURI := client.NewClientURI(tmAddr)
 	tmResult := new(ctypes.TMResult)
 
 	params := map[string]interface{}{
-		"path":  "/key",
-		"data":  key,
-		"prove": true,
+		"path":  path,
+		"data":  data,
+		"prove": prove,
 	}
 	_, err := clientURI.Call("wrsp_query", params, tmResult)
 	if err != nil {
@@ -57,21 +62,26 @@ func query(tmAddr string, key []byte) (*wrsp.ResponseQuery, error) {
 
 // fetch the account by querying the app
 func getAcc(tmAddr string, address []byte) (*types.Account, error) {
-
-	key := append([]byte("base/a/"), address...)
-	response, err := query(tmAddr, key)
+	response, err := queryAcc(tmAddr, address)
 	if err != nil {
 		return nil, err
 	}
+	return readAcc(address, response)
+}
+
+func queryAcc(tmAddr string, address []byte) (*wrsp.ResponseQuery, error) {
+	path := cmn.Fmt("/account/%X", address)
+	return query(tmAddr, path, nil)
+}
 
+func readAcc(address []byte, response *wrsp.ResponseQuery) (*types.Account, error) {
 	accountBytes := response.Value
 
 	if len(accountBytes) == 0 {
 		return nil, errors.New(cmn.Fmt("Account bytes are empty for address: %X ", address))
 	}
 
-	var acc *types.Account
-	err = wire.ReadBinaryBytes(accountBytes, &acc)
+	acc, err := state.ReadAccount(accountBytes)
 	if err != nil {
 		return nil, errors.New(cmn.Fmt("Error reading account %X error: %v",
 			accountBytes, err.Error()))
@@ -80,9 +90,8 @@ func getAcc(tmAddr string, address []byte) (*types.Account, error) {
 	return acc, nil
 }
 
-func getBlock(c *cli.Context, height int) (*tmtypes.Block, error) {
+func getBlock(tmAddr string, height int) (*tmtypes.Block, error) {
 	tmResult := new(ctypes.TMResult)
-	tmAddr := c.String("node")
 	clientURI := client.NewClientURI(tmAddr)
 
 	_, err := clientURI.Call("block", map[string]interface{}{"height": height}, tmResult)
@@ -6,6 +6,7 @@ import (
 	"github.com/tepleton/wrsp/server"
 	"github.com/tepleton/basecoin/app"
 	"github.com/tepleton/basecoin/plugins/counter"
+	"github.com/tepleton/basecoin/plugins/vote"
 	cmn "github.com/tepleton/go-common"
 	eyes "github.com/tepleton/merkleeyes/client"
 )
@@ -26,11 +27,12 @@ func main() {
 	app := app.NewBasecoin(eyesCli)
 
 	// add plugins
-	// TODO: add some more, like the cool voting app
 	counter := counter.New("counter")
 	app.RegisterPlugin(counter)
+	vote := vote.New("vote")
+	app.RegisterPlugin(vote)
 
-	// If genesis file was specified, set key-value options
+	// If genesis file was specified, load it
 	if *genFilePath != "" {
 		err := app.LoadGenesis(*genFilePath)
 		if err != nil {
@@ -4,9 +4,7 @@ import (
 	"flag"
 
 	"github.com/tepleton/basecoin/app"
-	"github.com/tepleton/basecoin/types"
 	. "github.com/tepleton/go-common"
-	"github.com/tepleton/go-wire"
 	eyes "github.com/tepleton/merkleeyes/client"
 	"github.com/tepleton/wrsp/server"
 )
@@ -27,24 +25,10 @@ func main() {
 	// Create Basecoin app
 	app := app.NewBasecoin(eyesCli)
 
-	// Load GenesisState
-	jsonBytes, err := ReadFile(*genPtr)
+	// Load the genesis
+	err = app.LoadGenesis(*genPtr)
 	if err != nil {
-		Exit("read genesis: " + err.Error())
-	}
-	genesisState := types.GenesisState{}
-	wire.ReadJSONPtr(&genesisState, jsonBytes, &err)
-	if err != nil {
-		Exit("parsing genesis JSON: " + err.Error())
-	}
-	for _, account := range genesisState.Accounts {
-		// pubKeyBytes := wire.BinaryBytes(account.PubKey)
-		pubKeyString := account.PubKey.KeyString()
-		accBytes := wire.BinaryBytes(account.Account)
-		err = eyesCli.SetSync([]byte(pubKeyString), accBytes)
-		if err != nil {
-			Exit("loading genesis accounts: " + err.Error())
-		}
+		Exit(Fmt("load genesis: %+v", err))
 	}
 
 	// Start the listener
@@ -1,6 +1,8 @@
 package counter
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 
 	wrsp "github.com/tepleton/wrsp/types"
@@ -13,15 +15,24 @@ type CounterPluginState struct {
 	TotalFees types.Coins
 }
 
+// The version of the encoding of CounterPluginState, see
+// types.VersionedBytes. Until the plugin's Migration has run,
+// it is stored untagged, as plain go-wire.
+const CounterStateVersion = 1
+
 type CounterTx struct {
 	Valid bool
 	Fee   types.Coins
 }
 
+// Packet.Type of the IBC packets counted by ReceivePacket
+const PacketTypeCounter = "counter"
+
 //--------------------------------------------------------------------------------
 
 type CounterPlugin struct {
-	name string
+	name          string
+	schemaVersion uint64 // Set by the app, see types.SchemaVersioner
 }
 
 func (cp *CounterPlugin) Name() string {
@@ -32,12 +43,21 @@ func (cp *CounterPlugin) StateKey() []byte {
 	return []byte(fmt.Sprintf("CounterPlugin{name=%v}.State", cp.name))
 }
 
+// The state was stored at the root of the app's store, under the same key.
+func (cp *CounterPlugin) OwnsLegacyKey(key []byte) bool {
+	return bytes.Equal(key, cp.StateKey())
+}
+
 func New(name string) *CounterPlugin {
 	return &CounterPlugin{
 		name: name,
 	}
 }
 
+func (cp *CounterPlugin) SetSchemaVersion(version uint64) {
+	cp.schemaVersion = version
+}
+
 func (cp *CounterPlugin) SetOption(store types.KVStore, key string, value string) (log string) {
 	return ""
 }
@@ -62,22 +82,24 @@ func (cp *CounterPlugin) RunTx(store types.KVStore, ctx types.CallContext, txByt
 	}
 
 	// Did the caller provide enough coins?
-	if !ctx.Coins.IsGTE(tx.Fee) {
+	if !ctx.Coins().IsGTE(tx.Fee) {
 		return wrsp.ErrInsufficientFunds.AppendLog("CounterTx.Fee was not provided")
 	}
 
-	// TODO If there are any funds left over, return funds.
-	// e.g. !ctx.Coins.Minus(tx.Fee).IsZero()
-	// ctx.CallerAccount is synced w/ store, so just modify that and store it.
+	// The fee is kept in the module account, return the rest
+	res = ctx.Send(types.ModuleAddress(cp.name), tx.Fee)
+	if res.IsErr() {
+		return res
+	}
+	res = ctx.Refund()
+	if res.IsErr() {
+		return res
+	}
 
 	// Load CounterPluginState
-	var cpState CounterPluginState
-	cpStateBytes := store.Get(cp.StateKey())
-	if len(cpStateBytes) > 0 {
-		err = wire.ReadBinaryBytes(cpStateBytes, &cpState)
-		if err != nil {
-			return wrsp.ErrInternalError.AppendLog("Error decoding state: " + err.Error())
-		}
+	cpState, err := cp.loadState(store)
+	if err != nil {
+		return wrsp.ErrInternalError.AppendLog("Error decoding state: " + err.Error())
 	}
 
 	// Update CounterPluginState
@@ -85,11 +107,109 @@ func (cp *CounterPlugin) RunTx(store types.KVStore, ctx types.CallContext, txByt
 	cpState.TotalFees = cpState.TotalFees.Plus(tx.Fee)
 
 	// Save CounterPluginState
-	store.Set(cp.StateKey(), wire.BinaryBytes(cpState))
+	cp.saveState(store, cpState)
 
 	return wrsp.OK
 }
 
+// ReceivePacket counts an IBC packet like a CounterTx without a fee.
+// The payload is ignored. Register it with the IBC plugin for PacketTypeCounter.
+func (cp *CounterPlugin) ReceivePacket(store types.KVStore, srcChainID string, payload []byte) (res wrsp.Result) {
+	cpState, err := cp.loadState(store)
+	if err != nil {
+		return wrsp.ErrInternalError.AppendLog("Error decoding state: " + err.Error())
+	}
+	cpState.Counter += 1
+	cp.saveState(store, cpState)
+	return wrsp.OK
+}
+
+// Query paths:
+//
+//	/state   CounterPluginState, versioned once the Migration has run
+func (cp *CounterPlugin) Query(store types.KVStore, reqQuery wrsp.RequestQuery) (resQuery wrsp.ResponseQuery) {
+	if reqQuery.Path != "/state" {
+		resQuery.Code = wrsp.CodeType_UnknownRequest
+		resQuery.Log = "Unknown query path " + reqQuery.Path
+		return
+	}
+	resQuery.Key = cp.StateKey()
+	resQuery.Value = store.Get(cp.StateKey())
+	return
+}
+
+// The genesis section is the CounterPluginState, as JSON.
+func (cp *CounterPlugin) InitGenesis(store types.KVStore, genesis []byte) (err error) {
+	var cpState CounterPluginState
+	wire.ReadJSONPtr(&cpState, genesis, &err)
+	if err != nil {
+		return err
+	}
+	if cpState.Counter < 0 || !cpState.TotalFees.IsValid() || !cpState.TotalFees.IsNonnegative() {
+		return errors.New("Invalid counter state " + string(genesis))
+	}
+	cp.saveState(store, cpState)
+	return nil
+}
+
+func (cp *CounterPlugin) ExportGenesis(store types.KVStore) (genesis []byte, err error) {
+	cpState, err := cp.loadState(store)
+	if err != nil {
+		return nil, err
+	}
+	return wire.JSONBytes(cpState), nil
+}
+
+// Migration tags the CounterPluginState with CounterStateVersion
+// at height. A new chain starts with it run, at any height.
+func (cp *CounterPlugin) Migration(height uint64) types.Migration {
+	return types.Migration{
+		Module:  cp.name,
+		Version: 1,
+		Height:  height,
+		Migrate: func(store types.KVStore) error {
+			cpStateBytes := store.Get(cp.StateKey())
+			if len(cpStateBytes) == 0 {
+				return nil
+			}
+			var cpState CounterPluginState
+			err := wire.ReadBinaryBytes(cpStateBytes, &cpState)
+			if err != nil {
+				return err
+			}
+			store.Set(cp.StateKey(), types.VersionedBytes(CounterStateVersion, cpState))
+			return nil
+		},
+	}
+}
+
+// The state is untagged until the Migration, so that the plugin writes
+// the same bytes as before it until every node runs it.
+func (cp *CounterPlugin) isVersioned() bool {
+	return cp.schemaVersion >= 1
+}
+
+func (cp *CounterPlugin) loadState(store types.KVStore) (cpState CounterPluginState, err error) {
+	cpStateBytes := store.Get(cp.StateKey())
+	if len(cpStateBytes) == 0 {
+		return
+	}
+	if cp.isVersioned() {
+		err = types.ReadVersionedBytes(cpStateBytes, CounterStateVersion, &cpState)
+	} else {
+		err = wire.ReadBinaryBytes(cpStateBytes, &cpState)
+	}
+	return
+}
+
+func (cp *CounterPlugin) saveState(store types.KVStore, cpState CounterPluginState) {
+	if cp.isVersioned() {
+		store.Set(cp.StateKey(), types.VersionedBytes(CounterStateVersion, cpState))
+	} else {
+		store.Set(cp.StateKey(), wire.BinaryBytes(cpState))
+	}
+}
+
 func (cp *CounterPlugin) InitChain(store types.KVStore, vals []*wrsp.Validator) {
 }
 
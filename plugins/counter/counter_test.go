@@ -1,11 +1,14 @@
 package counter
 
 import (
+	"encoding/json"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	wrsp "github.com/tepleton/wrsp/types"
 	"github.com/tepleton/basecoin/app"
+	sm "github.com/tepleton/basecoin/state"
 	"github.com/tepleton/basecoin/testutils"
 	"github.com/tepleton/basecoin/types"
 	"github.com/tepleton/go-wire"
@@ -91,9 +94,92 @@ func TestCounterPlugin(t *testing.T) {
 	res = DeliverCounterTx(0, types.Coin{"", 1}, types.Coins{{"", 4}, {"gold", 1}}, 6, types.Coins{{"", 2}, {"gold", 1}})
 	assert.True(t, res.IsOK(), res.String())
 
-	// Test more input than fee, more "gold"
+	// Test more input than fee, more "gold", which is returned
+	balanceOf := func(addr []byte) types.Coins {
+		bcApp.Commit()
+		resQuery := bcApp.Query(wrsp.RequestQuery{Path: fmt.Sprintf("/account/%X", addr)})
+		assert.True(t, resQuery.Code.IsOK(), resQuery.Log)
+		acc, err := sm.ReadAccount(resQuery.Value)
+		assert.Nil(t, err)
+		assert.NotNil(t, acc)
+		return acc.Balance
+	}
+	balance := func() types.Coins {
+		return balanceOf(test1Acc.PubKey.Address())
+	}
+	before := balance()
 	res = DeliverCounterTx(0, types.Coin{"", 1}, types.Coins{{"", 3}, {"gold", 2}}, 7, types.Coins{{"", 2}, {"gold", 1}})
 	assert.True(t, res.IsOK(), res.String())
+	assert.Equal(t, before.Minus(types.Coins{{"", 3}, {"gold", 1}}), balance())
+
+	// The fees are held in the module account
+	var cpState CounterPluginState
+	resQuery := bcApp.Query(wrsp.RequestQuery{Path: fmt.Sprintf("/plugin/%v/state", counterPluginName)})
+	assert.True(t, resQuery.Code.IsOK(), resQuery.Log)
+	assert.Nil(t, wire.ReadBinaryBytes(resQuery.Value, &cpState))
+	assert.Equal(t, cpState.TotalFees, balanceOf(types.ModuleAddress(counterPluginName)))
 
 	// REF: DeliverCounterTx(gas, fee, inputCoins, inputSequence, appFee) {
 }
+
+func TestCounterReceivePacket(t *testing.T) {
+	store := types.NewMemKVStore()
+	counterPlugin := New("testcounter")
+
+	for i := 1; i <= 2; i++ {
+		res := counterPlugin.ReceivePacket(store, "other_chain", nil)
+		assert.True(t, res.IsOK(), res.Log)
+
+		var cpState CounterPluginState
+		err := wire.ReadBinaryBytes(store.Get(counterPlugin.StateKey()), &cpState)
+		assert.Nil(t, err)
+		assert.Equal(t, i, cpState.Counter)
+		assert.True(t, cpState.TotalFees.IsZero())
+	}
+}
+
+func TestCounterGenesis(t *testing.T) {
+	bcApp := app.NewBasecoin(eyescli.NewLocalClient("", 0))
+	bcApp.RegisterPlugin(New("testcounter"))
+	withSection := func(section string) *app.Genesis {
+		return &app.Genesis{
+			ChainID: "test_chain_id",
+			Plugins: map[string]json.RawMessage{"testcounter": json.RawMessage(section)},
+		}
+	}
+
+	assert.NotNil(t, bcApp.InitGenesis(withSection(`{"Counter": -1}`)))
+	assert.Nil(t, bcApp.InitGenesis(withSection(`{"Counter": 3, "TotalFees": [{"denom": "gold", "amount": 5}]}`)))
+
+	// The state is exported as it was loaded
+	gen, err := bcApp.ExportGenesis("test_chain_id")
+	assert.Nil(t, err)
+	assert.Empty(t, gen.PluginStores)
+	var cpState CounterPluginState
+	wire.ReadJSONPtr(&cpState, gen.Plugins["testcounter"], &err)
+	assert.Nil(t, err)
+	assert.Equal(t, CounterPluginState{Counter: 3, TotalFees: types.Coins{{"gold", 5}}}, cpState)
+}
+
+func TestCounterMigration(t *testing.T) {
+	store := types.NewMemKVStore()
+	counterPlugin := New("testcounter")
+
+	// The state is untagged until the migration
+	res := counterPlugin.ReceivePacket(store, "other_chain", nil)
+	assert.True(t, res.IsOK(), res.Log)
+	var cpState CounterPluginState
+	assert.Nil(t, wire.ReadBinaryBytes(store.Get(counterPlugin.StateKey()), &cpState))
+	assert.Equal(t, 1, cpState.Counter)
+
+	// Like the app runs it in BeginBlock
+	migration := counterPlugin.Migration(10)
+	assert.Nil(t, migration.Migrate(store))
+	counterPlugin.SetSchemaVersion(migration.Version)
+
+	res = counterPlugin.ReceivePacket(store, "other_chain", nil)
+	assert.True(t, res.IsOK(), res.Log)
+	cpState = CounterPluginState{}
+	assert.Nil(t, types.ReadVersionedBytes(store.Get(counterPlugin.StateKey()), CounterStateVersion, &cpState))
+	assert.Equal(t, 2, cpState.Counter)
+}
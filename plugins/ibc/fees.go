@@ -0,0 +1,115 @@
+package ibc
+
+import (
+	wrsp "github.com/tepleton/wrsp/types"
+	"github.com/tepleton/basecoin/state"
+	"github.com/tepleton/basecoin/types"
+	cmn "github.com/tepleton/go-common"
+)
+
+// IBCCosts are charged from the coins sent with each tx type, into the fee pool.
+// Set with the "IBC/costs" option, as JSON.
+type IBCCosts struct {
+	RegisterChain types.Coins `json:"register_chain"`
+	UpdateChain   types.Coins `json:"update_chain"`
+	PacketCreate  types.Coins `json:"packet_create"`
+	PacketPost    types.Coins `json:"packet_post"`
+}
+
+func (costs IBCCosts) IsValid() bool {
+	for _, cost := range []types.Coins{costs.RegisterChain, costs.UpdateChain, costs.PacketCreate, costs.PacketPost} {
+		if !cost.IsValid() || !cost.IsNonnegative() {
+			return false
+		}
+	}
+	return true
+}
+
+// Other txs are free.
+func (costs IBCCosts) CostOf(tx IBCTx) types.Coins {
+	switch tx.(type) {
+	case IBCRegisterChainTx:
+		return costs.RegisterChain
+	case IBCUpdateChainTx:
+		return costs.UpdateChain
+	case IBCPacketCreateTx:
+		return costs.PacketCreate
+	case IBCPacketPostTx:
+		return costs.PacketPost
+	}
+	return nil
+}
+
+// RelayFee is held from the creator of a packet, and paid to the relayer
+// who posted it once its Ack is proven. It's refunded if the packet times out.
+type RelayFee struct {
+	Payer []byte
+	Fee   types.Coins
+}
+
+//----------------------------------------
+
+func (sm *IBCStateMachine) chargeCost(tx IBCTx) {
+	var costs IBCCosts
+	_, err := load(sm.store, toKey(_IBC, _COSTS), &costs)
+	if err != nil {
+		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading costs: %v", err.Error()))
+		return
+	}
+	cost := costs.CostOf(tx)
+	if cost.IsZero() {
+		return
+	}
+	res := sm.ctx.Send(state.FeePoolAddress(), cost)
+	if res.IsErr() {
+		sm.res = res.PrependLog("Paying the tx cost: ")
+	}
+}
+
+// Takes fee from ctx.Coins() and holds it in escrow for the packet's relayer.
+func (sm *IBCStateMachine) holdRelayFee(packet Packet, fee types.Coins) {
+	if !fee.IsValid() || !fee.IsPositive() {
+		sm.res = wrsp.ErrBaseInvalidInput.AppendLog(cmn.Fmt("Invalid relay fee %v", fee))
+		return
+	}
+	res := sm.ctx.Send(EscrowAddress(), fee)
+	if res.IsErr() {
+		sm.res = res.PrependLog("Holding the relay fee: ")
+		return
+	}
+
+	feeKey := toKey(_IBC, _FEE,
+		packet.SrcChainID,
+		packet.DstChainID,
+		cmn.Fmt("%v", packet.Sequence),
+	)
+	save(sm.store, feeKey, RelayFee{Payer: sm.ctx.CallerAddress, Fee: fee})
+}
+
+// Pays the packet's relay fee, if it has one, to addr,
+// or back to its payer if addr is nil.
+func (sm *IBCStateMachine) releaseRelayFee(packet Packet, addr []byte) {
+	feeKey := toKey(_IBC, _FEE,
+		packet.SrcChainID,
+		packet.DstChainID,
+		cmn.Fmt("%v", packet.Sequence),
+	)
+	var relayFee RelayFee
+	exists, err := load(sm.store, feeKey, &relayFee)
+	if err != nil {
+		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading relay fee: %v", err.Error()))
+		return
+	}
+	if !exists {
+		return
+	}
+	if len(addr) == 0 {
+		addr = relayFee.Payer
+	}
+	res := sm.ctx.Bank.PayFromModule(addr, relayFee.Fee)
+	if res.IsErr() {
+		sm.res = wrsp.ErrInternalError.AppendLog(res.Log)
+		return
+	}
+	sm.store.Delete(feeKey)
+}
@@ -0,0 +1,393 @@
+package ibc
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tepleton/basecoin/types"
+	cmn "github.com/tepleton/go-common"
+	"github.com/tepleton/go-wire"
+	tm "github.com/tepleton/tepleton/types"
+)
+
+// IBCGenesis is the plugin's section of the genesis document, as JSON.
+// A new chain sets the options, named like the "IBC/<key>" options,
+// and ExportGenesis fills in the state the plugin's txs wrote too.
+type IBCGenesis struct {
+	Costs           *IBCCosts  `json:"costs"`
+	Registration    string     `json:"registration"`
+	HeaderRetention uint64     `json:"header_retention"`
+	Registrars      [][]byte   `json:"registrars"`
+	Hubs            []HubRoute `json:"hubs"`
+
+	// Like the options of the same name, for one of each
+	Registrar []byte             `json:"registrar"`
+	Approve   *BlockchainGenesis `json:"approve"`
+	Hub       *HubRoute          `json:"hub"`
+
+	Chains              []GenesisChain       `json:"chains"`
+	Connections         []Connection         `json:"connections"`
+	ConnectionApprovals []ConnectionApproval `json:"connection_approvals"`
+	Packets             []GenesisPacket      `json:"packets"`
+}
+
+// GenesisChain is what the plugin keeps of another chain.
+type GenesisChain struct {
+	ChainID      string             `json:"chain_id"`
+	Genesis      *BlockchainGenesis `json:"genesis"`
+	State        *BlockchainState   `json:"state"`
+	Headers      []tm.Header        `json:"headers"`
+	Pins         []HeaderPin        `json:"pins"`
+	Escrow       types.Coins        `json:"escrow"`
+	Approval     []byte             `json:"approval"` // Of its BlockchainGenesis, see ApproveChain
+	ForwardCount uint64             `json:"forward_count"`
+	Forwards     []ForwardedRoute   `json:"forwards"`
+}
+
+// The number of pending packets that keep the header at Height from
+// being pruned.
+type HeaderPin struct {
+	Height uint64 `json:"height"`
+	Count  uint64 `json:"count"`
+}
+
+// The Index-th packet forwarded to the chain, see PacketRoute.
+type ForwardedRoute struct {
+	Index uint64      `json:"index"`
+	Route PacketRoute `json:"route"`
+}
+
+// See ApproveConnection.
+type ConnectionApproval struct {
+	SrcChainID string `json:"src_chain_id"`
+	DstChainID string `json:"dst_chain_id"`
+}
+
+// GenesisPacket is what the plugin keeps of the packet from SrcChainID
+// to DstChainID with Sequence.
+type GenesisPacket struct {
+	SrcChainID string       `json:"src_chain_id"`
+	DstChainID string       `json:"dst_chain_id"`
+	Sequence   uint64       `json:"sequence"`
+	Egress     *Packet      `json:"egress"`
+	Ingress    *Packet      `json:"ingress"`
+	Ack        *PacketAck   `json:"ack"`
+	Fee        *RelayFee    `json:"fee"`
+	Route      *PacketRoute `json:"route"`
+}
+
+func (ibc *IBCPlugin) InitGenesis(store types.KVStore, genesis []byte) (err error) {
+	var gen IBCGenesis
+	wire.ReadJSONPtr(&gen, genesis, &err)
+	if err != nil {
+		return err
+	}
+
+	if gen.Costs != nil {
+		if !gen.Costs.IsValid() {
+			return errors.New(cmn.Fmt("Invalid costs %v", *gen.Costs))
+		}
+		save(store, toKey(_IBC, _COSTS), *gen.Costs)
+	}
+	if gen.Registration != "" {
+		log := setRegistrationOption(store, "registration", gen.Registration)
+		if log != "Success" {
+			return errors.New(log)
+		}
+	}
+	if gen.HeaderRetention != 0 {
+		save(store, toKey(_IBC, _RETENTION), gen.HeaderRetention)
+	}
+	registrars := gen.Registrars
+	if gen.Registrar != nil {
+		registrars = append(registrars, gen.Registrar)
+	}
+	for _, addr := range registrars {
+		if len(addr) != 20 {
+			return errors.New(cmn.Fmt("Invalid registrar address %X", addr))
+		}
+		save(store, toKey(_IBC, _REGISTRAR, cmn.Fmt("%X", addr)), true)
+	}
+	hubs := gen.Hubs
+	if gen.Hub != nil {
+		hubs = append(hubs, *gen.Hub)
+	}
+	for _, route := range hubs {
+		if route.ChainID == "" || route.HubChainID == "" || route.ChainID == route.HubChainID {
+			return errors.New(cmn.Fmt("Invalid hub route %v", route))
+		}
+		save(store, toKey(_IBC, _HUB, route.ChainID), route.HubChainID)
+	}
+	if gen.Approve != nil {
+		ApproveChain(store, *gen.Approve)
+	}
+
+	for _, chain := range gen.Chains {
+		if chain.Genesis != nil {
+			save(store, toKey(_IBC, _BLOCKCHAIN, _GENESIS, chain.ChainID), *chain.Genesis)
+		}
+		if chain.State != nil {
+			save(store, toKey(_IBC, _BLOCKCHAIN, _STATE, chain.ChainID), *chain.State)
+		}
+		for _, header := range chain.Headers {
+			save(store, headerKey(chain.ChainID, uint64(header.Height)), header)
+		}
+		for _, pin := range chain.Pins {
+			save(store, pinKey(chain.ChainID, pin.Height), pin.Count)
+		}
+		if len(chain.Escrow) > 0 {
+			save(store, toKey(_IBC, _ESCROW, chain.ChainID), chain.Escrow)
+		}
+		if len(chain.Approval) > 0 {
+			store.Set(toKey(_IBC, _APPROVAL, chain.ChainID), chain.Approval)
+		}
+		if chain.ForwardCount > 0 {
+			save(store, toKey(_IBC, _FORWARD, chain.ChainID), chain.ForwardCount)
+		}
+		for _, forward := range chain.Forwards {
+			save(store, toKey(_IBC, _FORWARD, chain.ChainID, cmn.Fmt("%v", forward.Index)), forward.Route)
+		}
+	}
+	for _, conn := range gen.Connections {
+		save(store, toKey(_IBC, _CONNECTION, conn.SrcChainID, conn.DstChainID), conn)
+	}
+	for _, approval := range gen.ConnectionApprovals {
+		ApproveConnection(store, approval.SrcChainID, approval.DstChainID)
+	}
+	for _, p := range gen.Packets {
+		seq := cmn.Fmt("%v", p.Sequence)
+		if p.Egress != nil {
+			save(store, toKey(_IBC, _EGRESS, p.SrcChainID, p.DstChainID, seq), *p.Egress)
+		}
+		if p.Ingress != nil {
+			save(store, toKey(_IBC, _INGRESS, p.DstChainID, p.SrcChainID, seq), *p.Ingress)
+		}
+		if p.Ack != nil {
+			save(store, toKey(_IBC, _ACK, p.SrcChainID, p.DstChainID, seq), *p.Ack)
+		}
+		if p.Fee != nil {
+			save(store, toKey(_IBC, _FEE, p.SrcChainID, p.DstChainID, seq), *p.Fee)
+		}
+		if p.Route != nil {
+			save(store, toKey(_IBC, _ROUTE, p.SrcChainID, p.DstChainID, seq), *p.Route)
+		}
+	}
+	return nil
+}
+
+// Every key of the plugin's store goes in the section, or it fails.
+func (ibc *IBCPlugin) ExportGenesis(store types.KVStore) (genesis []byte, err error) {
+	exp := &genesisExporter{
+		chains:  make(map[string]*GenesisChain),
+		packets: make(map[packetID]*GenesisPacket),
+	}
+	iter := store.Iterator(nil, nil)
+	defer iter.Close()
+	for ; iter.Valid(); iter.Next() {
+		err := exp.exportKey(iter.Key(), iter.Value())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return wire.JSONBytes(exp.genesis()), nil
+}
+
+type genesisExporter struct {
+	gen     IBCGenesis
+	chains  map[string]*GenesisChain
+	packets map[packetID]*GenesisPacket
+}
+
+type packetID struct {
+	srcChainID string
+	dstChainID string
+	sequence   uint64
+}
+
+func (exp *genesisExporter) chain(chainID string) *GenesisChain {
+	chain, ok := exp.chains[chainID]
+	if !ok {
+		chain = &GenesisChain{ChainID: chainID}
+		exp.chains[chainID] = chain
+	}
+	return chain
+}
+
+func (exp *genesisExporter) packet(srcChainID, dstChainID, sequence string) (*GenesisPacket, error) {
+	seq, err := strconv.ParseUint(sequence, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	id := packetID{srcChainID, dstChainID, seq}
+	p, ok := exp.packets[id]
+	if !ok {
+		p = &GenesisPacket{SrcChainID: srcChainID, DstChainID: dstChainID, Sequence: seq}
+		exp.packets[id] = p
+	}
+	return p, nil
+}
+
+func (exp *genesisExporter) exportKey(key, value []byte) (err error) {
+	parts := strings.Split(string(key), ",")
+	for i, part := range parts {
+		parts[i], err = url.QueryUnescape(part)
+		if err != nil {
+			return errors.New(cmn.Fmt("Invalid key %s: %v", key, err))
+		}
+	}
+	if len(parts) < 2 || parts[0] != _IBC {
+		return errors.New(cmn.Fmt("Unknown key %s", key))
+	}
+	read := func(ptr interface{}) error {
+		err := wire.ReadBinaryBytes(value, ptr)
+		if err != nil {
+			return errors.New(cmn.Fmt("Error decoding key %s = 0x%X: %v", key, value, err))
+		}
+		return nil
+	}
+
+	gen := &exp.gen
+	switch kind := parts[1]; {
+	case len(parts) == 2 && kind == _COSTS:
+		gen.Costs = new(IBCCosts)
+		return read(gen.Costs)
+	case len(parts) == 2 && kind == _REGISTRATION:
+		return read(&gen.Registration)
+	case len(parts) == 2 && kind == _RETENTION:
+		return read(&gen.HeaderRetention)
+	case len(parts) == 3 && kind == _REGISTRAR:
+		addr, err := hex.DecodeString(parts[2])
+		if err != nil {
+			return errors.New(cmn.Fmt("Invalid key %s: %v", key, err))
+		}
+		gen.Registrars = append(gen.Registrars, addr)
+	case len(parts) == 3 && kind == _HUB:
+		route := HubRoute{ChainID: parts[2]}
+		gen.Hubs = append(gen.Hubs, route)
+		return read(&gen.Hubs[len(gen.Hubs)-1].HubChainID)
+	case len(parts) == 3 && kind == _APPROVAL:
+		exp.chain(parts[2]).Approval = value
+	case len(parts) == 5 && kind == _APPROVAL && parts[2] == _CONNECTION:
+		gen.ConnectionApprovals = append(gen.ConnectionApprovals, ConnectionApproval{parts[3], parts[4]})
+	case len(parts) == 4 && kind == _BLOCKCHAIN && parts[2] == _GENESIS:
+		chain := exp.chain(parts[3])
+		chain.Genesis = new(BlockchainGenesis)
+		return read(chain.Genesis)
+	case len(parts) == 4 && kind == _BLOCKCHAIN && parts[2] == _STATE:
+		chain := exp.chain(parts[3])
+		chain.State = new(BlockchainState)
+		return read(chain.State)
+	case len(parts) == 5 && kind == _BLOCKCHAIN && parts[2] == _HEADER:
+		var header tm.Header
+		err := read(&header)
+		if err != nil {
+			return err
+		}
+		if cmn.Fmt("%020d", header.Height) != parts[4] {
+			return errors.New(cmn.Fmt("Header key %s is not at the header's height %v", key, header.Height))
+		}
+		chain := exp.chain(parts[3])
+		chain.Headers = append(chain.Headers, header)
+	case len(parts) == 5 && kind == _BLOCKCHAIN && parts[2] == _PIN:
+		height, err := strconv.ParseUint(parts[4], 10, 64)
+		if err != nil {
+			return errors.New(cmn.Fmt("Invalid key %s: %v", key, err))
+		}
+		pin := HeaderPin{Height: height}
+		err = read(&pin.Count)
+		if err != nil {
+			return err
+		}
+		chain := exp.chain(parts[3])
+		chain.Pins = append(chain.Pins, pin)
+	case len(parts) == 3 && kind == _ESCROW:
+		return read(&exp.chain(parts[2]).Escrow)
+	case len(parts) == 3 && kind == _FORWARD:
+		return read(&exp.chain(parts[2]).ForwardCount)
+	case len(parts) == 4 && kind == _FORWARD:
+		index, err := strconv.ParseUint(parts[3], 10, 64)
+		if err != nil {
+			return errors.New(cmn.Fmt("Invalid key %s: %v", key, err))
+		}
+		forward := ForwardedRoute{Index: index}
+		err = read(&forward.Route)
+		if err != nil {
+			return err
+		}
+		chain := exp.chain(parts[2])
+		chain.Forwards = append(chain.Forwards, forward)
+	case len(parts) == 4 && kind == _CONNECTION:
+		var conn Connection
+		err := read(&conn)
+		if err != nil {
+			return err
+		}
+		gen.Connections = append(gen.Connections, conn)
+	case len(parts) == 5 && (kind == _EGRESS || kind == _INGRESS || kind == _ACK || kind == _FEE || kind == _ROUTE):
+		src, dst := parts[2], parts[3]
+		if kind == _INGRESS {
+			src, dst = dst, src
+		}
+		p, err := exp.packet(src, dst, parts[4])
+		if err != nil {
+			return errors.New(cmn.Fmt("Invalid key %s: %v", key, err))
+		}
+		switch kind {
+		case _EGRESS:
+			p.Egress = new(Packet)
+			return read(p.Egress)
+		case _INGRESS:
+			p.Ingress = new(Packet)
+			return read(p.Ingress)
+		case _ACK:
+			p.Ack = new(PacketAck)
+			return read(p.Ack)
+		case _FEE:
+			p.Fee = new(RelayFee)
+			return read(p.Fee)
+		case _ROUTE:
+			p.Route = new(PacketRoute)
+			return read(p.Route)
+		}
+	default:
+		return errors.New(cmn.Fmt("Unknown key %s", key))
+	}
+	return nil
+}
+
+// The chains and packets are sorted, so exports of the same state match.
+func (exp *genesisExporter) genesis() IBCGenesis {
+	gen := exp.gen
+	chainIDs := make([]string, 0, len(exp.chains))
+	for chainID := range exp.chains {
+		chainIDs = append(chainIDs, chainID)
+	}
+	sort.Strings(chainIDs)
+	for _, chainID := range chainIDs {
+		gen.Chains = append(gen.Chains, *exp.chains[chainID])
+	}
+	for _, p := range exp.packets {
+		gen.Packets = append(gen.Packets, *p)
+	}
+	sort.Sort(genesisPackets(gen.Packets))
+	return gen
+}
+
+type genesisPackets []GenesisPacket
+
+func (ps genesisPackets) Len() int      { return len(ps) }
+func (ps genesisPackets) Swap(i, j int) { ps[i], ps[j] = ps[j], ps[i] }
+func (ps genesisPackets) Less(i, j int) bool {
+	a, b := ps[i], ps[j]
+	if a.SrcChainID != b.SrcChainID {
+		return a.SrcChainID < b.SrcChainID
+	}
+	if a.DstChainID != b.DstChainID {
+		return a.DstChainID < b.DstChainID
+	}
+	return a.Sequence < b.Sequence
+}
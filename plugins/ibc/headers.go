@@ -0,0 +1,133 @@
+package ibc
+
+import (
+	"bytes"
+	"net/url"
+	"strconv"
+	"strings"
+
+	wrsp "github.com/tepleton/wrsp/types"
+	"github.com/tepleton/basecoin/types"
+	cmn "github.com/tepleton/go-common"
+)
+
+// Heights are zero padded in header keys, so a chain's headers sort by height.
+func headerKey(chainID string, height uint64) []byte {
+	return toKey(_IBC, _BLOCKCHAIN, _HEADER, chainID, cmn.Fmt("%020d", height))
+}
+
+func headerPrefix(chainID string) []byte {
+	return append(toKey(_IBC, _BLOCKCHAIN, _HEADER, chainID), ',')
+}
+
+func pinKey(chainID string, height uint64) []byte {
+	return toKey(_IBC, _BLOCKCHAIN, _PIN, chainID, cmn.Fmt("%020d", height))
+}
+
+// Migration zero pads the heights of the header keys, which were stored
+// unpadded, at height. A new chain starts with it run, at any height.
+func (ibc *IBCPlugin) Migration(height uint64) types.Migration {
+	return types.Migration{
+		Module:  ibc.Name(),
+		Version: 1,
+		Height:  height,
+		Migrate: func(store types.KVStore) error {
+			prefix := append(toKey(_IBC, _BLOCKCHAIN, _HEADER), ',')
+			return types.MigrateKeys(store, prefix, func(key, value []byte) ([]byte, error) {
+				parts := strings.Split(string(key), ",")
+				chainID, err := url.QueryUnescape(parts[len(parts)-2])
+				if err != nil {
+					return nil, err
+				}
+				height, err := strconv.ParseUint(parts[len(parts)-1], 10, 64)
+				if err != nil {
+					return nil, err
+				}
+				newKey := headerKey(chainID, height)
+				if bytes.Equal(newKey, key) {
+					return value, nil
+				}
+				store.Set(newKey, value)
+				return nil, nil
+			})
+		},
+	}
+}
+
+// Returns the heights of the headers stored for chainID, in order.
+func headerHeights(store types.KVStore, chainID string) (heights []uint64) {
+	prefix := headerPrefix(chainID)
+	iter := types.PrefixIterator(store, prefix)
+	for ; iter.Valid(); iter.Next() {
+		height, err := strconv.ParseUint(string(iter.Key()[len(prefix):]), 10, 64)
+		if err != nil {
+			cmn.PanicSanity(cmn.Fmt("Invalid header key %s", iter.Key()))
+		}
+		heights = append(heights, height)
+	}
+	iter.Close()
+	return heights
+}
+
+// The "IBC/header_retention" option is the number of each chain's latest
+// headers to keep, or 0 to keep them all, the default.
+func setRetentionOption(store types.KVStore, value string) (log string) {
+	retention, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return "Invalid header retention " + value
+	}
+	save(store, toKey(_IBC, _RETENTION), retention)
+	return "Success"
+}
+
+//----------------------------------------
+
+// Deletes the headers of chainID below the latest retained ones,
+// except those pinned by a pending packet.
+func (sm *IBCStateMachine) pruneHeaders(chainID string) {
+	var retention uint64
+	_, err := load(sm.store, toKey(_IBC, _RETENTION), &retention)
+	if err != nil {
+		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading header retention: %v", err.Error()))
+		return
+	}
+	if retention == 0 {
+		return
+	}
+
+	heights := headerHeights(sm.store, chainID)
+	if uint64(len(heights)) <= retention {
+		return
+	}
+	for _, height := range heights[:uint64(len(heights))-retention] {
+		if !exists(sm.store, pinKey(chainID, height)) {
+			sm.store.Delete(headerKey(chainID, height))
+		}
+	}
+}
+
+// Keeps the header of chainID at height from being pruned,
+// until as many unpinHeader calls.
+func (sm *IBCStateMachine) pinHeader(chainID string, height uint64) {
+	var count uint64
+	_, err := load(sm.store, pinKey(chainID, height), &count)
+	if err != nil {
+		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading header pin: %v", err.Error()))
+		return
+	}
+	save(sm.store, pinKey(chainID, height), count+1)
+}
+
+func (sm *IBCStateMachine) unpinHeader(chainID string, height uint64) {
+	var count uint64
+	_, err := load(sm.store, pinKey(chainID, height), &count)
+	if err != nil {
+		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading header pin: %v", err.Error()))
+		return
+	}
+	if count <= 1 {
+		sm.store.Delete(pinKey(chainID, height))
+		return
+	}
+	save(sm.store, pinKey(chainID, height), count-1)
+}
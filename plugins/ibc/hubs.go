@@ -0,0 +1,56 @@
+package ibc
+
+import (
+	wrsp "github.com/tepleton/wrsp/types"
+	"github.com/tepleton/basecoin/types"
+	cmn "github.com/tepleton/go-common"
+	"github.com/tepleton/go-wire"
+)
+
+// HubRoute is the value of the "IBC/hub" option, as JSON. It lets
+// HubChainID prove the packets of ChainID, which it forwards to this
+// chain, and the Acks of this chain's packets to ChainID, which it relays
+// back. An empty HubChainID removes ChainID's hub.
+type HubRoute struct {
+	ChainID    string
+	HubChainID string
+}
+
+func setHubOption(store types.KVStore, value string) (log string) {
+	var err error
+	var route HubRoute
+	wire.ReadJSONPtr(&route, []byte(value), &err)
+	if err != nil {
+		return "Error decoding hub route: " + err.Error()
+	}
+	if route.ChainID == "" || route.ChainID == route.HubChainID {
+		return "Invalid hub route " + value
+	}
+	if route.HubChainID == "" {
+		store.Delete(toKey(_IBC, _HUB, route.ChainID))
+	} else {
+		save(store, toKey(_IBC, _HUB, route.ChainID), route.HubChainID)
+	}
+	return "Success"
+}
+
+//----------------------------------------
+
+// Sets sm.res unless fromChainID may prove the packets and Acks of
+// chainID, which is chainID itself, or its hub.
+func (sm *IBCStateMachine) checkHub(chainID, fromChainID string) bool {
+	if fromChainID == chainID {
+		return true
+	}
+	var hub string
+	_, err := load(sm.store, toKey(_IBC, _HUB, chainID), &hub)
+	if err != nil {
+		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading hub: %v", err.Error()))
+		return false
+	}
+	if hub == "" || hub != fromChainID {
+		sm.res = wrsp.NewError(IBCCodeUnauthorized, cmn.Fmt("%v is not the hub for %v", fromChainID, chainID))
+		return false
+	}
+	return true
+}
@@ -1,8 +1,10 @@
 package ibc
 
 import (
+	"bytes"
 	"errors"
 	"net/url"
+	"strconv"
 	"strings"
 
 	wrsp "github.com/tepleton/wrsp/types"
@@ -15,23 +17,49 @@ import (
 
 const (
 	// Key parts
-	_IBC        = "ibc"
-	_BLOCKCHAIN = "blockchain"
-	_GENESIS    = "genesis"
-	_STATE      = "state"
-	_HEADER     = "header"
-	_EGRESS     = "egress"
-	_INGRESS    = "ingress"
-	_CONNECTION = "connection"
+	_IBC          = "ibc"
+	_BLOCKCHAIN   = "blockchain"
+	_GENESIS      = "genesis"
+	_STATE        = "state"
+	_HEADER       = "header"
+	_EGRESS       = "egress"
+	_INGRESS      = "ingress"
+	_CONNECTION   = "connection"
+	_ACK          = "ack"
+	_ESCROW       = "escrow"
+	_COSTS        = "costs"
+	_FEE          = "fee"
+	_FORWARD      = "forward"
+	_REGISTRATION = "registration"
+	_REGISTRAR    = "registrar"
+	_APPROVAL     = "approval"
+	_PIN          = "pin"
+	_RETENTION    = "retention"
+	_ROUTE        = "route"
+	_HUB          = "hub"
 )
 
 type IBCPluginState struct {
 	// @[:ibc, :blockchain, :genesis, ChainID] <~ BlockchainGenesis
 	// @[:ibc, :blockchain, :state, ChainID] <~ BlockchainState
-	// @[:ibc, :blockchain, :header, ChainID, Height] <~ tm.Header
+	// @[:ibc, :blockchain, :header, ChainID, Height] <~ tm.Header, Height zero padded to 20 digits
+	// @[:ibc, :blockchain, :pin, ChainID, Height] <~ uint64
 	// @[:ibc, :egress, Src, Dst, Sequence] <~ Packet
 	// @[:ibc, :ingress, Dst, Src, Sequence] <~ Packet
-	// @[:ibc, :connection, Src, Dst] <~ Connection # TODO - keep connection state
+	// @[:ibc, :connection, Src, Dst] <~ Connection
+	// @[:ibc, :ack, Src, Dst, Sequence] <~ PacketAck
+	// @[:ibc, :escrow, ChainID] <~ types.Coins
+	// @[:ibc, :costs] <~ IBCCosts
+	// @[:ibc, :fee, Src, Dst, Sequence] <~ RelayFee
+	// @[:ibc, :forward, Dst] <~ uint64
+	// @[:ibc, :forward, Dst, Index] <~ PacketRoute
+	// @[:ibc, :route, Src, Dst, Sequence] <~ PacketRoute
+	// @[:ibc, :retention] <~ uint64
+	// @[:ibc, :registration] <~ string
+	// @[:ibc, :registrar, Address] <~ bool
+	// @[:ibc, :approval, ChainID] <~ []byte
+	// @[:ibc, :approval, :connection, Src, Dst] <~ bool
+	// @[:ibc, :hub, ChainID] <~ string
 }
 
 type BlockchainGenesis struct {
@@ -39,19 +67,67 @@ type BlockchainGenesis struct {
 	Genesis string
 }
 
+// A Frozen chain has committed conflicting headers, see IBCMisbehaviourTx.
+// Nothing more is proven from it until it's registered again.
 type BlockchainState struct {
 	ChainID         string
 	Validators      []*tm.Validator
 	LastBlockHash   []byte
 	LastBlockHeight uint64
+	Frozen          bool
 }
 
+// Connection is the state of packets flowing from SrcChainID to DstChainID.
+// A chain keeps one per direction, (Local, Remote) for egress
+// and (Remote, Local) for ingress. SrcChainID opens and closes it, and
+// every other chain follows, see IBCConnectionOpenTx.
+type Connection struct {
+	SrcChainID      string
+	DstChainID      string
+	Owner           []byte // On SrcChainID, the address that opened it under RegistrationOpen
+	Open            bool
+	Ordered         bool   // Ingress packets must be posted in Sequence order
+	EgressSequence  uint64 // Assigned to the next egress packet
+	IngressSequence uint64 // The next ingress packet expected, if Ordered
+	ProvenFrom      string // Elsewhere, the chain it was last opened or closed from
+	ProvenHeight    uint64 // and the height of that header, so older proofs aren't replayed
+}
+
+// TimeoutHeight is the last height of the destination chain the packet
+// may be posted in, or 0 for none.
 type Packet struct {
-	SrcChainID string
-	DstChainID string
-	Sequence   uint64
-	Type       string
-	Payload    []byte
+	SrcChainID    string
+	DstChainID    string
+	Sequence      uint64
+	TimeoutHeight uint64
+	Type          string
+	Payload       []byte
+}
+
+// PacketAck is written by the destination chain when a packet is posted,
+// and proven back to the source chain with IBCPacketAckTx.
+// Relayer is the address that posted it, to be paid its RelayFee.
+type PacketAck struct {
+	Code    wrsp.CodeType
+	Data    []byte
+	Relayer []byte
+}
+
+// PacketRoute records an ingress packet for another registered chain,
+// which is forwarded by keeping it in egress under its own Src, Dst and
+// Sequence. Each Dst counts the packets forwarded to it, so relayers
+// can find them by Index.
+//
+// Its Ack, or its timeout, is proven here from the Dst chain, or the next
+// hub, and kept as this chain's own Ack of it, an IBCCodePacketTimedOut
+// one for a timeout, for the previous hop to prove from here in turn.
+// Until then, the route is also kept by packet, and the header it was
+// proven with is pinned so it isn't pruned.
+type PacketRoute struct {
+	FromChainID     string // The hop the packet was posted from
+	FromChainHeight uint64 // The height of the header its proof was checked against
+	SrcChainID      string
+	Sequence        uint64
 }
 
 //--------------------------------------------------------------------------------
@@ -61,12 +137,27 @@ const (
 	IBCTxTypeUpdateChain   = byte(0x02)
 	IBCTxTypePacketCreate  = byte(0x03)
 	IBCTxTypePacketPost    = byte(0x04)
+	IBCTxTypeConnOpen      = byte(0x05)
+	IBCTxTypeConnClose     = byte(0x06)
+	IBCTxTypePacketAck     = byte(0x07)
+	IBCTxTypePacketTimeout = byte(0x08)
+	IBCTxTypeMisbehaviour  = byte(0x09)
 
 	IBCCodeEncodingError       = wrsp.CodeType(1001)
 	IBCCodeChainAlreadyExists  = wrsp.CodeType(1002)
 	IBCCodePacketAlreadyExists = wrsp.CodeType(1003)
 	IBCCodeUnknownHeight       = wrsp.CodeType(1004)
 	IBCCodeInvalidProof        = wrsp.CodeType(1005)
+	IBCCodeInvalidCommit       = wrsp.CodeType(1006)
+	IBCCodeConnectionNotOpen   = wrsp.CodeType(1007)
+	IBCCodeConnectionOpen      = wrsp.CodeType(1008)
+	IBCCodeUnauthorized        = wrsp.CodeType(1009)
+	IBCCodeInvalidSequence     = wrsp.CodeType(1010)
+	IBCCodePacketTimedOut      = wrsp.CodeType(1011)
+	IBCCodeUnknownPacket       = wrsp.CodeType(1012)
+	IBCCodePacketNotTimedOut   = wrsp.CodeType(1013)
+	IBCCodeChainFrozen         = wrsp.CodeType(1014)
+	IBCCodeConflictingHeader   = wrsp.CodeType(1015)
 )
 
 var _ = wire.RegisterInterface(
@@ -75,6 +166,11 @@ var _ = wire.RegisterInterface(
 	wire.ConcreteType{IBCUpdateChainTx{}, IBCTxTypeUpdateChain},
 	wire.ConcreteType{IBCPacketCreateTx{}, IBCTxTypePacketCreate},
 	wire.ConcreteType{IBCPacketPostTx{}, IBCTxTypePacketPost},
+	wire.ConcreteType{IBCConnectionOpenTx{}, IBCTxTypeConnOpen},
+	wire.ConcreteType{IBCConnectionCloseTx{}, IBCTxTypeConnClose},
+	wire.ConcreteType{IBCPacketAckTx{}, IBCTxTypePacketAck},
+	wire.ConcreteType{IBCPacketTimeoutTx{}, IBCTxTypePacketTimeout},
+	wire.ConcreteType{IBCMisbehaviourTx{}, IBCTxTypeMisbehaviour},
 )
 
 type IBCTx interface {
@@ -82,71 +178,302 @@ type IBCTx interface {
 	ValidateBasic() wrsp.Result
 }
 
-func (IBCRegisterChainTx) AssertIsIBCTx() {}
-func (IBCUpdateChainTx) AssertIsIBCTx()   {}
-func (IBCPacketCreateTx) AssertIsIBCTx()  {}
-func (IBCPacketPostTx) AssertIsIBCTx()    {}
-
+func (IBCRegisterChainTx) AssertIsIBCTx()   {}
+func (IBCUpdateChainTx) AssertIsIBCTx()     {}
+func (IBCPacketCreateTx) AssertIsIBCTx()    {}
+func (IBCPacketPostTx) AssertIsIBCTx()      {}
+func (IBCConnectionOpenTx) AssertIsIBCTx()  {}
+func (IBCConnectionCloseTx) AssertIsIBCTx() {}
+func (IBCPacketAckTx) AssertIsIBCTx()       {}
+func (IBCPacketTimeoutTx) AssertIsIBCTx()   {}
+func (IBCMisbehaviourTx) AssertIsIBCTx()    {}
+
+// Registers a new chain, or registers a Frozen one again from a new genesis,
+// after which its old headers are forgotten. Whatever the policy, that
+// takes a registrar, or an approval from ApproveChain.
 type IBCRegisterChainTx struct {
 	BlockchainGenesis
 }
 
-func (IBCRegisterChainTx) ValidateBasic() (res wrsp.Result) {
-	// TODO - validate
-	return
+func (tx IBCRegisterChainTx) ValidateBasic() (res wrsp.Result) {
+	if tx.ChainID == "" {
+		return wrsp.ErrBaseInvalidInput.AppendLog("ChainID is empty")
+	}
+	if tx.Genesis == "" {
+		return wrsp.ErrBaseInvalidInput.AppendLog("Genesis is empty")
+	}
+	return wrsp.OK
 }
 
+// Validators is the set that signed Header, and must hash to
+// Header.ValidatorsHash. It may be left empty if the set hasn't changed
+// since the last update. Heights may be skipped, as long as +2/3 of the
+// last known voting power signed the Commit.
 type IBCUpdateChainTx struct {
-	Header tm.Header
-	Commit tm.Commit
-	// TODO: NextValidators
+	Header     tm.Header
+	Commit     tm.Commit
+	Validators []*tm.Validator
 }
 
-func (IBCUpdateChainTx) ValidateBasic() (res wrsp.Result) {
-	// TODO - validate
-	return
+func (tx IBCUpdateChainTx) ValidateBasic() (res wrsp.Result) {
+	if tx.Header.ChainID == "" {
+		return wrsp.ErrBaseInvalidInput.AppendLog("Header.ChainID is empty")
+	}
+	if tx.Header.Height <= 0 {
+		return wrsp.ErrBaseInvalidInput.AppendLog("Header.Height must be positive")
+	}
+	if len(tx.Commit.Precommits) == 0 {
+		return wrsp.ErrBaseInvalidInput.AppendLog("Commit has no precommits")
+	}
+	for _, val := range tx.Validators {
+		if val == nil {
+			return wrsp.ErrBaseInvalidInput.AppendLog("Validators can't be nil")
+		}
+	}
+	return wrsp.OK
 }
 
+// Packet.Sequence is ignored, the chain assigns the connection's next
+// EgressSequence and returns it in the result Data.
+// Fee is optional, and held from the tx's coins as the packet's RelayFee.
 type IBCPacketCreateTx struct {
 	Packet
+	Fee types.Coins
 }
 
-func (IBCPacketCreateTx) ValidateBasic() (res wrsp.Result) {
-	// TODO - validate
-	return
+func (tx IBCPacketCreateTx) ValidateBasic() (res wrsp.Result) {
+	res = validatePacket(tx.Packet)
+	if res.IsErr() {
+		return res
+	}
+	if !tx.Fee.IsValid() || !tx.Fee.IsNonnegative() {
+		return wrsp.ErrBaseInvalidInput.AppendLog(cmn.Fmt("Invalid relay fee %v", tx.Fee))
+	}
+	return wrsp.OK
 }
 
+// Posts a packet proven in FromChainID's egress, which is its SrcChainID,
+// or the hub set for it with the "IBC/hub" option. It's acked if its
+// DstChainID is this chain, and forwarded if it's another registered chain.
 type IBCPacketPostTx struct {
 	FromChainID     string // The immediate source of the packet, not always Packet.SrcChainID
-	FromChainHeight uint64 // The block height in which Packet was committed, to check Proof
+	FromChainHeight uint64 // The block height in which Packet was committed, to check Proof, or below it if pruned
 	Packet
 	Proof merkle.IAVLProof
 }
 
-func (IBCPacketPostTx) ValidateBasic() (res wrsp.Result) {
-	// TODO - validate
-	return
+func (tx IBCPacketPostTx) ValidateBasic() (res wrsp.Result) {
+	if tx.FromChainID == "" {
+		return wrsp.ErrBaseInvalidInput.AppendLog("FromChainID is empty")
+	}
+	if tx.FromChainHeight == 0 {
+		return wrsp.ErrBaseInvalidInput.AppendLog("FromChainHeight must be positive")
+	}
+	return validatePacket(tx.Packet)
+}
+
+// The SrcChainID's record of a connection, proven from FromChainID,
+// which is SrcChainID or the hub set for it, to open or close the
+// connection on another chain.
+type ConnectionProof struct {
+	FromChainID     string
+	FromChainHeight uint64 // The block height in which Connection was committed, to check Proof, or below it if pruned
+	Connection      Connection
+	Proof           merkle.IAVLProof
+}
+
+// Opens the connection from SrcChainID to DstChainID.
+// On SrcChainID, the "IBC/registration" policy decides who may, and the
+// opener chooses Ordered. Any other chain follows SrcChainID: the tx proves
+// the connection is open there, and its Ordered is taken from the proof.
+// A closed connection may be reopened, keeping its sequences and ordering.
+type IBCConnectionOpenTx struct {
+	SrcChainID string
+	DstChainID string
+	Ordered    bool // Only read on SrcChainID
+	ConnectionProof
+}
+
+func (tx IBCConnectionOpenTx) ValidateBasic() (res wrsp.Result) {
+	return validateChainPair(tx.SrcChainID, tx.DstChainID)
+}
+
+// Closes the connection, after which no packets are created or posted on it.
+// On SrcChainID the policy decides who may, as for IBCConnectionOpenTx.
+// Any other chain closes it once the tx proves SrcChainID closed it.
+type IBCConnectionCloseTx struct {
+	SrcChainID string
+	DstChainID string
+	ConnectionProof
+}
+
+func (tx IBCConnectionCloseTx) ValidateBasic() (res wrsp.Result) {
+	return validateChainPair(tx.SrcChainID, tx.DstChainID)
+}
+
+// Proves the destination's Ack of an egress Packet, which is then pruned.
+// An error Ack refunds the packet, and an IBCCodePacketTimedOut one counts
+// as a timeout. A packet sent through a hub is acked from the hub, which
+// relays the Ack back, see PacketRoute.
+type IBCPacketAckTx struct {
+	FromChainID     string // The chain Ack is proven from, Packet.DstChainID if empty, or the hub set for it
+	FromChainHeight uint64 // The block height of FromChainID in which Ack was committed, to check Proof, or below it if pruned
+	Packet
+	Ack   PacketAck
+	Proof merkle.IAVLProof
+}
+
+func (tx IBCPacketAckTx) ValidateBasic() (res wrsp.Result) {
+	if tx.FromChainHeight == 0 {
+		return wrsp.ErrBaseInvalidInput.AppendLog("FromChainHeight must be positive")
+	}
+	return validatePacket(tx.Packet)
+}
+
+// Proves an egress Packet was never posted to the destination before its
+// TimeoutHeight, by the absence of its ingress key at a later height.
+// The packet is refunded and pruned, and an ordered connection is closed,
+// since the packets after it can't be posted either.
+type IBCPacketTimeoutTx struct {
+	FromChainHeight uint64 // A block height of Packet.DstChainID after Packet.TimeoutHeight
+	Packet
+	Proof AbsenceProof
+}
+
+func (tx IBCPacketTimeoutTx) ValidateBasic() (res wrsp.Result) {
+	if tx.FromChainHeight == 0 {
+		return wrsp.ErrBaseInvalidInput.AppendLog("FromChainHeight must be positive")
+	}
+	if tx.Proof.Left == nil && tx.Proof.Right == nil {
+		return wrsp.ErrBaseInvalidInput.AppendLog("Proof is empty")
+	}
+	return validatePacket(tx.Packet)
+}
+
+// Evidence that a registered chain committed two different headers at
+// the same height. Each update must verify against the chain's validators
+// as an IBCUpdateChainTx would, and the chain is then Frozen.
+type IBCMisbehaviourTx struct {
+	Update1 IBCUpdateChainTx
+	Update2 IBCUpdateChainTx
+}
+
+func (tx IBCMisbehaviourTx) ValidateBasic() (res wrsp.Result) {
+	res = tx.Update1.ValidateBasic()
+	if res.IsErr() {
+		return res
+	}
+	return tx.Update2.ValidateBasic()
+}
+
+func validatePacket(packet Packet) wrsp.Result {
+	res := validateChainPair(packet.SrcChainID, packet.DstChainID)
+	if res.IsErr() {
+		return res
+	}
+	if packet.Type == "" {
+		return wrsp.ErrBaseInvalidInput.AppendLog("Packet.Type is empty")
+	}
+	return wrsp.OK
+}
+
+func validateChainPair(srcChainID, dstChainID string) wrsp.Result {
+	if srcChainID == "" || dstChainID == "" {
+		return wrsp.ErrBaseInvalidInput.AppendLog("SrcChainID and DstChainID can't be empty")
+	}
+	if srcChainID == dstChainID {
+		return wrsp.ErrBaseInvalidInput.AppendLog("SrcChainID and DstChainID must differ")
+	}
+	return wrsp.OK
 }
 
 //--------------------------------------------------------------------------------
 
 type IBCPlugin struct {
+	height   uint64 // Of the current block, for packet timeouts
+	handlers map[string]PacketHandler
+	host     Host
+}
+
+// Host is what the app gives the IBC plugin beyond its own store,
+// see state.Host.
+type Host interface {
+	// The named plugin's store, for its PacketHandler.
+	// store is the one the IBC plugin was handed.
+	PluginStore(store types.KVStore, pluginName string) (types.KVStore, error)
+	// Creates coins in addr, for the vouchers of other chains' coins,
+	// which plugins' Banks can't.
+	Mint(store types.KVStore, addr []byte, coins types.Coins) error
+}
+
+// PacketHandler receives the ingress packets of the Packet.Type it's
+// registered for, once their proof is verified, in the same cache as the
+// rest of the IBCPacketPostTx. If it returns an error nothing it wrote is
+// kept, and the packet is acked with the error. Otherwise the Ack carries
+// its res.Data.
+type PacketHandler interface {
+	// The plugin whose store the handler is given.
+	Name() string
+	ReceivePacket(store types.KVStore, srcChainID string, payload []byte) wrsp.Result
 }
 
 func (ibc *IBCPlugin) Name() string {
 	return "IBC"
 }
 
+// Its keys were stored at the root of the app's store, as they are now.
+func (ibc *IBCPlugin) OwnsLegacyKey(key []byte) bool {
+	return bytes.HasPrefix(key, append(toKey(_IBC), ','))
+}
+
 func (ibc *IBCPlugin) StateKey() []byte {
 	return []byte("IBCPlugin.State")
 }
 
-func New() *IBCPlugin {
-	return &IBCPlugin{}
+func New(host Host) *IBCPlugin {
+	return &IBCPlugin{
+		handlers: make(map[string]PacketHandler),
+		host:     host,
+	}
+}
+
+// Lets another plugin claim the ingress packets of packetType.
+// Packets of a type nobody claims are only stored.
+func (ibc *IBCPlugin) RegisterPacketHandler(packetType string, handler PacketHandler) {
+	if packetType == PacketTypeCoin {
+		cmn.PanicSanity("Packet type " + packetType + " is handled by the IBC plugin")
+	}
+	if ibc.host == nil {
+		cmn.PanicSanity("Packet handlers need the plugin to have a Host")
+	}
+	if _, ok := ibc.handlers[packetType]; ok {
+		cmn.PanicSanity("Packet type " + packetType + " already has a handler")
+	}
+	ibc.handlers[packetType] = handler
 }
 
 func (ibc *IBCPlugin) SetOption(store types.KVStore, key string, value string) (log string) {
-	return ""
+	switch key {
+	case "costs":
+		var err error
+		var costs IBCCosts
+		wire.ReadJSONPtr(&costs, []byte(value), &err)
+		if err != nil {
+			return "Error decoding costs: " + err.Error()
+		}
+		if !costs.IsValid() {
+			return "Invalid costs: " + value
+		}
+		save(store, toKey(_IBC, _COSTS), costs)
+		return "Success"
+	case "registration", "registrar", "revoke_registrar", "approve":
+		return setRegistrationOption(store, key, value)
+	case "header_retention":
+		return setRetentionOption(store, value)
+	case "hub":
+		return setHubOption(store, value)
+	}
+	return "Unrecognized option key " + key
 }
 
 func (ibc *IBCPlugin) RunTx(store types.KVStore, ctx types.CallContext, txBytes []byte) (res wrsp.Result) {
@@ -163,16 +490,14 @@ func (ibc *IBCPlugin) RunTx(store types.KVStore, ctx types.CallContext, txBytes
 		return res.PrependLog("ValidateBasic Failed: ")
 	}
 
-	// TODO - Check whether sufficient funds
-
-	defer func() {
-		// TODO - Refund any remaining funds left over
-		// e.g. !ctx.Coins.Minus(tx.Fee).IsZero()
-		// ctx.CallerAccount is synced w/ store, so just modify that and store it.
-		// NOTE: We should use the CallContext to store fund/refund information.
-	}()
+	sm := &IBCStateMachine{store, ctx, ibc.height, ibc.handlers, ibc.host, wrsp.OK}
 
-	sm := &IBCStateMachine{store, ctx, wrsp.OK}
+	// Charge the tx's cost from ctx.Coins().
+	// The state machine takes any coins it keeps from sm.ctx.Coins() too.
+	sm.chargeCost(tx)
+	if sm.res.IsErr() {
+		return sm.res
+	}
 
 	switch tx := tx.(type) {
 	case IBCRegisterChainTx:
@@ -183,15 +508,34 @@ func (ibc *IBCPlugin) RunTx(store types.KVStore, ctx types.CallContext, txBytes
 		sm.runPacketCreateTx(tx)
 	case IBCPacketPostTx:
 		sm.runPacketPostTx(tx)
+	case IBCConnectionOpenTx:
+		sm.runConnectionOpenTx(tx)
+	case IBCConnectionCloseTx:
+		sm.runConnectionCloseTx(tx)
+	case IBCPacketAckTx:
+		sm.runPacketAckTx(tx)
+	case IBCPacketTimeoutTx:
+		sm.runPacketTimeoutTx(tx)
+	case IBCMisbehaviourTx:
+		sm.runMisbehaviourTx(tx)
 	}
 
+	// Refund the rest. On error, the AppTx refunds all of ctx.Coins().
+	if sm.res.IsOK() {
+		if res := sm.ctx.Refund(); res.IsErr() {
+			return res
+		}
+	}
 	return sm.res
 }
 
 type IBCStateMachine struct {
-	store types.KVStore
-	ctx   types.CallContext
-	res   wrsp.Result
+	store    types.KVStore
+	ctx      types.CallContext
+	height   uint64
+	handlers map[string]PacketHandler
+	host     Host
+	res      wrsp.Result
 }
 
 func (sm *IBCStateMachine) runRegisterChainTx(tx IBCRegisterChainTx) {
@@ -204,18 +548,43 @@ func (sm *IBCStateMachine) runRegisterChainTx(tx IBCRegisterChainTx) {
 	var err error
 	wire.ReadJSONPtr(&chainGenDoc, []byte(chainGen.Genesis), &err)
 	if err != nil {
-		sm.res.Code = IBCCodeEncodingError
-		sm.res.AppendLog("Genesis doc couldn't be parsed: " + err.Error())
+		sm.res = wrsp.NewError(IBCCodeEncodingError, "Genesis doc couldn't be parsed: "+err.Error())
+		return
+	}
+	if chainGenDoc.ChainID != tx.ChainID {
+		sm.res = wrsp.ErrBaseInvalidInput.AppendLog(
+			cmn.Fmt("Registering %v with the genesis of %v", tx.ChainID, chainGenDoc.ChainID))
+		return
+	}
+	if len(chainGenDoc.Validators) == 0 {
+		sm.res = wrsp.ErrBaseInvalidInput.AppendLog("Genesis has no validators")
 		return
 	}
 
-	// Make sure chainGen doesn't already exist
-	if exists(sm.store, chainGenKey) {
-		sm.res.Code = IBCCodeChainAlreadyExists
-		sm.res.AppendLog("Already exists")
+	// Make sure the caller may register it
+	if !sm.checkRegistration(chainGen) {
 		return
 	}
 
+	// Make sure chainGen doesn't already exist, unless the chain is frozen
+	if exists(sm.store, chainGenKey) {
+		var oldState BlockchainState
+		_, err := load(sm.store, chainStateKey, &oldState)
+		if err != nil {
+			sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading ChainState: %v", err.Error()))
+			return
+		}
+		if !oldState.Frozen {
+			sm.res = wrsp.NewError(IBCCodeChainAlreadyExists, "Already exists")
+			return
+		}
+		if !sm.checkReregistration(chainGen) {
+			return
+		}
+		// Headers from either side of the fork can't be trusted
+		sm.deleteHeaders(tx.ChainID)
+	}
+
 	// Save new BlockchainGenesis
 	save(sm.store, chainGenKey, chainGen)
 
@@ -239,6 +608,7 @@ func (sm *IBCStateMachine) runRegisterChainTx(tx IBCRegisterChainTx) {
 
 	// Save new BlockchainState
 	save(sm.store, chainStateKey, chainState)
+	sm.store.Delete(toKey(_IBC, _APPROVAL, tx.ChainID))
 }
 
 func (sm *IBCStateMachine) runUpdateChainTx(tx IBCUpdateChainTx) {
@@ -261,21 +631,49 @@ func (sm *IBCStateMachine) runUpdateChainTx(tx IBCUpdateChainTx) {
 		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Missing ChainState"))
 		return
 	}
+	if chainState.Frozen {
+		sm.res = wrsp.NewError(IBCCodeChainFrozen, cmn.Fmt("Chain %v is frozen", chainID))
+		return
+	}
 
 	// Check commit against last known state & validators
-	err = verifyCommit(chainState, &tx.Header, &tx.Commit)
+	valSet, err := verifyCommit(chainState, &tx.Header, &tx.Commit, tx.Validators)
 	if err != nil {
-		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Invalid Commit: %v", err.Error()))
+		sm.res = wrsp.NewError(IBCCodeInvalidCommit, cmn.Fmt("Invalid Commit: %v", err.Error()))
 		return
 	}
 
-	// Store header
-	headerKey := toKey(_IBC, _BLOCKCHAIN, _HEADER, chainID, cmn.Fmt("%v", tx.Header.Height))
+	// A stored header is never replaced.
+	// A different one at the same height is evidence for IBCMisbehaviourTx.
+	headerKey := headerKey(chainID, uint64(tx.Header.Height))
+	var stored tm.Header
+	exists, err = load(sm.store, headerKey, &stored)
+	if err != nil {
+		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading Header: %v", err.Error()))
+		return
+	}
+	if exists && !bytes.Equal(stored.Hash(), tx.Header.Hash()) {
+		sm.res = wrsp.NewError(IBCCodeConflictingHeader, cmn.Fmt("Header conflicts with the one stored at height %v", tx.Header.Height))
+		return
+	}
+
+	// Store header, and make room for it
 	save(sm.store, headerKey, tx.Header)
+	sm.pruneHeaders(chainID)
+	if sm.res.IsErr() {
+		return
+	}
+
+	// Older headers may be stored for packet proofs,
+	// but only a newer one moves the chainState forward.
+	if uint64(tx.Header.Height) <= chainState.LastBlockHeight {
+		return
+	}
 
 	// Update chainState
 	chainState.LastBlockHash = tx.Header.Hash()
 	chainState.LastBlockHeight = uint64(tx.Header.Height)
+	chainState.Validators = valSet.Validators
 
 	// Store chainState
 	save(sm.store, chainStateKey, chainState)
@@ -283,6 +681,18 @@ func (sm *IBCStateMachine) runUpdateChainTx(tx IBCUpdateChainTx) {
 
 func (sm *IBCStateMachine) runPacketCreateTx(tx IBCPacketCreateTx) {
 	packet := tx.Packet
+	if packet.SrcChainID != sm.ctx.ChainID {
+		sm.res = wrsp.ErrBaseInvalidInput.AppendLog(cmn.Fmt("Packets created here are from %v, not %v", sm.ctx.ChainID, packet.SrcChainID))
+		return
+	}
+	connKey := toKey(_IBC, _CONNECTION, packet.SrcChainID, packet.DstChainID)
+	conn, ok := sm.loadOpenConnection(connKey)
+	if !ok {
+		return
+	}
+
+	// Assign the next sequence
+	packet.Sequence = conn.EgressSequence
 	packetKey := toKey(_IBC, _EGRESS,
 		packet.SrcChainID,
 		packet.DstChainID,
@@ -290,12 +700,27 @@ func (sm *IBCStateMachine) runPacketCreateTx(tx IBCPacketCreateTx) {
 	)
 	// Make sure packet doesn't already exist
 	if exists(sm.store, packetKey) {
-		sm.res.Code = IBCCodePacketAlreadyExists
-		sm.res.AppendLog("Already exists")
+		sm.res = wrsp.NewError(IBCCodePacketAlreadyExists, "Already exists")
 		return
 	}
+	if packet.Type == PacketTypeCoin {
+		sm.sendCoins(&packet)
+		if sm.res.IsErr() {
+			return
+		}
+	}
+	if !tx.Fee.IsZero() {
+		sm.holdRelayFee(packet, tx.Fee)
+		if sm.res.IsErr() {
+			return
+		}
+	}
 	// Save new Packet
-	save(sm.store, packetKey, wire.BinaryBytes(packet))
+	save(sm.store, packetKey, packet)
+
+	conn.EgressSequence++
+	save(sm.store, connKey, conn)
+	sm.res.Data = wire.BinaryBytes(packet.Sequence)
 }
 
 func (sm *IBCStateMachine) runPacketPostTx(tx IBCPacketPostTx) {
@@ -310,31 +735,50 @@ func (sm *IBCStateMachine) runPacketPostTx(tx IBCPacketPostTx) {
 		packet.SrcChainID,
 		cmn.Fmt("%v", packet.Sequence),
 	)
-	headerKey := toKey(_IBC, _BLOCKCHAIN, _HEADER,
-		tx.FromChainID,
-		cmn.Fmt("%v", tx.FromChainHeight),
+	ackKey := toKey(_IBC, _ACK,
+		packet.SrcChainID,
+		packet.DstChainID,
+		cmn.Fmt("%v", packet.Sequence),
 	)
+	connKey := toKey(_IBC, _CONNECTION, packet.SrcChainID, packet.DstChainID)
 
-	// Make sure packet doesn't already exist
-	if exists(sm.store, packetKeyIngress) {
-		sm.res.Code = IBCCodePacketAlreadyExists
-		sm.res.AppendLog("Already exists")
+	// Packets for another registered chain are forwarded to it.
+	forward := packet.DstChainID != sm.ctx.ChainID &&
+		exists(sm.store, toKey(_IBC, _BLOCKCHAIN, _GENESIS, packet.DstChainID))
+	if !forward && packet.DstChainID != sm.ctx.ChainID {
+		sm.res = wrsp.ErrBaseInvalidInput.AppendLog(cmn.Fmt("Packet is for %v, which is neither this chain nor registered", packet.DstChainID))
 		return
 	}
 
-	// Save new Packet
-	save(sm.store, packetKeyIngress, wire.BinaryBytes(packet))
+	// A chain can only prove its own packets, or those it's the hub for
+	if !sm.checkHub(packet.SrcChainID, tx.FromChainID) {
+		return
+	}
 
-	// Load Header and make sure it exists
-	var header tm.Header
-	exists, err := load(sm.store, headerKey, &header)
-	if err != nil {
-		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading Header: %v", err.Error()))
+	// Make sure packet doesn't already exist
+	if exists(sm.store, packetKeyIngress) || (forward && exists(sm.store, packetKeyEgress)) {
+		sm.res = wrsp.NewError(IBCCodePacketAlreadyExists, "Already exists")
 		return
 	}
-	if !exists {
-		sm.res.Code = IBCCodeUnknownHeight
-		sm.res.AppendLog(cmn.Fmt("Loading Header: %v", err.Error()))
+
+	// Make sure the connection is open, and the packet is next if ordered
+	conn, ok := sm.loadOpenConnection(connKey)
+	if !ok {
+		return
+	}
+	if conn.Ordered && packet.Sequence != conn.IngressSequence {
+		sm.res = wrsp.NewError(IBCCodeInvalidSequence, cmn.Fmt("Expected packet sequence %v, got %v", conn.IngressSequence, packet.Sequence))
+		return
+	}
+	// TimeoutHeight is for the destination to check
+	if !forward && packet.TimeoutHeight != 0 && sm.height > packet.TimeoutHeight {
+		sm.res = wrsp.NewError(IBCCodePacketTimedOut, cmn.Fmt("Packet timed out at height %v", packet.TimeoutHeight))
+		return
+	}
+
+	// Load Header and make sure it exists
+	header, ok := sm.loadHeader(tx.FromChainID, tx.FromChainHeight)
+	if !ok {
 		return
 	}
 
@@ -343,8 +787,7 @@ func (sm *IBCStateMachine) runPacketPostTx(tx IBCPacketPostTx) {
 		var proof *merkle.IAVLProof
 		err = wire.ReadBinaryBytes(tx.Proof, &proof)
 		if err != nil {
-			sm.res.Code = IBCEncodingError
-			sm.res.AppendLog(cmn.Fmt("Reading Proof: %v", err.Error()))
+			sm.res = wrsp.NewError(IBCCodeEncodingError, cmn.Fmt("Reading Proof: %v", err.Error()))
 			return
 		}
 	*/
@@ -352,21 +795,528 @@ func (sm *IBCStateMachine) runPacketPostTx(tx IBCPacketPostTx) {
 	packetBytes := wire.BinaryBytes(packet)
 
 	// Make sure packet's proof matches given (packet, key, blockhash)
-	ok := proof.Verify(packetKeyEgress, packetBytes, header.AppHash)
+	ok = proof.Verify(provenKey(packetKeyEgress), packetBytes, header.AppHash)
 	if !ok {
-		sm.res.Code = IBCCodeInvalidProof
-		sm.res.AppendLog("Proof is invalid")
+		sm.res = wrsp.NewError(IBCCodeInvalidProof, "Proof is invalid")
 		return
 	}
 
-	return
+	if forward {
+		sm.forwardPacket(tx, header)
+		if sm.res.IsErr() {
+			return
+		}
+	} else {
+		// Save new Packet, and Ack it
+		ack := PacketAck{Code: wrsp.CodeType_OK, Relayer: sm.ctx.CallerAddress}
+		if packet.Type == PacketTypeCoin {
+			res := sm.receiveCoins(packet)
+			if res.IsErr() {
+				ack.Code, ack.Data = res.Code, []byte(res.Log)
+			}
+		} else if handler, ok := sm.handlers[packet.Type]; ok {
+			res := sm.handlePacket(handler, packet)
+			if res.IsErr() {
+				ack.Code, ack.Data = res.Code, []byte(res.Log)
+			} else {
+				ack.Data = res.Data
+			}
+		}
+		save(sm.store, packetKeyIngress, packet)
+		save(sm.store, ackKey, ack)
+	}
+
+	if conn.Ordered {
+		conn.IngressSequence++
+		save(sm.store, connKey, conn)
+	}
+}
+
+// Runs the handler in a cache of its plugin's store,
+// which is only synced if it succeeds.
+func (sm *IBCStateMachine) handlePacket(handler PacketHandler, packet Packet) wrsp.Result {
+	store, err := sm.host.PluginStore(sm.store, handler.Name())
+	if err != nil {
+		return wrsp.ErrInternalError.AppendLog("Error reaching the handler's store: " + err.Error())
+	}
+	cache := types.NewKVCache(store)
+	res := handler.ReceivePacket(cache, packet.SrcChainID, packet.Payload)
+	if res.IsOK() {
+		cache.Sync()
+	}
+	return res
+}
+
+// Puts the packet in egress as it is, and records its route.
+// Its coins, if any, pass through untouched.
+func (sm *IBCStateMachine) forwardPacket(tx IBCPacketPostTx, header tm.Header) {
+	packet := tx.Packet
+	packetKey := toKey(_IBC, _EGRESS,
+		packet.SrcChainID,
+		packet.DstChainID,
+		cmn.Fmt("%v", packet.Sequence),
+	)
+	save(sm.store, packetKey, packet)
+
+	countKey := toKey(_IBC, _FORWARD, packet.DstChainID)
+	var count uint64
+	_, err := load(sm.store, countKey, &count)
+	if err != nil {
+		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading forward count: %v", err.Error()))
+		return
+	}
+	route := PacketRoute{
+		FromChainID:     tx.FromChainID,
+		FromChainHeight: uint64(header.Height),
+		SrcChainID:      packet.SrcChainID,
+		Sequence:        packet.Sequence,
+	}
+	save(sm.store, toKey(_IBC, _FORWARD, packet.DstChainID, cmn.Fmt("%v", count)), route)
+	save(sm.store, countKey, count+1)
+	save(sm.store, routeKey(packet), route)
+	sm.pinHeader(route.FromChainID, route.FromChainHeight)
+	sm.ctx.FireEvent("Forward", packet)
+}
+
+func routeKey(packet Packet) []byte {
+	return toKey(_IBC, _ROUTE,
+		packet.SrcChainID,
+		packet.DstChainID,
+		cmn.Fmt("%v", packet.Sequence),
+	)
+}
+
+// Forgets the route of a forwarded packet leaving egress, and unpins its header.
+// Returns false if the packet wasn't forwarded.
+func (sm *IBCStateMachine) releaseRoute(packet Packet) (forwarded bool) {
+	var route PacketRoute
+	exists, err := load(sm.store, routeKey(packet), &route)
+	if err != nil {
+		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading PacketRoute: %v", err.Error()))
+		return false
+	}
+	if !exists {
+		return false
+	}
+	sm.unpinHeader(route.FromChainID, route.FromChainHeight)
+	sm.store.Delete(routeKey(packet))
+	return true
+}
+
+func (sm *IBCStateMachine) runPacketAckTx(tx IBCPacketAckTx) {
+	packet := tx.Packet
+	ackKey := toKey(_IBC, _ACK,
+		packet.SrcChainID,
+		packet.DstChainID,
+		cmn.Fmt("%v", packet.Sequence),
+	)
+
+	packetKeyEgress, ok := sm.loadEgressPacket(packet)
+	if !ok {
+		return
+	}
+	fromChainID := tx.FromChainID
+	if fromChainID == "" {
+		fromChainID = packet.DstChainID
+	}
+	if !sm.checkHub(packet.DstChainID, fromChainID) {
+		return
+	}
+	header, ok := sm.loadHeader(fromChainID, tx.FromChainHeight)
+	if !ok {
+		return
+	}
 
+	// Make sure ack's proof matches given (ack, key, blockhash)
+	ok = tx.Proof.Verify(provenKey(ackKey), wire.BinaryBytes(tx.Ack), header.AppHash)
+	if !ok {
+		sm.res = wrsp.NewError(IBCCodeInvalidProof, "Proof is invalid")
+		return
+	}
+
+	// A forwarded packet's Ack is relayed back, and its coins are
+	// refunded where they came from
+	forwarded := sm.releaseRoute(packet)
+	if sm.res.IsErr() {
+		return
+	}
+	if forwarded {
+		save(sm.store, ackKey, tx.Ack)
+	} else if tx.Ack.Code != wrsp.CodeType_OK {
+		sm.refundPacket(packet)
+		if sm.res.IsErr() {
+			return
+		}
+	}
+	sm.releaseRelayFee(packet, tx.Ack.Relayer)
+	if sm.res.IsErr() {
+		return
+	}
+	sm.store.Delete(packetKeyEgress)
+	if tx.Ack.Code == IBCCodePacketTimedOut {
+		sm.closeOrderedConnection(packet)
+	}
+}
+
+func (sm *IBCStateMachine) runPacketTimeoutTx(tx IBCPacketTimeoutTx) {
+	packet := tx.Packet
+	packetKeyIngress := toKey(_IBC, _INGRESS,
+		packet.DstChainID,
+		packet.SrcChainID,
+		cmn.Fmt("%v", packet.Sequence),
+	)
+
+	packetKeyEgress, ok := sm.loadEgressPacket(packet)
+	if !ok {
+		return
+	}
+	header, ok := sm.loadHeader(packet.DstChainID, tx.FromChainHeight)
+	if !ok {
+		return
+	}
+
+	// The AppHash of header H commits to the state after block H-1,
+	// so posting at TimeoutHeight is ruled out from TimeoutHeight+1.
+	if packet.TimeoutHeight == 0 || uint64(header.Height) <= packet.TimeoutHeight {
+		sm.res = wrsp.NewError(IBCCodePacketNotTimedOut, cmn.Fmt("Packet times out at height %v, header is at %v", packet.TimeoutHeight, header.Height))
+		return
+	}
+
+	// Make sure the packet is absent from the destination's ingress
+	ok = tx.Proof.Verify(provenKey(packetKeyIngress), header.AppHash)
+	if !ok {
+		sm.res = wrsp.NewError(IBCCodeInvalidProof, "Proof is invalid")
+		return
+	}
+
+	// A forwarded packet's timeout is relayed back as an Ack
+	forwarded := sm.releaseRoute(packet)
+	if sm.res.IsErr() {
+		return
+	}
+	if forwarded {
+		ackKey := toKey(_IBC, _ACK,
+			packet.SrcChainID,
+			packet.DstChainID,
+			cmn.Fmt("%v", packet.Sequence),
+		)
+		save(sm.store, ackKey, PacketAck{
+			Code: IBCCodePacketTimedOut,
+			Data: []byte(cmn.Fmt("Packet timed out at height %v", packet.TimeoutHeight)),
+		})
+	} else {
+		sm.refundPacket(packet)
+		if sm.res.IsErr() {
+			return
+		}
+	}
+	sm.releaseRelayFee(packet, nil)
+	if sm.res.IsErr() {
+		return
+	}
+	sm.store.Delete(packetKeyEgress)
+	sm.closeOrderedConnection(packet)
+}
+
+// Closes the packet's connection if it's ordered, once the packet timed
+// out, since the packets after it can't be posted either.
+func (sm *IBCStateMachine) closeOrderedConnection(packet Packet) {
+	connKey := toKey(_IBC, _CONNECTION, packet.SrcChainID, packet.DstChainID)
+	var conn Connection
+	exists, err := load(sm.store, connKey, &conn)
+	if err != nil {
+		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading Connection: %v", err.Error()))
+		return
+	}
+	if exists && conn.Ordered {
+		conn.Open = false
+		save(sm.store, connKey, conn)
+	}
+}
+
+// Called when the destination chain won't process the packet,
+// on an error Ack or a timeout.
+func (sm *IBCStateMachine) refundPacket(packet Packet) {
+	if packet.Type == PacketTypeCoin {
+		sm.refundCoins(packet)
+		if sm.res.IsErr() {
+			return
+		}
+	}
+	sm.ctx.FireEvent("Refund", packet)
+}
+
+// Makes sure the packet is still in egress, as given.
+// Returns its key, or sets sm.res.
+func (sm *IBCStateMachine) loadEgressPacket(packet Packet) (packetKey []byte, ok bool) {
+	packetKey = toKey(_IBC, _EGRESS,
+		packet.SrcChainID,
+		packet.DstChainID,
+		cmn.Fmt("%v", packet.Sequence),
+	)
+	if !bytes.Equal(sm.store.Get(packetKey), wire.BinaryBytes(packet)) {
+		sm.res = wrsp.NewError(IBCCodeUnknownPacket, cmn.Fmt("No such egress packet %s", packetKey))
+		return nil, false
+	}
+	return packetKey, true
+}
+
+// Loads the first header of chainID stored at or above height,
+// since the one at height may have been pruned.
+// Sets sm.res if there's none, or chainID is frozen.
+func (sm *IBCStateMachine) loadHeader(chainID string, height uint64) (header tm.Header, ok bool) {
+	var chainState BlockchainState
+	_, err := load(sm.store, toKey(_IBC, _BLOCKCHAIN, _STATE, chainID), &chainState)
+	if err != nil {
+		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading ChainState: %v", err.Error()))
+		return header, false
+	}
+	if chainState.Frozen {
+		sm.res = wrsp.NewError(IBCCodeChainFrozen, cmn.Fmt("Chain %v is frozen", chainID))
+		return header, false
+	}
+
+	iter := sm.store.Iterator(headerKey(chainID, height), types.PrefixEndBytes(headerPrefix(chainID)))
+	defer iter.Close()
+	if !iter.Valid() {
+		sm.res = wrsp.NewError(IBCCodeUnknownHeight, cmn.Fmt("Loading Header: no header for %v at or above height %v", chainID, height))
+		return header, false
+	}
+	err = wire.ReadBinaryBytes(iter.Value(), &header)
+	if err != nil {
+		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading Header: %v", err.Error()))
+		return header, false
+	}
+	return header, true
+}
+
+func (sm *IBCStateMachine) runMisbehaviourTx(tx IBCMisbehaviourTx) {
+	header1, header2 := tx.Update1.Header, tx.Update2.Header
+	if header1.ChainID != header2.ChainID || header1.Height != header2.Height {
+		sm.res = wrsp.ErrBaseInvalidInput.AppendLog("Headers must be of the same chain and height")
+		return
+	}
+	if bytes.Equal(header1.Hash(), header2.Hash()) {
+		sm.res = wrsp.ErrBaseInvalidInput.AppendLog("Headers are the same")
+		return
+	}
+
+	chainStateKey := toKey(_IBC, _BLOCKCHAIN, _STATE, header1.ChainID)
+	var chainState BlockchainState
+	exists, err := load(sm.store, chainStateKey, &chainState)
+	if err != nil {
+		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading ChainState: %v", err.Error()))
+		return
+	}
+	if !exists {
+		sm.res = wrsp.ErrBaseInvalidInput.AppendLog(cmn.Fmt("Unknown chain %v", header1.ChainID))
+		return
+	}
+	if chainState.Frozen {
+		sm.res = wrsp.NewError(IBCCodeChainFrozen, cmn.Fmt("Chain %v is already frozen", header1.ChainID))
+		return
+	}
+
+	// Both must be signed by validators we trust,
+	// or we'd never have accepted either.
+	for _, update := range []IBCUpdateChainTx{tx.Update1, tx.Update2} {
+		_, err := verifyCommit(chainState, &update.Header, &update.Commit, update.Validators)
+		if err != nil {
+			sm.res = wrsp.NewError(IBCCodeInvalidCommit, cmn.Fmt("Invalid Commit: %v", err.Error()))
+			return
+		}
+	}
+
+	chainState.Frozen = true
+	save(sm.store, chainStateKey, chainState)
+	sm.ctx.FireEvent("Frozen", chainState)
+}
+
+// Forgets every stored header of chainID.
+func (sm *IBCStateMachine) deleteHeaders(chainID string) {
+	var keys [][]byte
+	iter := types.PrefixIterator(sm.store, headerPrefix(chainID))
+	for ; iter.Valid(); iter.Next() {
+		keys = append(keys, iter.Key())
+	}
+	iter.Close()
+	for _, key := range keys {
+		sm.store.Delete(key)
+	}
+}
+
+func (sm *IBCStateMachine) runConnectionOpenTx(tx IBCConnectionOpenTx) {
+	connKey := toKey(_IBC, _CONNECTION, tx.SrcChainID, tx.DstChainID)
+
+	var conn Connection
+	exists, err := load(sm.store, connKey, &conn)
+	if err != nil {
+		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading Connection: %v", err.Error()))
+		return
+	}
+	if exists && conn.Open {
+		sm.res = wrsp.NewError(IBCCodeConnectionOpen, "Already open")
+		return
+	}
+	if !exists {
+		conn = Connection{
+			SrcChainID: tx.SrcChainID,
+			DstChainID: tx.DstChainID,
+		}
+	}
+
+	if tx.SrcChainID == sm.ctx.ChainID {
+		if !sm.checkConnection(conn, !exists) {
+			return
+		}
+		if !exists {
+			conn.Owner = sm.ctx.CallerAddress
+			conn.Ordered = tx.Ordered
+		}
+	} else {
+		source, ok := sm.verifyConnection(&conn, tx.ConnectionProof)
+		if !ok {
+			return
+		}
+		if !source.Open {
+			sm.res = wrsp.NewError(IBCCodeConnectionNotOpen, cmn.Fmt("Connection is not open on %v", tx.FromChainID))
+			return
+		}
+		conn.Ordered = source.Ordered
+	}
+
+	conn.Open = true
+	save(sm.store, connKey, conn)
+}
+
+func (sm *IBCStateMachine) runConnectionCloseTx(tx IBCConnectionCloseTx) {
+	connKey := toKey(_IBC, _CONNECTION, tx.SrcChainID, tx.DstChainID)
+	conn, ok := sm.loadOpenConnection(connKey)
+	if !ok {
+		return
+	}
+
+	if tx.SrcChainID == sm.ctx.ChainID {
+		if !sm.checkConnection(conn, false) {
+			return
+		}
+	} else {
+		source, ok := sm.verifyConnection(&conn, tx.ConnectionProof)
+		if !ok {
+			return
+		}
+		if source.Open {
+			sm.res = wrsp.NewError(IBCCodeConnectionOpen, cmn.Fmt("Connection is still open on %v", tx.FromChainID))
+			return
+		}
+	}
+
+	conn.Open = false
+	save(sm.store, connKey, conn)
+}
+
+// Verifies the proof of the source's record of conn, from the source or
+// the hub set for it. A proof from the chain conn was last proven from
+// must be of a later header. Records the proof in conn and returns the
+// source's record, or sets sm.res.
+func (sm *IBCStateMachine) verifyConnection(conn *Connection, proof ConnectionProof) (source Connection, ok bool) {
+	source = proof.Connection
+	if proof.FromChainID == "" {
+		sm.res = wrsp.ErrBaseInvalidInput.AppendLog(cmn.Fmt("The connection follows %v, and takes a proof of it", conn.SrcChainID))
+		return source, false
+	}
+	if source.SrcChainID != conn.SrcChainID || source.DstChainID != conn.DstChainID {
+		sm.res = wrsp.ErrBaseInvalidInput.AppendLog(cmn.Fmt("Proven connection is from %v to %v", source.SrcChainID, source.DstChainID))
+		return source, false
+	}
+	if !sm.checkHub(conn.SrcChainID, proof.FromChainID) {
+		return source, false
+	}
+	header, ok := sm.loadHeader(proof.FromChainID, proof.FromChainHeight)
+	if !ok {
+		return source, false
+	}
+	if proof.FromChainID == conn.ProvenFrom && uint64(header.Height) <= conn.ProvenHeight {
+		sm.res = wrsp.NewError(IBCCodeInvalidProof, cmn.Fmt("Connection was proven from %v at height %v already", conn.ProvenFrom, conn.ProvenHeight))
+		return source, false
+	}
+
+	connKey := toKey(_IBC, _CONNECTION, conn.SrcChainID, conn.DstChainID)
+	if !proof.Proof.Verify(provenKey(connKey), wire.BinaryBytes(source), header.AppHash) {
+		sm.res = wrsp.NewError(IBCCodeInvalidProof, "Proof is invalid")
+		return source, false
+	}
+	conn.ProvenFrom = proof.FromChainID
+	conn.ProvenHeight = uint64(header.Height)
+	return source, true
+}
+
+// Sets sm.res if the connection doesn't exist or is closed.
+func (sm *IBCStateMachine) loadOpenConnection(connKey []byte) (conn Connection, ok bool) {
+	exists, err := load(sm.store, connKey, &conn)
+	if err != nil {
+		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading Connection: %v", err.Error()))
+		return conn, false
+	}
+	if !exists || !conn.Open {
+		sm.res = wrsp.NewError(IBCCodeConnectionNotOpen, cmn.Fmt("Connection %s is not open", connKey))
+		return conn, false
+	}
+	return conn, true
+}
+
+// Query paths, answered with the go-wire encoded value:
+//
+//	/genesis/<ChainID>                 BlockchainGenesis
+//	/state/<ChainID>                   BlockchainState
+//	/header/<ChainID>/<Height>         tm.Header
+//	/headers/<ChainID>                 []uint64, the heights of the stored headers, without a proof
+//	/egress/<Src>/<Dst>/<Sequence>     Packet
+//	/ingress/<Dst>/<Src>/<Sequence>    Packet
+//	/connection/<Src>/<Dst>            Connection
+//	/ack/<Src>/<Dst>/<Sequence>        PacketAck
+//	/forward/<Dst>                     uint64, the number of packets forwarded
+//	/forward/<Dst>/<Index>             PacketRoute
+func (ibc *IBCPlugin) Query(store types.KVStore, reqQuery wrsp.RequestQuery) (resQuery wrsp.ResponseQuery) {
+	parts := strings.Split(strings.TrimPrefix(reqQuery.Path, "/"), "/")
+	var key []byte
+	switch {
+	case len(parts) == 2 && (parts[0] == _GENESIS || parts[0] == _STATE):
+		key = toKey(_IBC, _BLOCKCHAIN, parts[0], parts[1])
+	case len(parts) == 3 && parts[0] == _HEADER:
+		height, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			resQuery.Code = wrsp.CodeType_BaseInvalidInput
+			resQuery.Log = "Invalid height " + parts[2]
+			return
+		}
+		key = headerKey(parts[1], height)
+	case len(parts) == 2 && parts[0] == "headers":
+		resQuery.Value = wire.BinaryBytes(headerHeights(store, parts[1]))
+		return
+	case len(parts) == 3 && parts[0] == _CONNECTION:
+		key = toKey(_IBC, _CONNECTION, parts[1], parts[2])
+	case len(parts) == 2 && parts[0] == _FORWARD:
+		key = toKey(_IBC, _FORWARD, parts[1])
+	case len(parts) == 3 && parts[0] == _FORWARD:
+		key = toKey(_IBC, _FORWARD, parts[1], parts[2])
+	case len(parts) == 4 && (parts[0] == _EGRESS || parts[0] == _INGRESS || parts[0] == _ACK):
+		key = toKey(_IBC, parts[0], parts[1], parts[2], parts[3])
+	default:
+		resQuery.Code = wrsp.CodeType_UnknownRequest
+		resQuery.Log = "Unknown query path " + reqQuery.Path
+		return
+	}
+	resQuery.Key = key
+	resQuery.Value = store.Get(key)
+	return
 }
 
 func (ibc *IBCPlugin) InitChain(store types.KVStore, vals []*wrsp.Validator) {
 }
 
 func (ibc *IBCPlugin) BeginBlock(store types.KVStore, height uint64) {
+	ibc.height = height
 }
 
 func (ibc *IBCPlugin) EndBlock(store types.KVStore, height uint64) []*wrsp.Validator {
@@ -414,35 +1364,111 @@ func toKey(parts ...string) []byte {
 	return []byte(strings.Join(escParts, ","))
 }
 
-// NOTE: Commit's votes include ValidatorAddress, so can be matched up
-// against chainState.Validators, even if the validator set had changed.
-// For the purpose of the demo, we assume that the validator set hadn't changed,
-// though we should check that explicitly.
-func verifyCommit(chainState BlockchainState, header *tm.Header, commit *tm.Commit) error {
+// Proofs from other chains are of keys in the app's store,
+// where their IBC plugin's keys are under its prefix.
+func provenKey(key []byte) []byte {
+	return append(types.PluginPrefix("IBC"), key...)
+}
 
-	// Ensure that chainState and header ChainID match.
-	if chainState.ChainID != header.ChainID {
-		return errors.New(cmn.Fmt("Expected header.ChainID %v, got %v", chainState.ChainID, header.ChainID))
-	}
+// Returns the validator set that signed the header, see VerifyCommit.
+func verifyCommit(chainState BlockchainState, header *tm.Header, commit *tm.Commit, vals []*tm.Validator) (*tm.ValidatorSet, error) {
 	if len(chainState.Validators) == 0 {
-		return errors.New(cmn.Fmt("Blockchain has no validators")) // NOTE: Why would this happen?
+		return nil, errors.New(cmn.Fmt("Blockchain has no validators")) // NOTE: Why would this happen?
+	}
+	return VerifyCommit(chainState.ChainID, chainState.Validators, header, commit, vals)
+}
+
+// ErrTrustedPowerTooLow is returned by VerifyCommit when the validator set
+// changed too much since the trusted one to be trusted on its own.
+// A header in between can be verified first, to trust the set there.
+type ErrTrustedPowerTooLow struct {
+	Signed int64
+	Total  int64
+}
+
+func (e ErrTrustedPowerTooLow) Error() string {
+	return cmn.Fmt("Validator set changed and only %v of %v trusted power signed", e.Signed, e.Total)
+}
+
+// Returns the validator set that signed the header, of chainID, given the
+// trusted validators. It's shared by the IBC plugin and the light client.
+// If vals is empty the set is assumed unchanged. Otherwise vals must hash to
+// header.ValidatorsHash, and since we can't trust a new set on its own,
+// +2/3 of the voting power of trusted must also have signed.
+// NOTE: Commit's votes include ValidatorAddress, so can be matched up
+// against trusted, even if the validator set had changed.
+func VerifyCommit(chainID string, trusted []*tm.Validator, header *tm.Header, commit *tm.Commit, vals []*tm.Validator) (*tm.ValidatorSet, error) {
+	if header.ChainID != chainID {
+		return nil, errors.New(cmn.Fmt("Expected header.ChainID %v, got %v", chainID, header.ChainID))
 	}
 	if len(commit.Precommits) == 0 {
-		return errors.New(cmn.Fmt("Commit has no signatures"))
+		return nil, errors.New(cmn.Fmt("Commit has no signatures"))
+	}
+	trustedSet := tm.NewValidatorSet(trusted)
+	valSet := trustedSet
+	if len(vals) > 0 {
+		valSet = tm.NewValidatorSet(vals)
+	}
+	if !bytes.Equal(valSet.Hash(), header.ValidatorsHash) {
+		return nil, errors.New(cmn.Fmt("Validators hash %X does not match header.ValidatorsHash %X",
+			valSet.Hash(), header.ValidatorsHash))
 	}
-	chainID := chainState.ChainID
-	vote0 := commit.Precommits[0]
-	vals := chainState.Validators
-	valSet := tm.NewValidatorSet(vals)
 
-	// NOTE: Currently this only works with the exact same validator set.
-	// Not this, but perhaps "ValidatorSet.VerifyCommitAny" should expose
-	// the functionality to verify commits even after validator changes.
-	err := valSet.VerifyCommit(chainID, vote0.BlockID, vote0.Height, commit)
+	// Make sure the commit is for this header
+	blockID, err := commitBlockID(header, commit)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// +2/3 of the signing set
+	err = valSet.VerifyCommit(chainID, blockID, header.Height, commit)
+	if err != nil {
+		return nil, err
+	}
+
+	// +2/3 of the trusted set, if it changed
+	if valSet != trustedSet {
+		signed := signedPower(chainID, trustedSet, blockID, commit)
+		if signed*3 <= trustedSet.TotalVotingPower()*2 {
+			return nil, ErrTrustedPowerTooLow{signed, trustedSet.TotalVotingPower()}
+		}
 	}
 
 	// All ok!
-	return nil
+	return valSet, nil
+}
+
+// Returns the BlockID the commit is for, which must be the header's.
+func commitBlockID(header *tm.Header, commit *tm.Commit) (tm.BlockID, error) {
+	for _, precommit := range commit.Precommits {
+		if precommit == nil {
+			continue
+		}
+		if !bytes.Equal(precommit.BlockID.Hash, header.Hash()) {
+			return tm.BlockID{}, errors.New(cmn.Fmt("Commit is for block %X, not the header %X",
+				precommit.BlockID.Hash, header.Hash()))
+		}
+		return precommit.BlockID, nil
+	}
+	return tm.BlockID{}, errors.New(cmn.Fmt("Commit has no signatures"))
+}
+
+// Sums the voting power in valSet with a valid precommit for blockID.
+// The commit's votes are matched up by ValidatorAddress.
+func signedPower(chainID string, valSet *tm.ValidatorSet, blockID tm.BlockID, commit *tm.Commit) int64 {
+	var power int64
+	for _, precommit := range commit.Precommits {
+		if precommit == nil || !precommit.BlockID.Equals(blockID) {
+			continue
+		}
+		_, val := valSet.GetByAddress(precommit.ValidatorAddress)
+		if val == nil {
+			continue
+		}
+		if !val.PubKey.VerifyBytes(tm.SignBytes(chainID, precommit), precommit.Signature) {
+			continue
+		}
+		power += val.VotingPower
+	}
+	return power
 }
@@ -6,9 +6,11 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	wrsp "github.com/tepleton/wrsp/types"
+	"github.com/tepleton/basecoin/state"
 	"github.com/tepleton/basecoin/testutils"
 	"github.com/tepleton/basecoin/types"
 	cmn "github.com/tepleton/go-common"
+	merkle "github.com/tepleton/go-merkle"
 	"github.com/tepleton/go-wire"
 	eyes "github.com/tepleton/merkleeyes/client"
 	tm "github.com/tepleton/tepleton/types"
@@ -36,17 +38,61 @@ func genGenesisDoc(chainID string, numVals int) (*tm.GenesisDoc, []*tm.Validator
 	return genDoc, vals
 }
 
+// Returns the validators of chainID with the given indices,
+// named as in genGenesisDoc so they can sign for it.
+func genValidators(chainID string, indices ...int) ([]*tm.Validator, []types.PrivAccount) {
+	var vals []*tm.Validator
+	var privAccs []types.PrivAccount
+	for _, i := range indices {
+		privAcc := testutils.PrivAccountFromSecret(cmn.Fmt("%v_val_%v", chainID, i))
+		vals = append(vals, tm.NewValidator(privAcc.Account.PubKey, 1))
+		privAccs = append(privAccs, privAcc)
+	}
+	return vals, privAccs
+}
+
+// Makes a header at height for the validator set vals,
+// and a commit for it signed by signers.
+func genHeaderAndCommit(chainID string, height int, appHash []byte, vals []*tm.Validator, signers []types.PrivAccount) (tm.Header, tm.Commit) {
+	valSet := tm.NewValidatorSet(vals)
+	header := tm.Header{
+		ChainID:        chainID,
+		Height:         height,
+		AppHash:        appHash,
+		ValidatorsHash: valSet.Hash(),
+	}
+	blockID := tm.BlockID{Hash: header.Hash()}
+	precommits := make([]*tm.Vote, len(valSet.Validators))
+	for _, signer := range signers {
+		index, _ := valSet.GetByAddress(signer.Account.PubKey.Address())
+		if index < 0 {
+			continue
+		}
+		vote := &tm.Vote{
+			ValidatorAddress: signer.Account.PubKey.Address(),
+			ValidatorIndex:   index,
+			Height:           height,
+			Round:            0,
+			Type:             tm.VoteTypePrecommit,
+			BlockID:          blockID,
+		}
+		vote.Signature = signer.PrivKey.Sign(tm.SignBytes(chainID, vote))
+		precommits[index] = vote
+	}
+	return header, tm.Commit{BlockID: blockID, Precommits: precommits}
+}
+
 func TestIBCPlugin(t *testing.T) {
 
 	tree := eyes.NewLocalClient("", 0)
-	store := types.NewKVCache(tree)
+	store := types.NewKVCache(state.NewEyesStore(tree))
 	store.SetLogging() // Log all activity
 
-	ibcPlugin := New()
+	ibcPlugin := New(nil)
 	ctx := types.CallContext{
+		ChainID:       "test_chain",
 		CallerAddress: nil,
 		CallerAccount: nil,
-		Coins:         types.Coins{},
 	}
 
 	chainID_1 := "test_chain"
@@ -86,38 +132,1279 @@ func TestIBCPlugin(t *testing.T) {
 	t.Log(">>", strings.Join(store.GetLogLines(), "\n"))
 	store.ClearLogLines()
 
-	// Create a new packet (for testing)
-	res = ibcPlugin.RunTx(store, ctx, wire.BinaryBytes(struct{ IBCTx }{IBCPacketCreateTx{
-		Packet{
-			SrcChainID: "test_chain",
-			DstChainID: "dst_chain",
-			Sequence:   0,
-			Type:       "data",
-			Payload:    []byte("hello world"),
-		},
+	// Create a packet without a connection
+	packet := Packet{
+		SrcChainID: "test_chain",
+		DstChainID: "dst_chain",
+		Sequence:   0,
+		Type:       "data",
+		Payload:    []byte("hello world"),
+	}
+	res = ibcPlugin.RunTx(store, ctx, wire.BinaryBytes(struct{ IBCTx }{IBCPacketCreateTx{Packet: packet}}))
+	assert.Equal(t, res.Code, IBCCodeConnectionNotOpen, res.Log)
+	t.Log(">>", strings.Join(store.GetLogLines(), "\n"))
+	store.ClearLogLines()
+
+	// Open a connection
+	res = ibcPlugin.RunTx(store, ctx, wire.BinaryBytes(struct{ IBCTx }{IBCConnectionOpenTx{
+		SrcChainID: "test_chain",
+		DstChainID: "dst_chain",
 	}}))
+	assert.True(t, res.IsOK(), res.Log)
+	t.Log(">>", strings.Join(store.GetLogLines(), "\n"))
+	store.ClearLogLines()
+
+	// Create a new packet (for testing)
+	res = ibcPlugin.RunTx(store, ctx, wire.BinaryBytes(struct{ IBCTx }{IBCPacketCreateTx{Packet: packet}}))
 	assert.Equal(t, res.Code, wrsp.CodeType(0), res.Log)
+	assert.Equal(t, wire.BinaryBytes(uint64(0)), res.Data)
 	t.Log(">>", strings.Join(store.GetLogLines(), "\n"))
 	store.ClearLogLines()
 
-	// Post a duplicate packet
-	res = ibcPlugin.RunTx(store, ctx, wire.BinaryBytes(struct{ IBCTx }{IBCPacketCreateTx{
-		Packet{
-			SrcChainID: "test_chain",
-			DstChainID: "dst_chain",
-			Sequence:   0,
-			Type:       "data",
-			Payload:    []byte("hello world"),
-		},
-	}}))
-	assert.Equal(t, res.Code, IBCCodePacketAlreadyExists, res.Log)
+	// The same packet again gets the next sequence
+	res = ibcPlugin.RunTx(store, ctx, wire.BinaryBytes(struct{ IBCTx }{IBCPacketCreateTx{Packet: packet}}))
+	assert.Equal(t, res.Code, wrsp.CodeType(0), res.Log)
+	assert.Equal(t, wire.BinaryBytes(uint64(1)), res.Data)
 	t.Log(">>", strings.Join(store.GetLogLines(), "\n"))
 	store.ClearLogLines()
 
 	// Update a chain
-	//header, commit :=
+	_, privAccs_1 := genValidators(chainID_1, 0, 1, 2, 3)
+	header, commit := genHeaderAndCommit(chainID_1, 1, nil, vals_1, privAccs_1)
+	res = ibcPlugin.RunTx(store, ctx, wire.BinaryBytes(struct{ IBCTx }{IBCUpdateChainTx{
+		Header: header,
+		Commit: commit,
+	}}))
+	assert.True(t, res.IsOK(), res.Log)
+	t.Log(">>", strings.Join(store.GetLogLines(), "\n"))
+	store.ClearLogLines()
 
 	store.Sync()
 	resCommit := tree.CommitSync()
 	t.Log(">>", vals_1, tree, resCommit.Data)
 }
+
+func TestIBCUpdateChainValidatorChange(t *testing.T) {
+
+	tree := eyes.NewLocalClient("", 0)
+	store := types.NewKVCache(state.NewEyesStore(tree))
+
+	ibcPlugin := New(nil)
+	ctx := types.CallContext{}
+
+	chainID := "test_chain"
+	genDoc, vals := genGenesisDoc(chainID, 4)
+	res := ibcPlugin.RunTx(store, ctx, wire.BinaryBytes(struct{ IBCTx }{IBCRegisterChainTx{
+		BlockchainGenesis{
+			ChainID: chainID,
+			Genesis: string(wire.JSONBytes(genDoc)),
+		},
+	}}))
+	assert.True(t, res.IsOK(), res.Log)
+
+	updateChain := func(height int, vals []*tm.Validator, signers []types.PrivAccount) wrsp.Result {
+		header, commit := genHeaderAndCommit(chainID, height, nil, vals, signers)
+		return ibcPlugin.RunTx(store, ctx, wire.BinaryBytes(struct{ IBCTx }{IBCUpdateChainTx{
+			Header:     header,
+			Commit:     commit,
+			Validators: vals,
+		}}))
+	}
+	loadChainState := func() (chainState BlockchainState) {
+		_, err := load(store, toKey(_IBC, _BLOCKCHAIN, _STATE, chainID), &chainState)
+		assert.Nil(t, err)
+		return chainState
+	}
+
+	// Header for the genesis set, skipping ahead
+	_, signers := genValidators(chainID, 0, 1, 2)
+	res = updateChain(3, vals, signers)
+	assert.True(t, res.IsOK(), res.Log)
+	assert.Equal(t, uint64(3), loadChainState().LastBlockHeight)
+
+	// Not enough of the trusted set signed
+	vals_2, signers_2 := genValidators(chainID, 2, 3, 4, 5)
+	res = updateChain(5, vals_2, signers_2)
+	assert.Equal(t, IBCCodeInvalidCommit, res.Code, res.Log)
+
+	// The set changed, but +2/3 of the trusted power signed
+	vals_2, signers_2 = genValidators(chainID, 1, 2, 3, 4)
+	res = updateChain(5, vals_2, signers_2)
+	assert.True(t, res.IsOK(), res.Log)
+	chainState := loadChainState()
+	assert.Equal(t, uint64(5), chainState.LastBlockHeight)
+	assert.Equal(t, tm.NewValidatorSet(vals_2).Hash(), tm.NewValidatorSet(chainState.Validators).Hash())
+
+	// Validators that don't match the header
+	header, commit := genHeaderAndCommit(chainID, 6, nil, vals_2, signers_2)
+	res = ibcPlugin.RunTx(store, ctx, wire.BinaryBytes(struct{ IBCTx }{IBCUpdateChainTx{
+		Header:     header,
+		Commit:     commit,
+		Validators: vals,
+	}}))
+	assert.Equal(t, IBCCodeInvalidCommit, res.Code, res.Log)
+
+	// An older header is stored, but doesn't move the state back
+	res = updateChain(4, vals_2, signers_2)
+	assert.True(t, res.IsOK(), res.Log)
+	assert.Equal(t, uint64(5), loadChainState().LastBlockHeight)
+	assert.True(t, exists(store, headerKey(chainID, 4)))
+}
+
+func TestIBCRegistration(t *testing.T) {
+	tree := eyes.NewLocalClient("", 0)
+	store := types.NewKVCache(state.NewEyesStore(tree))
+	ibcPlugin := New(nil)
+	registrar := testutils.PrivAccountFromSecret("registrar").Account.PubKey.Address()
+	stranger := testutils.PrivAccountFromSecret("stranger").Account.PubKey.Address()
+
+	register := func(caller []byte, chainID string, genDoc *tm.GenesisDoc) wrsp.Result {
+		return ibcPlugin.RunTx(store, types.CallContext{CallerAddress: caller},
+			wire.BinaryBytes(struct{ IBCTx }{IBCRegisterChainTx{BlockchainGenesis{
+				ChainID: chainID,
+				Genesis: string(wire.JSONBytes(genDoc)),
+			}}}))
+	}
+
+	// The ChainID must be the genesis'
+	genDoc_1, _ := genGenesisDoc("chain_1", 4)
+	res := register(nil, "", genDoc_1)
+	assert.Equal(t, wrsp.CodeType_BaseInvalidInput, res.Code, res.Log)
+	res = register(nil, "chain_2", genDoc_1)
+	assert.Equal(t, wrsp.CodeType_BaseInvalidInput, res.Code, res.Log)
+
+	// Only registrars may register
+	assert.NotEqual(t, "Success", ibcPlugin.SetOption(store, "registration", "closed"))
+	assert.Equal(t, "Success", ibcPlugin.SetOption(store, "registration", RegistrationAllowlist))
+	assert.Equal(t, "Success", ibcPlugin.SetOption(store, "registrar", cmn.Fmt("%X", registrar)))
+	res = register(stranger, "chain_1", genDoc_1)
+	assert.Equal(t, IBCCodeUnauthorized, res.Code, res.Log)
+	res = register(registrar, "chain_1", genDoc_1)
+	assert.True(t, res.IsOK(), res.Log)
+
+	// Only approved chains may be registered
+	assert.Equal(t, "Success", ibcPlugin.SetOption(store, "registration", RegistrationGovernance))
+	genDoc_2, _ := genGenesisDoc("chain_2", 4)
+	res = register(registrar, "chain_2", genDoc_2)
+	assert.Equal(t, IBCCodeUnauthorized, res.Code, res.Log)
+	squatter, _ := genGenesisDoc("chain_2", 1)
+	ApproveChain(store, BlockchainGenesis{ChainID: "chain_2", Genesis: string(wire.JSONBytes(genDoc_2))})
+	res = register(stranger, "chain_2", squatter)
+	assert.Equal(t, IBCCodeUnauthorized, res.Code, res.Log)
+	res = register(stranger, "chain_2", genDoc_2)
+	assert.True(t, res.IsOK(), res.Log)
+	assert.False(t, exists(store, toKey(_IBC, _APPROVAL, "chain_2")))
+
+	// This chain's connections are opened and closed under the same policy
+	connect := func(caller []byte, open bool) wrsp.Result {
+		var tx IBCTx = IBCConnectionCloseTx{SrcChainID: "chain_0", DstChainID: "chain_1"}
+		if open {
+			tx = IBCConnectionOpenTx{SrcChainID: "chain_0", DstChainID: "chain_1"}
+		}
+		return ibcPlugin.RunTx(store, types.CallContext{ChainID: "chain_0", CallerAddress: caller},
+			wire.BinaryBytes(struct{ IBCTx }{tx}))
+	}
+	res = connect(stranger, true)
+	assert.Equal(t, IBCCodeUnauthorized, res.Code, res.Log)
+	ApproveConnection(store, "chain_0", "chain_1")
+	res = connect(stranger, true)
+	assert.True(t, res.IsOK(), res.Log)
+	res = connect(stranger, false)
+	assert.Equal(t, IBCCodeUnauthorized, res.Code, res.Log)
+
+	assert.Equal(t, "Success", ibcPlugin.SetOption(store, "registration", RegistrationAllowlist))
+	res = connect(stranger, false)
+	assert.Equal(t, IBCCodeUnauthorized, res.Code, res.Log)
+	res = connect(registrar, false)
+	assert.True(t, res.IsOK(), res.Log)
+
+	// Under the open policy, only the first to open it may reopen it
+	assert.Equal(t, "Success", ibcPlugin.SetOption(store, "registration", RegistrationOpen))
+	res = connect(registrar, true)
+	assert.Equal(t, IBCCodeUnauthorized, res.Code, res.Log)
+	res = connect(stranger, true)
+	assert.True(t, res.IsOK(), res.Log)
+
+	// A revoked registrar can't register chains any more
+	assert.Equal(t, "Success", ibcPlugin.SetOption(store, "revoke_registrar", cmn.Fmt("%X", registrar)))
+	assert.Equal(t, "Success", ibcPlugin.SetOption(store, "registration", RegistrationAllowlist))
+	genDoc_3, _ := genGenesisDoc("chain_3", 4)
+	res = register(registrar, "chain_3", genDoc_3)
+	assert.Equal(t, IBCCodeUnauthorized, res.Code, res.Log)
+}
+
+func TestIBCValidateBasic(t *testing.T) {
+	packet := Packet{SrcChainID: "chain_1", DstChainID: "chain_2", Type: "data"}
+	assert.True(t, IBCPacketCreateTx{Packet: packet}.ValidateBasic().IsOK())
+
+	loop := packet
+	loop.DstChainID = loop.SrcChainID
+	noType := packet
+	noType.Type = ""
+	for _, tx := range []IBCTx{
+		IBCPacketCreateTx{Packet: loop},
+		IBCPacketCreateTx{Packet: noType},
+		IBCPacketCreateTx{Packet: packet, Fee: types.Coins{{"mycoin", -1}}},
+		IBCPacketPostTx{FromChainID: "chain_1", Packet: packet},
+		IBCPacketAckTx{FromChainHeight: 1, Packet: noType},
+		IBCPacketTimeoutTx{FromChainHeight: 1, Packet: packet},
+		IBCConnectionOpenTx{SrcChainID: "chain_1"},
+		IBCConnectionCloseTx{SrcChainID: "chain_1", DstChainID: "chain_1"},
+		IBCUpdateChainTx{Header: tm.Header{ChainID: "chain_1", Height: 1}},
+		IBCMisbehaviourTx{},
+	} {
+		assert.Equal(t, wrsp.CodeType_BaseInvalidInput, tx.ValidateBasic().Code, cmn.Fmt("%#v", tx))
+	}
+}
+
+//----------------------------------------
+
+// A chain for tests that send packets between chains.
+// Each commit makes a header signed by all of its validators.
+type testChain struct {
+	t       *testing.T
+	chainID string
+	plugin  *IBCPlugin
+	tree    *eyes.Client
+	cache   *types.KVCache     // The app's store
+	store   *types.PluginStore // The plugin's keys in cache
+	genDoc  *tm.GenesisDoc
+	vals    []*tm.Validator
+	signers []types.PrivAccount
+	height  int
+}
+
+func newTestChain(t *testing.T, chainID string) *testChain {
+	tree := eyes.NewLocalClient("", 0)
+	genDoc, vals := genGenesisDoc(chainID, 4)
+	_, signers := genValidators(chainID, 0, 1, 2, 3)
+	pgz := types.NewPlugins()
+	plugin := New(state.NewHost(pgz))
+	pgz.RegisterPlugin(plugin)
+	cache := types.NewKVCache(state.NewEyesStore(tree))
+	return &testChain{
+		t:       t,
+		chainID: chainID,
+		plugin:  plugin,
+		tree:    tree,
+		cache:   cache,
+		store:   state.NewPluginStore(cache, pgz, plugin),
+		genDoc:  genDoc,
+		vals:    vals,
+		signers: signers,
+	}
+}
+
+func (tc *testChain) runTx(ctx types.CallContext, tx IBCTx) wrsp.Result {
+	if ctx.ChainID == "" {
+		ctx.ChainID = tc.chainID
+	}
+	if ctx.Bank == nil {
+		ctx.Bank = tc.store.Bank()
+	}
+	return tc.plugin.RunTx(tc.store, ctx, wire.BinaryBytes(struct{ IBCTx }{tx}))
+}
+
+// The context of a tx from caller that sends coins to the plugin.
+func (tc *testChain) txContext(caller []byte, coins types.Coins) types.CallContext {
+	bank := state.NewTxBank(tc.cache, tc.plugin.Name(), coins, nil, nil)
+	return types.NewCallContext(tc.chainID, caller, nil, nil, nil, bank)
+}
+
+// Commits the store and begins the next block.
+// Returns the header of the next block, which commits to the state so far.
+func (tc *testChain) commit() (tm.Header, tm.Commit) {
+	tc.cache.Sync()
+	resCommit := tc.tree.CommitSync()
+	assert.True(tc.t, resCommit.IsOK(), resCommit.Log)
+	tc.height++
+	tc.plugin.BeginBlock(tc.store, uint64(tc.height))
+	return genHeaderAndCommit(tc.chainID, tc.height, resCommit.Data, tc.vals, tc.signers)
+}
+
+func (tc *testChain) registerChain(other *testChain) {
+	res := tc.runTx(types.CallContext{}, IBCRegisterChainTx{BlockchainGenesis{
+		ChainID: other.chainID,
+		Genesis: string(wire.JSONBytes(other.genDoc)),
+	}})
+	assert.True(tc.t, res.IsOK(), res.Log)
+}
+
+// Lets hub prove the packets of chain.
+func (tc *testChain) setHub(chain, hub *testChain) {
+	log := tc.plugin.SetOption(tc.store, "hub", string(wire.JSONBytes(HubRoute{chain.chainID, hub.chainID})))
+	assert.Equal(tc.t, "Success", log)
+}
+
+func (tc *testChain) updateChain(header tm.Header, commit tm.Commit) {
+	res := tc.runTx(types.CallContext{}, IBCUpdateChainTx{Header: header, Commit: commit})
+	assert.True(tc.t, res.IsOK(), res.Log)
+}
+
+// Opens the connection from chains[0] to the last of chains on each of
+// them in turn, proving it on each from the one before. Each chain must
+// have the one before registered, and set as the hub of chains[0] if
+// it's not chains[0].
+func openConnection(ordered bool, chains ...*testChain) {
+	src, dst := chains[0], chains[len(chains)-1]
+	res := src.runTx(types.CallContext{}, IBCConnectionOpenTx{SrcChainID: src.chainID, DstChainID: dst.chainID, Ordered: ordered})
+	assert.True(src.t, res.IsOK(), res.Log)
+	for i := 1; i < len(chains); i++ {
+		from, chain := chains[i-1], chains[i]
+		chain.updateChain(from.commit())
+		res = chain.runTx(types.CallContext{}, IBCConnectionOpenTx{
+			SrcChainID:      src.chainID,
+			DstChainID:      dst.chainID,
+			ConnectionProof: from.proveConnection(src, dst),
+		})
+		assert.True(chain.t, res.IsOK(), res.Log)
+	}
+}
+
+// Proves the chain's record of the connection from src to dst in the
+// last committed tree.
+func (tc *testChain) proveConnection(src, dst *testChain) ConnectionProof {
+	connKey := toKey(_IBC, _CONNECTION, src.chainID, dst.chainID)
+	var conn Connection
+	_, err := load(tc.store, connKey, &conn)
+	assert.Nil(tc.t, err)
+	return ConnectionProof{
+		FromChainID:     tc.chainID,
+		FromChainHeight: uint64(tc.height),
+		Connection:      conn,
+		Proof:           tc.proveKey(connKey),
+	}
+}
+
+// Proves the value of the plugin's key in the last committed tree.
+func (tc *testChain) proveKey(key []byte) merkle.IAVLProof {
+	return tc.proveTreeKey(provenKey(key))
+}
+
+func (tc *testChain) proveTreeKey(key []byte) merkle.IAVLProof {
+	resQuery, err := tc.tree.QuerySync(wrsp.RequestQuery{Path: "/key", Data: key, Prove: true})
+	assert.Nil(tc.t, err)
+	proof, err := merkle.ReadProof(resQuery.Proof)
+	assert.Nil(tc.t, err)
+	return *proof
+}
+
+// Proves key is absent from the last committed tree, with the keys
+// either side of where it would be.
+func (tc *testChain) proveAbsence(key []byte) (proof AbsenceProof) {
+	resQuery, err := tc.tree.QuerySync(wrsp.RequestQuery{Path: "/key", Data: provenKey(key)})
+	assert.Nil(tc.t, err)
+	if leftKey := tc.keyAt(resQuery.Index - 1); leftKey != nil {
+		left := tc.proveTreeKey(leftKey)
+		proof.Left = &left
+	}
+	if rightKey := tc.keyAt(resQuery.Index); rightKey != nil {
+		right := tc.proveTreeKey(rightKey)
+		proof.Right = &right
+	}
+	return proof
+}
+
+func (tc *testChain) keyAt(index int64) []byte {
+	if index < 0 {
+		return nil
+	}
+	resQuery, err := tc.tree.QuerySync(wrsp.RequestQuery{Path: "/index", Data: wire.BinaryBytes(index)})
+	assert.Nil(tc.t, err)
+	return resQuery.Key
+}
+
+func egressKey(packet Packet) []byte {
+	return toKey(_IBC, _EGRESS, packet.SrcChainID, packet.DstChainID, cmn.Fmt("%v", packet.Sequence))
+}
+
+func ingressKey(packet Packet) []byte {
+	return toKey(_IBC, _INGRESS, packet.DstChainID, packet.SrcChainID, cmn.Fmt("%v", packet.Sequence))
+}
+
+func ackKey(packet Packet) []byte {
+	return toKey(_IBC, _ACK, packet.SrcChainID, packet.DstChainID, cmn.Fmt("%v", packet.Sequence))
+}
+
+//----------------------------------------
+
+func TestIBCPacketPost(t *testing.T) {
+	src, dst := newTestChain(t, "src_chain"), newTestChain(t, "dst_chain")
+	ctx := types.CallContext{}
+
+	// Send two packets from the source chain, over an ordered connection
+	res := src.runTx(ctx, IBCConnectionOpenTx{SrcChainID: src.chainID, DstChainID: dst.chainID, Ordered: true})
+	assert.True(t, res.IsOK(), res.Log)
+	var packets []Packet
+	for i := 0; i < 2; i++ {
+		packet := Packet{
+			SrcChainID: src.chainID,
+			DstChainID: dst.chainID,
+			Sequence:   uint64(i),
+			Type:       "data",
+			Payload:    []byte(cmn.Fmt("packet %v", i)),
+		}
+		res = src.runTx(ctx, IBCPacketCreateTx{Packet: packet})
+		assert.True(t, res.IsOK(), res.Log)
+		packets = append(packets, packet)
+	}
+	header, commit := src.commit()
+
+	// Register the source chain on the destination, and its header with the packets
+	dst.registerChain(src)
+	dst.updateChain(header, commit)
+
+	postPacket := func(packet Packet, proofPacket Packet) wrsp.Result {
+		return dst.runTx(ctx, IBCPacketPostTx{
+			FromChainID:     src.chainID,
+			FromChainHeight: uint64(header.Height),
+			Packet:          packet,
+			Proof:           src.proveKey(egressKey(proofPacket)),
+		})
+	}
+
+	// No ingress connection yet
+	res = postPacket(packets[0], packets[0])
+	assert.Equal(t, IBCCodeConnectionNotOpen, res.Code, res.Log)
+
+	// The destination opens it as proven from the source, which chose the ordering
+	openTx := IBCConnectionOpenTx{SrcChainID: src.chainID, DstChainID: dst.chainID}
+	res = dst.runTx(ctx, openTx)
+	assert.Equal(t, wrsp.CodeType_BaseInvalidInput, res.Code, res.Log)
+	openTx.ConnectionProof = src.proveConnection(src, dst)
+	unordered := openTx
+	unordered.Connection.Ordered = false
+	res = dst.runTx(ctx, unordered)
+	assert.Equal(t, IBCCodeInvalidProof, res.Code, res.Log)
+	res = dst.runTx(ctx, openTx)
+	assert.True(t, res.IsOK(), res.Log)
+
+	// Out of order
+	res = postPacket(packets[1], packets[1])
+	assert.Equal(t, IBCCodeInvalidSequence, res.Code, res.Log)
+
+	// In order
+	res = postPacket(packets[0], packets[0])
+	assert.True(t, res.IsOK(), res.Log)
+	res = postPacket(packets[0], packets[0])
+	assert.Equal(t, IBCCodePacketAlreadyExists, res.Code, res.Log)
+	res = postPacket(packets[1], packets[1])
+	assert.True(t, res.IsOK(), res.Log)
+
+	// A tampered packet doesn't verify
+	tampered := packets[1]
+	tampered.Sequence = 2
+	res = postPacket(tampered, packets[1])
+	assert.Equal(t, IBCCodeInvalidProof, res.Code, res.Log)
+
+	// The destination closes it once the source has, with a newer proof
+	res = src.runTx(ctx, IBCConnectionCloseTx{SrcChainID: src.chainID, DstChainID: dst.chainID})
+	assert.True(t, res.IsOK(), res.Log)
+	dst.updateChain(src.commit())
+	closeTx := IBCConnectionCloseTx{SrcChainID: src.chainID, DstChainID: dst.chainID, ConnectionProof: openTx.ConnectionProof}
+	res = dst.runTx(ctx, closeTx)
+	assert.Equal(t, IBCCodeInvalidProof, res.Code, res.Log)
+	closeTx.ConnectionProof = src.proveConnection(src, dst)
+	res = dst.runTx(ctx, closeTx)
+	assert.True(t, res.IsOK(), res.Log)
+
+	// Nothing is posted once closed, and the old proof doesn't reopen it
+	res = postPacket(tampered, packets[1])
+	assert.Equal(t, IBCCodeConnectionNotOpen, res.Code, res.Log)
+	res = dst.runTx(ctx, openTx)
+	assert.Equal(t, IBCCodeInvalidProof, res.Code, res.Log)
+}
+
+func TestIBCPacketAck(t *testing.T) {
+	src, dst := newTestChain(t, "src_chain"), newTestChain(t, "dst_chain")
+	ctx := types.CallContext{}
+
+	dst.registerChain(src)
+	src.registerChain(dst)
+	openConnection(false, src, dst)
+
+	packet := Packet{
+		SrcChainID: src.chainID,
+		DstChainID: dst.chainID,
+		Type:       "data",
+		Payload:    []byte("hello world"),
+	}
+	res := src.runTx(ctx, IBCPacketCreateTx{Packet: packet})
+	assert.True(t, res.IsOK(), res.Log)
+
+	// Post the packet, which writes an Ack
+	dst.updateChain(src.commit())
+	res = dst.runTx(ctx, IBCPacketPostTx{
+		FromChainID:     src.chainID,
+		FromChainHeight: uint64(src.height),
+		Packet:          packet,
+		Proof:           src.proveKey(egressKey(packet)),
+	})
+	assert.True(t, res.IsOK(), res.Log)
+	ack := PacketAck{Code: wrsp.CodeType_OK}
+	assert.Equal(t, wire.BinaryBytes(ack), dst.store.Get(ackKey(packet)))
+
+	// Prove the Ack back on the source chain
+	src.updateChain(dst.commit())
+	ackTx := IBCPacketAckTx{
+		FromChainHeight: uint64(dst.height),
+		Packet:          packet,
+		Ack:             PacketAck{Code: wrsp.CodeType_InternalError},
+		Proof:           dst.proveKey(ackKey(packet)),
+	}
+	res = src.runTx(ctx, ackTx)
+	assert.Equal(t, IBCCodeInvalidProof, res.Code, res.Log)
+
+	ackTx.Ack = ack
+	res = src.runTx(ctx, ackTx)
+	assert.True(t, res.IsOK(), res.Log)
+	assert.False(t, exists(src.store, egressKey(packet)))
+
+	// The egress packet is gone
+	res = src.runTx(ctx, ackTx)
+	assert.Equal(t, IBCCodeUnknownPacket, res.Code, res.Log)
+}
+
+func TestIBCPacketTimeout(t *testing.T) {
+	src, dst := newTestChain(t, "src_chain"), newTestChain(t, "dst_chain")
+	ctx := types.CallContext{}
+
+	dst.registerChain(src)
+	src.registerChain(dst)
+	openConnection(true, src, dst)
+
+	packet := Packet{
+		SrcChainID:    src.chainID,
+		DstChainID:    dst.chainID,
+		TimeoutHeight: 2,
+		Type:          "data",
+		Payload:       []byte("hello world"),
+	}
+	res := src.runTx(ctx, IBCPacketCreateTx{Packet: packet})
+	assert.True(t, res.IsOK(), res.Log)
+	dst.updateChain(src.commit())
+
+	// Too late to post it in block 3
+	dst.commit()
+	header_2, commit_2 := dst.commit()
+	header_3, commit_3 := dst.commit()
+	res = dst.runTx(ctx, IBCPacketPostTx{
+		FromChainID:     src.chainID,
+		FromChainHeight: uint64(src.height),
+		Packet:          packet,
+		Proof:           src.proveKey(egressKey(packet)),
+	})
+	assert.Equal(t, IBCCodePacketTimedOut, res.Code, res.Log)
+
+	// Header 2 doesn't cover block 2
+	src.updateChain(header_2, commit_2)
+	res = src.runTx(ctx, IBCPacketTimeoutTx{
+		FromChainHeight: 2,
+		Packet:          packet,
+		Proof:           dst.proveAbsence(ingressKey(packet)),
+	})
+	assert.Equal(t, IBCCodePacketNotTimedOut, res.Code, res.Log)
+
+	// Neighbours that aren't adjacent don't prove absence
+	src.updateChain(header_3, commit_3)
+	proof := dst.proveAbsence(ingressKey(packet))
+	if assert.NotNil(t, proof.Left) {
+		assert.True(t, proof.Verify(ingressKey(packet), header_3.AppHash))
+		left, _ := leafIndex(proof.Left)
+		forged := AbsenceProof{Right: proof.Right}
+		if left > 0 {
+			leftProof := dst.proveTreeKey(dst.keyAt(int64(left - 1)))
+			forged.Left = &leftProof
+		}
+		assert.False(t, forged.Verify(ingressKey(packet), header_3.AppHash))
+	}
+
+	res = src.runTx(ctx, IBCPacketTimeoutTx{
+		FromChainHeight: 3,
+		Packet:          packet,
+		Proof:           proof,
+	})
+	assert.True(t, res.IsOK(), res.Log)
+	assert.False(t, exists(src.store, egressKey(packet)))
+
+	// The ordered connection is closed
+	var conn Connection
+	_, err := load(src.store, toKey(_IBC, _CONNECTION, src.chainID, dst.chainID), &conn)
+	assert.Nil(t, err)
+	assert.False(t, conn.Open)
+}
+
+func TestIBCPacketForward(t *testing.T) {
+	src, hub, dst := newTestChain(t, "src_chain"), newTestChain(t, "hub_chain"), newTestChain(t, "dst_chain")
+	ctx := types.CallContext{}
+	hub.registerChain(src)
+	hub.registerChain(dst)
+	dst.registerChain(hub)
+	dst.setHub(src, hub)
+	openConnection(true, src, hub, dst)
+
+	packet := Packet{
+		SrcChainID: src.chainID,
+		DstChainID: dst.chainID,
+		Type:       "data",
+		Payload:    []byte("hello world"),
+	}
+	res := src.runTx(ctx, IBCPacketCreateTx{Packet: packet})
+	assert.True(t, res.IsOK(), res.Log)
+
+	// The hub forwards it, since it knows the destination
+	hub.updateChain(src.commit())
+	postTx := IBCPacketPostTx{
+		FromChainID:     src.chainID,
+		FromChainHeight: uint64(src.height),
+		Packet:          packet,
+		Proof:           src.proveKey(egressKey(packet)),
+	}
+	res = hub.runTx(ctx, postTx)
+	assert.True(t, res.IsOK(), res.Log)
+	assert.False(t, exists(hub.store, ingressKey(packet)))
+	assert.False(t, exists(hub.store, ackKey(packet)))
+	assert.True(t, exists(hub.store, egressKey(packet)))
+	res = hub.runTx(ctx, postTx)
+	assert.Equal(t, IBCCodePacketAlreadyExists, res.Code, res.Log)
+
+	var count uint64
+	var route PacketRoute
+	_, err := load(hub.store, toKey(_IBC, _FORWARD, dst.chainID), &count)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), count)
+	_, err = load(hub.store, toKey(_IBC, _FORWARD, dst.chainID, "0"), &route)
+	assert.Nil(t, err)
+	assert.Equal(t, PacketRoute{src.chainID, uint64(src.height), src.chainID, 0}, route)
+
+	// The destination takes it from the hub
+	dst.updateChain(hub.commit())
+	res = dst.runTx(ctx, IBCPacketPostTx{
+		FromChainID:     hub.chainID,
+		FromChainHeight: uint64(hub.height),
+		Packet:          packet,
+		Proof:           hub.proveKey(egressKey(packet)),
+	})
+	assert.True(t, res.IsOK(), res.Log)
+	assert.True(t, exists(dst.store, ingressKey(packet)))
+	assert.True(t, exists(dst.store, ackKey(packet)))
+
+	// The hub proves the Ack, and relays it back
+	hub.updateChain(dst.commit())
+	var ack PacketAck
+	_, err = load(dst.store, ackKey(packet), &ack)
+	assert.Nil(t, err)
+	res = hub.runTx(ctx, IBCPacketAckTx{
+		FromChainHeight: uint64(dst.height),
+		Packet:          packet,
+		Ack:             ack,
+		Proof:           dst.proveKey(ackKey(packet)),
+	})
+	assert.True(t, res.IsOK(), res.Log)
+	assert.False(t, exists(hub.store, egressKey(packet)))
+	assert.True(t, exists(hub.store, ackKey(packet)))
+
+	// The source takes it from the hub, once it's set as the hub
+	src.registerChain(hub)
+	src.updateChain(hub.commit())
+	ackTx := IBCPacketAckTx{
+		FromChainID:     hub.chainID,
+		FromChainHeight: uint64(hub.height),
+		Packet:          packet,
+		Ack:             ack,
+		Proof:           hub.proveKey(ackKey(packet)),
+	}
+	res = src.runTx(ctx, ackTx)
+	assert.Equal(t, IBCCodeUnauthorized, res.Code, res.Log)
+	src.setHub(dst, hub)
+	res = src.runTx(ctx, ackTx)
+	assert.True(t, res.IsOK(), res.Log)
+	assert.False(t, exists(src.store, egressKey(packet)))
+
+	// A timeout is relayed back as an Ack too
+	late := Packet{
+		SrcChainID:    src.chainID,
+		DstChainID:    dst.chainID,
+		Sequence:      1,
+		TimeoutHeight: uint64(dst.height),
+		Type:          "data",
+		Payload:       []byte("too late"),
+	}
+	res = src.runTx(ctx, IBCPacketCreateTx{Packet: late})
+	assert.True(t, res.IsOK(), res.Log)
+	hub.updateChain(src.commit())
+	res = hub.runTx(ctx, IBCPacketPostTx{
+		FromChainID:     src.chainID,
+		FromChainHeight: uint64(src.height),
+		Packet:          late,
+		Proof:           src.proveKey(egressKey(late)),
+	})
+	assert.True(t, res.IsOK(), res.Log)
+	hub.updateChain(dst.commit())
+	res = hub.runTx(ctx, IBCPacketTimeoutTx{
+		FromChainHeight: uint64(dst.height),
+		Packet:          late,
+		Proof:           dst.proveAbsence(ingressKey(late)),
+	})
+	assert.True(t, res.IsOK(), res.Log)
+	_, err = load(hub.store, ackKey(late), &ack)
+	assert.Nil(t, err)
+	assert.Equal(t, IBCCodePacketTimedOut, ack.Code)
+
+	src.updateChain(hub.commit())
+	res = src.runTx(ctx, IBCPacketAckTx{
+		FromChainID:     hub.chainID,
+		FromChainHeight: uint64(hub.height),
+		Packet:          late,
+		Ack:             ack,
+		Proof:           hub.proveKey(ackKey(late)),
+	})
+	assert.True(t, res.IsOK(), res.Log)
+	assert.False(t, exists(src.store, egressKey(late)))
+	var conn Connection
+	_, err = load(src.store, toKey(_IBC, _CONNECTION, src.chainID, dst.chainID), &conn)
+	assert.Nil(t, err)
+	assert.False(t, conn.Open)
+}
+
+func TestIBCPacketSource(t *testing.T) {
+	a, b, dst := newTestChain(t, "chain_a"), newTestChain(t, "chain_b"), newTestChain(t, "dst_chain")
+	ctx := types.CallContext{}
+	dst.registerChain(a)
+	dst.registerChain(b)
+	openConnection(false, a, dst)
+
+	// Chain B can't create a packet claiming to come from chain A,
+	// but a faulty B could still commit one
+	packet := Packet{
+		SrcChainID: a.chainID,
+		DstChainID: dst.chainID,
+		Type:       "data",
+		Payload:    []byte("forged"),
+	}
+	res := b.runTx(ctx, IBCPacketCreateTx{Packet: packet})
+	assert.Equal(t, wrsp.CodeType_BaseInvalidInput, res.Code, res.Log)
+	save(b.store, egressKey(packet), packet)
+	// along with one for a chain the destination doesn't know
+	stray := Packet{
+		SrcChainID: b.chainID,
+		DstChainID: "other_chain",
+		Type:       "data",
+		Payload:    []byte("stray"),
+	}
+	save(b.store, egressKey(stray), stray)
+	dst.updateChain(b.commit())
+
+	postTx := func(packet Packet) IBCPacketPostTx {
+		return IBCPacketPostTx{
+			FromChainID:     b.chainID,
+			FromChainHeight: uint64(b.height),
+			Packet:          packet,
+			Proof:           b.proveKey(egressKey(packet)),
+		}
+	}
+
+	// The destination refuses both
+	res = dst.runTx(ctx, postTx(packet))
+	assert.Equal(t, IBCCodeUnauthorized, res.Code, res.Log)
+	assert.False(t, exists(dst.store, ingressKey(packet)))
+	res = dst.runTx(ctx, postTx(stray))
+	assert.Equal(t, wrsp.CodeType_BaseInvalidInput, res.Code, res.Log)
+
+	// Unless B is the hub for A
+	dst.setHub(a, b)
+	res = dst.runTx(ctx, postTx(packet))
+	assert.True(t, res.IsOK(), res.Log)
+	assert.True(t, exists(dst.store, ingressKey(packet)))
+}
+
+func TestIBCHeaderRetention(t *testing.T) {
+	src, hub, dst := newTestChain(t, "src_chain"), newTestChain(t, "hub_chain"), newTestChain(t, "dst_chain")
+	ctx := types.CallContext{}
+	hub.registerChain(src)
+	hub.registerChain(dst)
+	dst.registerChain(hub)
+	dst.setHub(src, hub)
+	openConnection(false, src, hub, dst)
+	assert.Equal(t, "Success", hub.plugin.SetOption(hub.store, "header_retention", "2"))
+
+	heights := func() (heights []uint64) {
+		resQuery := hub.plugin.Query(hub.store, wrsp.RequestQuery{Path: "/headers/" + src.chainID})
+		assert.True(t, resQuery.Code.IsOK(), resQuery.Log)
+		err := wire.ReadBinaryBytes(resQuery.Value, &heights)
+		assert.Nil(t, err)
+		return heights
+	}
+
+	packet := Packet{
+		SrcChainID: src.chainID,
+		DstChainID: dst.chainID,
+		Type:       "data",
+		Payload:    []byte("hello world"),
+	}
+	res := src.runTx(ctx, IBCPacketCreateTx{Packet: packet})
+	assert.True(t, res.IsOK(), res.Log)
+
+	// The header at height 2 isn't stored, so the next one is used
+	src.commit()
+	hub.updateChain(src.commit())
+	assert.Equal(t, []uint64{1, 3}, heights())
+	res = hub.runTx(ctx, IBCPacketPostTx{
+		FromChainID:     src.chainID,
+		FromChainHeight: 2,
+		Packet:          packet,
+		Proof:           src.proveKey(egressKey(packet)),
+	})
+	assert.True(t, res.IsOK(), res.Log)
+
+	// The forwarded packet's header is kept until it's acked
+	hub.updateChain(src.commit())
+	hub.updateChain(src.commit())
+	hub.updateChain(src.commit())
+	assert.Equal(t, []uint64{3, 5, 6}, heights())
+
+	dst.updateChain(hub.commit())
+	res = dst.runTx(ctx, IBCPacketPostTx{
+		FromChainID:     hub.chainID,
+		FromChainHeight: uint64(hub.height),
+		Packet:          packet,
+		Proof:           hub.proveKey(egressKey(packet)),
+	})
+	assert.True(t, res.IsOK(), res.Log)
+	hub.updateChain(dst.commit())
+	res = hub.runTx(ctx, IBCPacketAckTx{
+		FromChainHeight: uint64(dst.height),
+		Packet:          packet,
+		Ack:             PacketAck{Code: wrsp.CodeType_OK},
+		Proof:           dst.proveKey(ackKey(packet)),
+	})
+	assert.True(t, res.IsOK(), res.Log)
+	assert.False(t, exists(hub.store, egressKey(packet)))
+	assert.False(t, exists(hub.store, routeKey(packet)))
+
+	hub.updateChain(src.commit())
+	assert.Equal(t, []uint64{6, 7}, heights())
+
+	// Nothing is stored at or above height 8
+	res = hub.runTx(ctx, IBCPacketPostTx{
+		FromChainID:     src.chainID,
+		FromChainHeight: 8,
+		Packet:          packet,
+		Proof:           src.proveKey(egressKey(packet)),
+	})
+	assert.Equal(t, IBCCodeUnknownHeight, res.Code, res.Log)
+}
+
+// Stores the payload at "handled,<srcChainID>", then fails if it's "fail".
+type testHandler struct{}
+
+func (testHandler) Name() string {
+	return "test"
+}
+
+func (testHandler) ReceivePacket(store types.KVStore, srcChainID string, payload []byte) wrsp.Result {
+	store.Set([]byte("handled,"+srcChainID), payload)
+	if string(payload) == "fail" {
+		return wrsp.ErrBaseInvalidInput.AppendLog("Failed")
+	}
+	return wrsp.NewResultOK(payload, "")
+}
+
+func TestIBCHeaderMigration(t *testing.T) {
+	store := types.NewMemKVStore()
+	for _, height := range []uint64{2, 10, 9} {
+		save(store, toKey(_IBC, _BLOCKCHAIN, _HEADER, "chain_1", cmn.Fmt("%v", height)), tm.Header{ChainID: "chain_1", Height: int(height)})
+	}
+	save(store, headerKey("chain_2", 3), tm.Header{ChainID: "chain_2", Height: 3})
+
+	err := New(nil).Migration(1).Migrate(store)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{2, 9, 10}, headerHeights(store, "chain_1"))
+	assert.Equal(t, []uint64{3}, headerHeights(store, "chain_2"))
+	assert.False(t, exists(store, toKey(_IBC, _BLOCKCHAIN, _HEADER, "chain_1", "10")))
+	var header tm.Header
+	_, err = load(store, headerKey("chain_1", 10), &header)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, header.Height)
+}
+
+// The keys of store, hex encoded.
+func storeKVs(store types.KVStore) map[string]string {
+	kvs := make(map[string]string)
+	iter := store.Iterator(nil, nil)
+	for ; iter.Valid(); iter.Next() {
+		kvs[string(iter.Key())] = cmn.Fmt("%X", iter.Value())
+	}
+	iter.Close()
+	return kvs
+}
+
+func TestIBCGenesis(t *testing.T) {
+	src, hub, dst := newTestChain(t, "src_chain"), newTestChain(t, "hub_chain"), newTestChain(t, "dst_chain")
+	hub.registerChain(src)
+	hub.registerChain(dst)
+	dst.registerChain(hub)
+	openConnection(true, src, hub, dst)
+
+	// A forwarded packet, with its route and pinned header
+	packet := Packet{
+		SrcChainID: src.chainID,
+		DstChainID: dst.chainID,
+		Type:       "data",
+		Payload:    []byte("hello world"),
+	}
+	res := src.runTx(types.CallContext{}, IBCPacketCreateTx{Packet: packet})
+	assert.True(t, res.IsOK(), res.Log)
+	hub.updateChain(src.commit())
+	res = hub.runTx(types.CallContext{}, IBCPacketPostTx{
+		FromChainID:     src.chainID,
+		FromChainHeight: uint64(src.height),
+		Packet:          packet,
+		Proof:           src.proveKey(egressKey(packet)),
+	})
+	assert.True(t, res.IsOK(), res.Log)
+
+	options := map[string]string{
+		"costs":            string(wire.JSONBytes(IBCCosts{RegisterChain: types.Coins{{"mycoin", 1}}})),
+		"registration":     RegistrationAllowlist,
+		"registrar":        cmn.Fmt("%X", testutils.PrivAccountFromSecret("registrar").Account.PubKey.Address()),
+		"header_retention": "10",
+		"hub":              string(wire.JSONBytes(HubRoute{src.chainID, dst.chainID})),
+	}
+	for key, value := range options {
+		assert.Equal(t, "Success", hub.plugin.SetOption(hub.store, key, value), key)
+	}
+	ApproveChain(hub.store, BlockchainGenesis{ChainID: "other_chain"})
+	ApproveConnection(hub.store, hub.chainID, "other_chain")
+
+	// Every key is exported, and comes back the same
+	genesis, err := hub.plugin.ExportGenesis(hub.store)
+	assert.Nil(t, err)
+	fresh := newTestChain(t, hub.chainID)
+	err = fresh.plugin.InitGenesis(fresh.store, genesis)
+	assert.Nil(t, err)
+	assert.Equal(t, storeKVs(hub.store), storeKVs(fresh.store))
+
+	// A key it doesn't know can't be exported
+	hub.store.Set(toKey(_IBC, "unknown"), []byte{0x01})
+	_, err = hub.plugin.ExportGenesis(hub.store)
+	assert.NotNil(t, err)
+
+	// The options of a new chain are checked
+	err = fresh.plugin.InitGenesis(fresh.store, []byte(`{"registration":"nobody"}`))
+	assert.NotNil(t, err)
+	err = fresh.plugin.InitGenesis(fresh.store, []byte(`{"registrar":"0102"}`))
+	assert.NotNil(t, err)
+}
+
+func TestIBCPacketHandler(t *testing.T) {
+	src, dst := newTestChain(t, "src_chain"), newTestChain(t, "dst_chain")
+	ctx := types.CallContext{}
+	dst.registerChain(src)
+	openConnection(false, src, dst)
+	dst.plugin.RegisterPacketHandler("test", testHandler{})
+	handlerStore := types.NewPrefixStore(dst.cache, types.PluginPrefix("test"))
+	assert.Panics(t, func() { dst.plugin.RegisterPacketHandler("test", testHandler{}) })
+	assert.Panics(t, func() { dst.plugin.RegisterPacketHandler(PacketTypeCoin, testHandler{}) })
+
+	var packets []Packet
+	for i, payload := range []string{"hello", "fail"} {
+		packet := Packet{
+			SrcChainID: src.chainID,
+			DstChainID: dst.chainID,
+			Sequence:   uint64(i),
+			Type:       "test",
+			Payload:    []byte(payload),
+		}
+		res := src.runTx(ctx, IBCPacketCreateTx{Packet: packet})
+		assert.True(t, res.IsOK(), res.Log)
+		packets = append(packets, packet)
+	}
+	dst.updateChain(src.commit())
+
+	postPacket := func(packet Packet) PacketAck {
+		res := dst.runTx(ctx, IBCPacketPostTx{
+			FromChainID:     src.chainID,
+			FromChainHeight: uint64(src.height),
+			Packet:          packet,
+			Proof:           src.proveKey(egressKey(packet)),
+		})
+		assert.True(t, res.IsOK(), res.Log)
+		var ack PacketAck
+		_, err := load(dst.store, ackKey(packet), &ack)
+		assert.Nil(t, err)
+		return ack
+	}
+
+	// The handler's result is in the Ack
+	ack := postPacket(packets[0])
+	assert.Equal(t, wrsp.CodeType_OK, ack.Code)
+	assert.Equal(t, []byte("hello"), ack.Data)
+	assert.Equal(t, []byte("hello"), handlerStore.Get([]byte("handled,src_chain")))
+	assert.Nil(t, dst.store.Get([]byte("handled,src_chain")))
+
+	// A failed handler's writes are discarded, but the packet is still acked
+	ack = postPacket(packets[1])
+	assert.Equal(t, wrsp.CodeType_BaseInvalidInput, ack.Code)
+	assert.Equal(t, []byte("hello"), handlerStore.Get([]byte("handled,src_chain")))
+	assert.True(t, exists(dst.store, ingressKey(packets[1])))
+}
+
+func TestIBCMisbehaviour(t *testing.T) {
+	src, dst := newTestChain(t, "src_chain"), newTestChain(t, "dst_chain")
+	ctx := types.CallContext{}
+	dst.registerChain(src)
+	openConnection(false, src, dst)
+	packet := Packet{
+		SrcChainID: src.chainID,
+		DstChainID: dst.chainID,
+		Type:       "data",
+		Payload:    []byte("hello world"),
+	}
+	res := src.runTx(ctx, IBCPacketCreateTx{Packet: packet})
+	assert.True(t, res.IsOK(), res.Log)
+
+	header, commit := src.commit()
+	dst.updateChain(header, commit)
+	update := IBCUpdateChainTx{Header: header, Commit: commit}
+	loadChainState := func() (chainState BlockchainState) {
+		_, err := load(dst.store, toKey(_IBC, _BLOCKCHAIN, _STATE, src.chainID), &chainState)
+		assert.Nil(t, err)
+		return chainState
+	}
+
+	// The validators sign a fork with a different AppHash
+	forkHeader, forkCommit := genHeaderAndCommit(src.chainID, header.Height, []byte("forged"), src.vals, src.signers)
+	fork := IBCUpdateChainTx{Header: forkHeader, Commit: forkCommit}
+	res = dst.runTx(ctx, fork)
+	assert.Equal(t, IBCCodeConflictingHeader, res.Code, res.Log)
+
+	// Not evidence of anything
+	res = dst.runTx(ctx, IBCMisbehaviourTx{update, update})
+	assert.Equal(t, wrsp.CodeType_BaseInvalidInput, res.Code, res.Log)
+	_, strangers := genValidators("other_chain", 0, 1, 2, 3)
+	strangerHeader, strangerCommit := genHeaderAndCommit(src.chainID, header.Height, []byte("forged"), src.vals, strangers)
+	res = dst.runTx(ctx, IBCMisbehaviourTx{update, IBCUpdateChainTx{Header: strangerHeader, Commit: strangerCommit}})
+	assert.Equal(t, IBCCodeInvalidCommit, res.Code, res.Log)
+	assert.False(t, loadChainState().Frozen)
+
+	// The fork freezes the chain
+	res = dst.runTx(ctx, IBCMisbehaviourTx{update, fork})
+	assert.True(t, res.IsOK(), res.Log)
+	assert.True(t, loadChainState().Frozen)
+	res = dst.runTx(ctx, IBCMisbehaviourTx{update, fork})
+	assert.Equal(t, IBCCodeChainFrozen, res.Code, res.Log)
+
+	// Nothing more is accepted from it
+	res = dst.runTx(ctx, IBCUpdateChainTx{Header: forkHeader, Commit: forkCommit})
+	assert.Equal(t, IBCCodeChainFrozen, res.Code, res.Log)
+	nextHeader, nextCommit := src.commit()
+	res = dst.runTx(ctx, IBCUpdateChainTx{Header: nextHeader, Commit: nextCommit})
+	assert.Equal(t, IBCCodeChainFrozen, res.Code, res.Log)
+	res = dst.runTx(ctx, IBCPacketPostTx{
+		FromChainID:     src.chainID,
+		FromChainHeight: uint64(header.Height),
+		Packet:          packet,
+		Proof:           src.proveKey(egressKey(packet)),
+	})
+	assert.Equal(t, IBCCodeChainFrozen, res.Code, res.Log)
+
+	// Registering it again takes an approval, even under the open policy,
+	// and starts over without the old headers
+	genesis := BlockchainGenesis{ChainID: src.chainID, Genesis: string(wire.JSONBytes(src.genDoc))}
+	res = dst.runTx(ctx, IBCRegisterChainTx{genesis})
+	assert.Equal(t, IBCCodeUnauthorized, res.Code, res.Log)
+	assert.True(t, loadChainState().Frozen)
+	ApproveChain(dst.store, genesis)
+	dst.registerChain(src)
+	assert.False(t, loadChainState().Frozen)
+	assert.False(t, exists(dst.store, headerKey(src.chainID, uint64(header.Height))))
+	dst.updateChain(nextHeader, nextCommit)
+	res = dst.runTx(ctx, IBCPacketPostTx{
+		FromChainID:     src.chainID,
+		FromChainHeight: uint64(nextHeader.Height),
+		Packet:          packet,
+		Proof:           src.proveKey(egressKey(packet)),
+	})
+	assert.True(t, res.IsOK(), res.Log)
+}
+
+func TestIBCCoinTransfer(t *testing.T) {
+	src, dst := newTestChain(t, "src_chain"), newTestChain(t, "dst_chain")
+	dst.registerChain(src)
+	src.registerChain(dst)
+	openConnection(false, src, dst)
+	openConnection(false, dst, src)
+
+	sender := testutils.PrivAccountFromSecret("sender").Account.PubKey.Address()
+	recipient := testutils.PrivAccountFromSecret("recipient").Account.PubKey.Address()
+	balance := func(chain *testChain, addr []byte) types.Coins {
+		acc := state.GetAccount(chain.cache, addr)
+		if acc == nil {
+			return nil
+		}
+		return acc.Balance
+	}
+	voucher := VoucherDenom(src.chainID, "mycoin")
+
+	// Creates a coin packet and returns it as stored, with its Sender set.
+	sendCoins := func(from, to *testChain, ctx types.CallContext, coins types.Coins, addr []byte) (Packet, wrsp.Result) {
+		packet := Packet{
+			SrcChainID: from.chainID,
+			DstChainID: to.chainID,
+			Type:       PacketTypeCoin,
+			Payload:    wire.BinaryBytes(CoinsPayload{Recipient: addr, Coins: coins}),
+		}
+		res := from.runTx(ctx, IBCPacketCreateTx{Packet: packet})
+		if res.IsOK() {
+			wire.ReadBinaryBytes(res.Data, &packet.Sequence)
+			_, err := load(from.store, egressKey(packet), &packet)
+			assert.Nil(t, err)
+		}
+		return packet, res
+	}
+	postPacket := func(from, to *testChain, packet Packet) {
+		to.updateChain(from.commit())
+		res := to.runTx(types.CallContext{}, IBCPacketPostTx{
+			FromChainID:     from.chainID,
+			FromChainHeight: uint64(from.height),
+			Packet:          packet,
+			Proof:           from.proveKey(egressKey(packet)),
+		})
+		assert.True(t, res.IsOK(), res.Log)
+	}
+
+	// Can't send more than the tx provides
+	_, res := sendCoins(src, dst, src.txContext(sender, types.Coins{{"mycoin", 10}}), types.Coins{{"mycoin", 20}}, recipient)
+	assert.Equal(t, wrsp.CodeType_BaseInsufficientFunds, res.Code, res.Log)
+
+	// Escrow 7 on the source chain, for 7 vouchers on the destination.
+	// The other 3 are refunded.
+	ctx := src.txContext(sender, types.Coins{{"mycoin", 10}})
+	packet, res := sendCoins(src, dst, ctx, types.Coins{{"mycoin", 7}}, recipient)
+	assert.True(t, res.IsOK(), res.Log)
+	var payload CoinsPayload
+	assert.Nil(t, wire.ReadBinaryBytes(packet.Payload, &payload))
+	assert.Equal(t, sender, payload.Sender)
+	assert.Equal(t, types.Coins{{"mycoin", 7}}, balance(src, EscrowAddress()))
+	assert.Equal(t, types.Coins{{"mycoin", 3}}, balance(src, sender))
+
+	postPacket(src, dst, packet)
+	assert.Equal(t, types.Coins{{voucher, 7}}, balance(dst, recipient))
+
+	// Send 3 vouchers back, which are burned and released from escrow
+	ctx = dst.txContext(recipient, types.Coins{{voucher, 3}})
+	packet, res = sendCoins(dst, src, ctx, types.Coins{{voucher, 3}}, sender)
+	assert.True(t, res.IsOK(), res.Log)
+	assert.Nil(t, balance(dst, EscrowAddress()))
+
+	postPacket(dst, src, packet)
+	assert.Equal(t, types.Coins{{"mycoin", 6}}, balance(src, sender))
+	assert.Equal(t, types.Coins{{"mycoin", 4}}, balance(src, EscrowAddress()))
+
+	// More vouchers than were escrowed for them are refused with an error Ack,
+	// and minted again when it's proven back.
+	ctx = dst.txContext(recipient, types.Coins{{voucher, 8}})
+	packet, res = sendCoins(dst, src, ctx, types.Coins{{voucher, 8}}, sender)
+	assert.True(t, res.IsOK(), res.Log)
+
+	postPacket(dst, src, packet)
+	assert.Equal(t, types.Coins{{"mycoin", 6}}, balance(src, sender))
+	assert.Equal(t, types.Coins{{"mycoin", 4}}, balance(src, EscrowAddress()))
+	var ack PacketAck
+	_, err := load(src.store, ackKey(packet), &ack)
+	assert.Nil(t, err)
+	assert.Equal(t, wrsp.CodeType_BaseInsufficientFunds, ack.Code)
+
+	before := balance(dst, recipient)
+	dst.updateChain(src.commit())
+	res = dst.runTx(types.CallContext{}, IBCPacketAckTx{
+		FromChainHeight: uint64(src.height),
+		Packet:          packet,
+		Ack:             ack,
+		Proof:           src.proveKey(ackKey(packet)),
+	})
+	assert.True(t, res.IsOK(), res.Log)
+	assert.Equal(t, before.Plus(types.Coins{{voucher, 8}}), balance(dst, recipient))
+}
+
+func TestIBCCosts(t *testing.T) {
+	chain := newTestChain(t, "test_chain")
+	other := newTestChain(t, "other_chain")
+	caller := testutils.PrivAccountFromSecret("caller").Account.PubKey.Address()
+	balance := func(addr []byte) types.Coins {
+		acc := state.GetAccount(chain.cache, addr)
+		if acc == nil {
+			return nil
+		}
+		return acc.Balance
+	}
+
+	log := chain.plugin.SetOption(chain.store, "costs", `{"register_chain": [{"denom": "mycoin", "amount": 5}]}`)
+	assert.Equal(t, "Success", log)
+	log = chain.plugin.SetOption(chain.store, "costs", `{"register_chain": [{"denom": "mycoin", "amount": -5}]}`)
+	assert.NotEqual(t, "Success", log)
+
+	registerTx := IBCRegisterChainTx{BlockchainGenesis{
+		ChainID: other.chainID,
+		Genesis: string(wire.JSONBytes(other.genDoc)),
+	}}
+	res := chain.runTx(chain.txContext(caller, types.Coins{{"mycoin", 4}}), registerTx)
+	assert.Equal(t, wrsp.CodeType_BaseInsufficientFunds, res.Code, res.Log)
+
+	// The cost goes to the fee pool, the rest back to the caller
+	res = chain.runTx(chain.txContext(caller, types.Coins{{"mycoin", 7}}), registerTx)
+	assert.True(t, res.IsOK(), res.Log)
+	assert.Equal(t, types.Coins{{"mycoin", 5}}, balance(state.FeePoolAddress()))
+	assert.Equal(t, types.Coins{{"mycoin", 2}}, balance(caller))
+}
+
+func TestIBCRelayFee(t *testing.T) {
+	src, dst := newTestChain(t, "src_chain"), newTestChain(t, "dst_chain")
+	dst.registerChain(src)
+	src.registerChain(dst)
+	openConnection(false, src, dst)
+
+	sender := testutils.PrivAccountFromSecret("sender").Account.PubKey.Address()
+	relayer := testutils.PrivAccountFromSecret("relayer").Account.PubKey.Address()
+	balance := func(chain *testChain, addr []byte) types.Coins {
+		acc := state.GetAccount(chain.cache, addr)
+		if acc == nil {
+			return nil
+		}
+		return acc.Balance
+	}
+
+	packet := Packet{
+		SrcChainID: src.chainID,
+		DstChainID: dst.chainID,
+		Type:       "data",
+		Payload:    []byte("hello world"),
+	}
+	ctx := src.txContext(sender, types.Coins{{"mycoin", 5}})
+	res := src.runTx(ctx, IBCPacketCreateTx{Packet: packet, Fee: types.Coins{{"mycoin", 2}}})
+	assert.True(t, res.IsOK(), res.Log)
+	assert.Equal(t, types.Coins{{"mycoin", 2}}, balance(src, EscrowAddress()))
+	assert.Equal(t, types.Coins{{"mycoin", 3}}, balance(src, sender))
+
+	// The relayer who posts the packet gets the fee, once the Ack is proven
+	dst.updateChain(src.commit())
+	res = dst.runTx(types.CallContext{CallerAddress: relayer}, IBCPacketPostTx{
+		FromChainID:     src.chainID,
+		FromChainHeight: uint64(src.height),
+		Packet:          packet,
+		Proof:           src.proveKey(egressKey(packet)),
+	})
+	assert.True(t, res.IsOK(), res.Log)
+
+	src.updateChain(dst.commit())
+	res = src.runTx(types.CallContext{}, IBCPacketAckTx{
+		FromChainHeight: uint64(dst.height),
+		Packet:          packet,
+		Ack:             PacketAck{Code: wrsp.CodeType_OK, Relayer: relayer},
+		Proof:           dst.proveKey(ackKey(packet)),
+	})
+	assert.True(t, res.IsOK(), res.Log)
+	assert.Equal(t, types.Coins{{"mycoin", 2}}, balance(src, relayer))
+	assert.True(t, balance(src, EscrowAddress()).IsZero())
+}
@@ -0,0 +1,68 @@
+package ibc
+
+import (
+	"bytes"
+
+	merkle "github.com/tepleton/go-merkle"
+)
+
+// AbsenceProof proves a key is not in an IAVL tree by the existence
+// proofs of its neighbours: Left is the greatest key before it and Right
+// the least key after it. Either is nil if the key would be at that end
+// of the tree. The neighbours are adjacent if their leaf indices differ
+// by one, which is checked with the (hashed) subtree sizes in the proofs.
+type AbsenceProof struct {
+	Left  *merkle.IAVLProof
+	Right *merkle.IAVLProof
+}
+
+func (proof AbsenceProof) Verify(key []byte, rootHash []byte) bool {
+	if proof.Left == nil && proof.Right == nil {
+		return false
+	}
+	var leftIndex, rightIndex, size int
+	if proof.Left != nil {
+		leaf := proof.Left.LeafNode
+		if bytes.Compare(leaf.KeyBytes, key) >= 0 {
+			return false
+		}
+		if !proof.Left.Verify(leaf.KeyBytes, leaf.ValueBytes, rootHash) {
+			return false
+		}
+		leftIndex, size = leafIndex(proof.Left)
+	}
+	if proof.Right != nil {
+		leaf := proof.Right.LeafNode
+		if bytes.Compare(leaf.KeyBytes, key) <= 0 {
+			return false
+		}
+		if !proof.Right.Verify(leaf.KeyBytes, leaf.ValueBytes, rootHash) {
+			return false
+		}
+		rightIndex, size = leafIndex(proof.Right)
+	}
+
+	switch {
+	case proof.Left == nil:
+		return rightIndex == 0
+	case proof.Right == nil:
+		return leftIndex == size-1
+	default:
+		return rightIndex == leftIndex+1
+	}
+}
+
+// Returns the index of the proof's leaf, and the size of the tree.
+// InnerNodes go from the leaf up to the root. Where the path goes right
+// the node's Left hash is set, and every leaf in the left subtree comes
+// before ours.
+func leafIndex(proof *merkle.IAVLProof) (index int, size int) {
+	size = 1
+	for _, node := range proof.InnerNodes {
+		if len(node.Left) > 0 {
+			index += int(node.Size) - size
+		}
+		size = int(node.Size)
+	}
+	return index, size
+}
@@ -0,0 +1,169 @@
+package ibc
+
+import (
+	"bytes"
+	"encoding/hex"
+
+	wrsp "github.com/tepleton/wrsp/types"
+	"github.com/tepleton/basecoin/types"
+	cmn "github.com/tepleton/go-common"
+	"github.com/tepleton/go-wire"
+)
+
+// Who may send an IBCRegisterChainTx, and open or close this chain's
+// connections, set with the "IBC/registration" option.
+const (
+	RegistrationOpen       = "open"       // Anyone, the default
+	RegistrationAllowlist  = "allowlist"  // Addresses added with the "IBC/registrar" option, until "IBC/revoke_registrar"
+	RegistrationGovernance = "governance" // Anyone, for a genesis approved with ApproveChain
+)
+
+// Approves registering chainGen, when the policy is RegistrationGovernance.
+// For a governance plugin to call once a proposal passes, on the IBC
+// plugin's store from the app's Host, or set with the "IBC/approve"
+// option, as JSON.
+// The approval is used up by the registration.
+func ApproveChain(store types.KVStore, chainGen BlockchainGenesis) {
+	store.Set(toKey(_IBC, _APPROVAL, chainGen.ChainID), wire.BinaryRipemd160(chainGen))
+}
+
+// Approves opening or closing the connection from this chain to
+// dstChainID once, when the policy is RegistrationGovernance, like
+// ApproveChain. srcChainID is this chain's ID.
+func ApproveConnection(store types.KVStore, srcChainID, dstChainID string) {
+	save(store, toKey(_IBC, _APPROVAL, _CONNECTION, srcChainID, dstChainID), true)
+}
+
+func setRegistrationOption(store types.KVStore, key string, value string) (log string) {
+	switch key {
+	case "registration":
+		switch value {
+		case RegistrationOpen, RegistrationAllowlist, RegistrationGovernance:
+			save(store, toKey(_IBC, _REGISTRATION), value)
+			return "Success"
+		}
+		return "Unknown registration policy " + value
+	case "registrar":
+		addr, err := hex.DecodeString(value)
+		if err != nil || len(addr) != 20 {
+			return "Invalid registrar address " + value
+		}
+		save(store, toKey(_IBC, _REGISTRAR, cmn.Fmt("%X", addr)), true)
+		return "Success"
+	case "revoke_registrar":
+		addr, err := hex.DecodeString(value)
+		if err != nil || len(addr) != 20 {
+			return "Invalid registrar address " + value
+		}
+		store.Delete(toKey(_IBC, _REGISTRAR, cmn.Fmt("%X", addr)))
+		return "Success"
+	case "approve":
+		var err error
+		var chainGen BlockchainGenesis
+		wire.ReadJSONPtr(&chainGen, []byte(value), &err)
+		if err != nil {
+			return "Error decoding genesis: " + err.Error()
+		}
+		ApproveChain(store, chainGen)
+		return "Success"
+	}
+	return "Unrecognized option key " + key
+}
+
+//----------------------------------------
+
+// Sets sm.res unless the policy lets the caller register chainGen.
+func (sm *IBCStateMachine) checkRegistration(chainGen BlockchainGenesis) bool {
+	policy, ok := sm.loadRegistrationPolicy()
+	if !ok {
+		return false
+	}
+
+	switch policy {
+	case RegistrationOpen:
+		return true
+	case RegistrationAllowlist:
+		if sm.isRegistrar() {
+			return true
+		}
+		sm.res = wrsp.NewError(IBCCodeUnauthorized, cmn.Fmt("%X may not register chains", sm.ctx.CallerAddress))
+		return false
+	case RegistrationGovernance:
+		if sm.isApproved(chainGen) {
+			return true
+		}
+		sm.res = wrsp.NewError(IBCCodeUnauthorized, cmn.Fmt("Registering %v has not been approved", chainGen.ChainID))
+		return false
+	}
+	sm.res = wrsp.ErrInternalError.AppendLog("Unknown registration policy " + policy)
+	return false
+}
+
+// Sets sm.res unless the caller may register a Frozen chain again from
+// chainGen. Under any policy that takes a registrar or an approval, or
+// whoever saw the chain frozen could replace its validators.
+func (sm *IBCStateMachine) checkReregistration(chainGen BlockchainGenesis) bool {
+	if sm.isRegistrar() || sm.isApproved(chainGen) {
+		return true
+	}
+	sm.res = wrsp.NewError(IBCCodeUnauthorized, cmn.Fmt("Registering frozen chain %v again takes a registrar or an approval", chainGen.ChainID))
+	return false
+}
+
+// Sets sm.res unless the policy lets the caller open or close conn, an
+// egress connection of this chain, which isNew if it doesn't exist yet.
+// Under RegistrationOpen anyone may open a new one and becomes its Owner,
+// who alone may close or reopen it. Otherwise it takes a registrar, or an
+// approval from ApproveConnection, which is used up.
+func (sm *IBCStateMachine) checkConnection(conn Connection, isNew bool) bool {
+	policy, ok := sm.loadRegistrationPolicy()
+	if !ok {
+		return false
+	}
+
+	switch policy {
+	case RegistrationOpen:
+		if isNew || bytes.Equal(conn.Owner, sm.ctx.CallerAddress) {
+			return true
+		}
+		sm.res = wrsp.NewError(IBCCodeUnauthorized, "Only the owner may close or reopen a connection")
+		return false
+	case RegistrationAllowlist:
+		if sm.isRegistrar() {
+			return true
+		}
+		sm.res = wrsp.NewError(IBCCodeUnauthorized, cmn.Fmt("%X may not open or close connections", sm.ctx.CallerAddress))
+		return false
+	case RegistrationGovernance:
+		approvalKey := toKey(_IBC, _APPROVAL, _CONNECTION, conn.SrcChainID, conn.DstChainID)
+		if exists(sm.store, approvalKey) {
+			sm.store.Delete(approvalKey)
+			return true
+		}
+		sm.res = wrsp.NewError(IBCCodeUnauthorized, cmn.Fmt("Opening or closing the connection to %v has not been approved", conn.DstChainID))
+		return false
+	}
+	sm.res = wrsp.ErrInternalError.AppendLog("Unknown registration policy " + policy)
+	return false
+}
+
+// The policy set with the "IBC/registration" option, or RegistrationOpen.
+func (sm *IBCStateMachine) loadRegistrationPolicy() (policy string, ok bool) {
+	policy = RegistrationOpen
+	_, err := load(sm.store, toKey(_IBC, _REGISTRATION), &policy)
+	if err != nil {
+		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading registration policy: %v", err.Error()))
+		return "", false
+	}
+	return policy, true
+}
+
+func (sm *IBCStateMachine) isRegistrar() bool {
+	return exists(sm.store, toKey(_IBC, _REGISTRAR, cmn.Fmt("%X", sm.ctx.CallerAddress)))
+}
+
+// Whether chainGen was approved with ApproveChain.
+func (sm *IBCStateMachine) isApproved(chainGen BlockchainGenesis) bool {
+	approval := sm.store.Get(toKey(_IBC, _APPROVAL, chainGen.ChainID))
+	return len(approval) > 0 && bytes.Equal(approval, wire.BinaryRipemd160(chainGen))
+}
@@ -0,0 +1,213 @@
+package ibc
+
+import (
+	"strings"
+
+	wrsp "github.com/tepleton/wrsp/types"
+	"github.com/tepleton/basecoin/types"
+	cmn "github.com/tepleton/go-common"
+	"github.com/tepleton/go-wire"
+)
+
+// Packet.Type of a CoinsPayload
+const PacketTypeCoin = "coin"
+
+// CoinsPayload moves Coins from Sender on the source chain to Recipient
+// on the destination chain. The source chain sets Sender to the caller.
+//
+// Coins leaving their chain are escrowed, and credited on the destination
+// as vouchers, with the source ChainID and "/" prefixed to their denom.
+// Vouchers sent back to the chain they name are burned, and the escrowed
+// coins released.
+type CoinsPayload struct {
+	Sender    []byte
+	Recipient []byte
+	Coins     types.Coins
+}
+
+// The IBC plugin's module account. It holds the coins sent out over IBC,
+// until they return or are refunded, and the relay fees.
+// How much was sent to each chain is kept at @[:ibc, :escrow, ChainID].
+func EscrowAddress() []byte {
+	return types.ModuleAddress("IBC")
+}
+
+// Returns the denom of a voucher for denom from chainID.
+func VoucherDenom(chainID string, denom string) string {
+	return chainID + "/" + denom
+}
+
+//----------------------------------------
+
+// Takes the payload's coins from ctx.Coins() as the packet is created,
+// escrowing them or burning returning vouchers.
+func (sm *IBCStateMachine) sendCoins(packet *Packet) {
+	var payload CoinsPayload
+	err := wire.ReadBinaryBytes(packet.Payload, &payload)
+	if err != nil {
+		sm.res = wrsp.NewError(IBCCodeEncodingError, cmn.Fmt("Decoding CoinsPayload: %v", err.Error()))
+		return
+	}
+	if len(payload.Recipient) == 0 {
+		sm.res = wrsp.ErrBaseInvalidInput.AppendLog("CoinsPayload has no Recipient")
+		return
+	}
+	if !payload.Coins.IsValid() || !payload.Coins.IsPositive() {
+		sm.res = wrsp.ErrBaseInvalidInput.AppendLog(cmn.Fmt("Invalid coins %v", payload.Coins))
+		return
+	}
+	if !sm.ctx.Coins().IsGTE(payload.Coins) {
+		sm.res = wrsp.ErrBaseInsufficientFunds.AppendLog(cmn.Fmt("Sending %v, only provided %v", payload.Coins, sm.ctx.Coins()))
+		return
+	}
+
+	payload.Sender = sm.ctx.CallerAddress
+	packet.Payload = wire.BinaryBytes(payload)
+
+	// Returning vouchers are burned
+	returning, escrow := splitVouchers(packet.DstChainID, payload.Coins)
+	if res := sm.ctx.Burn(returning); res.IsErr() {
+		sm.res = res
+		return
+	}
+	sm.escrowCoins(packet.DstChainID, escrow)
+}
+
+// Credits the payload's coins to its recipient as the packet is posted.
+// Returns an error if the packet should be acked as failed,
+// in which case nothing is written.
+func (sm *IBCStateMachine) receiveCoins(packet Packet) (res wrsp.Result) {
+	var payload CoinsPayload
+	err := wire.ReadBinaryBytes(packet.Payload, &payload)
+	if err != nil {
+		return wrsp.NewError(IBCCodeEncodingError, cmn.Fmt("Decoding CoinsPayload: %v", err.Error()))
+	}
+	if len(payload.Recipient) == 0 {
+		return wrsp.ErrBaseInvalidInput.AppendLog("CoinsPayload has no Recipient")
+	}
+	if !payload.Coins.IsValid() || !payload.Coins.IsPositive() {
+		return wrsp.ErrBaseInvalidInput.AppendLog(cmn.Fmt("Invalid coins %v", payload.Coins))
+	}
+
+	// Returning vouchers are released from escrow, as their base denom.
+	returning, vouchers := splitVouchers(packet.DstChainID, payload.Coins)
+	if len(vouchers) > 0 && sm.host == nil {
+		return wrsp.ErrInternalError.AppendLog("Minting vouchers needs the plugin to have a Host")
+	}
+	released := types.Coins{}
+	for _, coin := range returning {
+		coin.Denom = strings.TrimPrefix(coin.Denom, VoucherDenom(packet.DstChainID, ""))
+		released = released.Plus(types.Coins{coin})
+	}
+	escrowKey := toKey(_IBC, _ESCROW, packet.SrcChainID)
+	var escrowed types.Coins
+	_, err = load(sm.store, escrowKey, &escrowed)
+	if err != nil {
+		return wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading escrow: %v", err.Error()))
+	}
+	if !escrowed.IsGTE(released) {
+		return wrsp.ErrBaseInsufficientFunds.AppendLog(
+			cmn.Fmt("%v returned %v, but only %v was sent there", packet.SrcChainID, released, escrowed))
+	}
+	if len(released) > 0 {
+		res := sm.ctx.Bank.PayFromModule(payload.Recipient, released)
+		if res.IsErr() {
+			return res
+		}
+		save(sm.store, escrowKey, escrowed.Minus(released))
+	}
+
+	// Everything else is minted as vouchers of the source chain.
+	minted := types.Coins{}
+	for _, coin := range vouchers {
+		coin.Denom = VoucherDenom(packet.SrcChainID, coin.Denom)
+		minted = minted.Plus(types.Coins{coin})
+	}
+	if len(minted) > 0 {
+		return sm.mint(payload.Recipient, minted)
+	}
+	return wrsp.OK
+}
+
+// Returns the payload's coins to its sender, after an error Ack or a timeout.
+func (sm *IBCStateMachine) refundCoins(packet Packet) {
+	var payload CoinsPayload
+	err := wire.ReadBinaryBytes(packet.Payload, &payload)
+	if err != nil {
+		// We encoded it in sendCoins.
+		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Decoding CoinsPayload: %v", err.Error()))
+		return
+	}
+
+	_, escrow := splitVouchers(packet.DstChainID, payload.Coins)
+	escrowKey := toKey(_IBC, _ESCROW, packet.DstChainID)
+	var escrowed types.Coins
+	_, err = load(sm.store, escrowKey, &escrowed)
+	if err != nil {
+		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading escrow: %v", err.Error()))
+		return
+	}
+	if !escrowed.IsGTE(escrow) {
+		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Refunding %v, but only %v is escrowed", escrow, escrowed))
+		return
+	}
+	if len(escrow) > 0 {
+		res := sm.ctx.Bank.PayFromModule(payload.Sender, escrow)
+		if res.IsErr() {
+			sm.res = wrsp.ErrInternalError.AppendLog(res.Log)
+			return
+		}
+		save(sm.store, escrowKey, escrowed.Minus(escrow))
+	}
+
+	// Burned vouchers are minted again.
+	vouchers, _ := splitVouchers(packet.DstChainID, payload.Coins)
+	if len(vouchers) > 0 {
+		if res := sm.mint(payload.Sender, vouchers); res.IsErr() {
+			sm.res = res
+		}
+	}
+}
+
+func (sm *IBCStateMachine) mint(addr []byte, coins types.Coins) wrsp.Result {
+	if sm.host == nil {
+		return wrsp.ErrInternalError.AppendLog("Minting vouchers needs the plugin to have a Host")
+	}
+	err := sm.host.Mint(sm.store, addr, coins)
+	if err != nil {
+		return wrsp.ErrInternalError.AppendLog(cmn.Fmt("Minting vouchers: %v", err.Error()))
+	}
+	return wrsp.OK
+}
+
+func (sm *IBCStateMachine) escrowCoins(chainID string, coins types.Coins) {
+	if len(coins) == 0 {
+		return
+	}
+	escrowKey := toKey(_IBC, _ESCROW, chainID)
+	var escrowed types.Coins
+	_, err := load(sm.store, escrowKey, &escrowed)
+	if err != nil {
+		sm.res = wrsp.ErrInternalError.AppendLog(cmn.Fmt("Loading escrow: %v", err.Error()))
+		return
+	}
+	res := sm.ctx.Send(EscrowAddress(), coins)
+	if res.IsErr() {
+		sm.res = res
+		return
+	}
+	save(sm.store, escrowKey, escrowed.Plus(coins))
+}
+
+// Splits coins into vouchers of chainID, and the rest.
+func splitVouchers(chainID string, coins types.Coins) (vouchers types.Coins, others types.Coins) {
+	prefix := VoucherDenom(chainID, "")
+	for _, coin := range coins {
+		if strings.HasPrefix(coin.Denom, prefix) {
+			vouchers = append(vouchers, coin)
+		} else {
+			others = append(others, coin)
+		}
+	}
+	return vouchers, others
+}
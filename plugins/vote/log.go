@@ -0,0 +1,7 @@
+package vote
+
+import (
+	"github.com/tepleton/go-logger"
+)
+
+var log = logger.New("module", "vote")
@@ -1,92 +1,425 @@
 package vote
 
 import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
 	wrsp "github.com/tepleton/wrsp/types"
+	"github.com/tepleton/basecoin/state"
 	"github.com/tepleton/basecoin/types"
+	cmn "github.com/tepleton/go-common"
 	"github.com/tepleton/go-wire"
 )
 
-type Vote struct {
-	bb *ballotBox
+type VotePluginState struct {
+	// @[Prefix, :params] <~ VoteParams
+	// @[Prefix, :count] <~ uint64, the ID of the next proposal
+	// @[Prefix, :proposal, ID] <~ Proposal
+	// @[Prefix, :tally, ID] <~ Tally
+	// @[Prefix, :ballot, ID, Address] <~ Ballot
+	// @[Prefix, :deadline, EndHeight, ID] <~ uint64, while the proposal is open
+}
+
+// Set with the "<name>/params" option, as JSON.
+type VoteParams struct {
+	Denom        string      `json:"denom"`         // Votes are weighted by the voter's balance of Denom
+	Deposit      types.Coins `json:"deposit"`       // Held from the proposer until the proposal is decided
+	VotingPeriod uint64      `json:"voting_period"` // Number of blocks a proposal is open for
+}
+
+const DefaultVotingPeriod = 100
+
+// A Proposal is open for votes until EndHeight, inclusive.
+// Denom is VoteParams.Denom when it was proposed.
+type Proposal struct {
+	ID        uint64
+	Issue     string
+	Proposer  []byte
+	Deposit   types.Coins
+	Denom     string
+	EndHeight uint64
+}
+
+// Tally is counted as votes come in, and recounted and made Final in the
+// BeginBlock after EndHeight. A proposal passes with more Yes than No.
+// The deposit goes back to the proposer if it passes,
+// and to the fee pool if not.
+type Tally struct {
+	Yes    int64
+	No     int64
+	Final  bool
+	Passed bool
 }
 
-type ballotBox struct {
-	issue    string
-	votesYes int
-	votesNo  int
+// Weight is the voter's balance of the proposal's Denom when they voted.
+// The final tally counts it up to the voter's balance then, so coins moved
+// to another address to vote again are only counted once.
+type Ballot struct {
+	Voter  []byte
+	Yes    bool
+	Weight int64
 }
 
-type Tx struct {
-	voteYes bool
+//--------------------------------------------------------------------------------
+
+const (
+	VoteTxTypePropose = byte(0x01)
+	VoteTxTypeBallot  = byte(0x02)
+
+	VoteCodeUnknownProposal = wrsp.CodeType(1201)
+	VoteCodeVotingClosed    = wrsp.CodeType(1202)
+	VoteCodeAlreadyVoted    = wrsp.CodeType(1203)
+	VoteCodeNoWeight        = wrsp.CodeType(1204)
+)
+
+var _ = wire.RegisterInterface(
+	struct{ VoteTx }{},
+	wire.ConcreteType{ProposeTx{}, VoteTxTypePropose},
+	wire.ConcreteType{BallotTx{}, VoteTxTypeBallot},
+)
+
+type VoteTx interface {
+	AssertIsVoteTx()
+	ValidateBasic() wrsp.Result
 }
 
-func NewVoteInstance(issue string) Vote {
-	return Vote{
-		&ballotBox{
-			issue:    issue,
-			votesYes: 0,
-			votesNo:  0,
-		},
+func (ProposeTx) AssertIsVoteTx() {}
+func (BallotTx) AssertIsVoteTx()  {}
+
+// Opens a new proposal, for the deposit in VoteParams.
+// Returns its ID in res.Data.
+type ProposeTx struct {
+	Issue string
+}
+
+func (tx ProposeTx) ValidateBasic() (res wrsp.Result) {
+	if tx.Issue == "" {
+		return wrsp.ErrBaseInvalidInput.AppendLog("Issue is empty")
 	}
+	return
 }
 
-func (app Vote) SetOption(store types.KVStore, key string, value string) (log string) {
-	return ""
+// Votes on an open proposal with the caller's balance of its Denom.
+// Each address votes once. Any coins sent are returned.
+type BallotTx struct {
+	ProposalID uint64
+	Yes        bool
 }
 
-//because no coins are being exchanged ctx is unused
-func (app Vote) RunTx(store types.KVStore, ctx types.CallContext, txBytes []byte) (res wrsp.Result) {
+func (tx BallotTx) ValidateBasic() (res wrsp.Result) {
+	return
+}
+
+//--------------------------------------------------------------------------------
+
+type VotePlugin struct {
+	name   string
+	height uint64
+}
 
+func (vp *VotePlugin) Name() string {
+	return vp.name
+}
+
+func New(name string) *VotePlugin {
+	return &VotePlugin{
+		name: name,
+	}
+}
+
+// Key parts are joined with ',' after the plugin's prefix
+func (vp *VotePlugin) key(parts ...string) []byte {
+	return []byte(fmt.Sprintf("VotePlugin{name=%v},%v", vp.name, strings.Join(parts, ",")))
+}
+
+// Its keys were stored at the root of the app's store, as they are now.
+func (vp *VotePlugin) OwnsLegacyKey(key []byte) bool {
+	return bytes.HasPrefix(key, vp.key())
+}
+
+func (vp *VotePlugin) deadlineKey(endHeight, id uint64) []byte {
+	return vp.key("deadline", cmn.Fmt("%020d", endHeight), cmn.Fmt("%020d", id))
+}
+
+func (vp *VotePlugin) SetOption(store types.KVStore, key string, value string) (log string) {
+	switch key {
+	case "params":
+		var err error
+		var params VoteParams
+		wire.ReadJSONPtr(&params, []byte(value), &err)
+		if err != nil {
+			return "Error decoding params: " + err.Error()
+		}
+		if !params.Deposit.IsValid() || !params.Deposit.IsNonnegative() || params.VotingPeriod == 0 {
+			return "Invalid params: " + value
+		}
+		save(store, vp.key("params"), params)
+		return "Success"
+	}
+	return "Unrecognized option key " + key
+}
+
+func (vp *VotePlugin) loadParams(store types.KVStore) (params VoteParams, err error) {
+	params.VotingPeriod = DefaultVotingPeriod
+	_, err = load(store, vp.key("params"), &params)
+	return params, err
+}
+
+func (vp *VotePlugin) RunTx(store types.KVStore, ctx types.CallContext, txBytes []byte) (res wrsp.Result) {
 	// Decode tx
-	var tx Tx
+	var tx VoteTx
 	err := wire.ReadBinaryBytes(txBytes, &tx)
 	if err != nil {
-		return wrsp.ErrBaseEncodingError.AppendLog("Error decoding tx: " + err.Error())
+		return wrsp.ErrBaseEncodingError.AppendLog("Error decoding tx: " + err.Error()).PrependLog("VoteTx Error: ")
 	}
 
-	//Read the ballotBox from the store
-	kvBytes := store.Get([]byte(app.bb.issue))
-	var tempBB ballotBox
+	// Validate tx
+	res = tx.ValidateBasic()
+	if res.IsErr() {
+		return res.PrependLog("ValidateBasic Failed: ")
+	}
+
+	params, err := vp.loadParams(store)
+	if err != nil {
+		return wrsp.ErrInternalError.AppendLog("Loading params: " + err.Error())
+	}
+
+	switch tx := tx.(type) {
+	case ProposeTx:
+		res = vp.runProposeTx(store, &ctx, params, tx)
+	case BallotTx:
+		res = vp.runBallotTx(store, &ctx, params, tx)
+	}
+	return res
+}
+
+func (vp *VotePlugin) runProposeTx(store types.KVStore, ctx *types.CallContext, params VoteParams, tx ProposeTx) wrsp.Result {
+	if !ctx.Coins().IsGTE(params.Deposit) {
+		return wrsp.ErrBaseInsufficientFunds.AppendLog(cmn.Fmt("Deposit is %v, only provided %v", params.Deposit, ctx.Coins()))
+	}
+
+	var id uint64
+	_, err := load(store, vp.key("count"), &id)
+	if err != nil {
+		return wrsp.ErrInternalError.AppendLog("Loading count: " + err.Error())
+	}
+	proposal := Proposal{
+		ID:        id,
+		Issue:     tx.Issue,
+		Proposer:  ctx.CallerAddress,
+		Deposit:   params.Deposit,
+		Denom:     params.Denom,
+		EndHeight: vp.height + params.VotingPeriod,
+	}
+	save(store, vp.key("count"), id+1)
+	save(store, vp.key("proposal", cmn.Fmt("%v", id)), proposal)
+	save(store, vp.key("tally", cmn.Fmt("%v", id)), Tally{})
+	save(store, vp.deadlineKey(proposal.EndHeight, id), id)
 
-	//does the issue already exist?
-	if kvBytes != nil {
-		err := wire.ReadBinaryBytes(kvBytes, &tempBB)
+	// The deposit is held in the module account, return the rest
+	res := ctx.Send(types.ModuleAddress(vp.name), params.Deposit)
+	if res.IsErr() {
+		return res
+	}
+	res = ctx.Refund()
+	if res.IsErr() {
+		return res
+	}
+	return wrsp.NewResultOK(wire.BinaryBytes(id), "")
+}
+
+func (vp *VotePlugin) runBallotTx(store types.KVStore, ctx *types.CallContext, params VoteParams, tx BallotTx) wrsp.Result {
+	idStr := cmn.Fmt("%v", tx.ProposalID)
+	var proposal Proposal
+	exists, err := load(store, vp.key("proposal", idStr), &proposal)
+	if err != nil {
+		return wrsp.ErrInternalError.AppendLog("Loading proposal: " + err.Error())
+	}
+	if !exists {
+		return wrsp.NewError(VoteCodeUnknownProposal, cmn.Fmt("No proposal %v", tx.ProposalID))
+	}
+	var tally Tally
+	_, err = load(store, vp.key("tally", idStr), &tally)
+	if err != nil {
+		return wrsp.ErrInternalError.AppendLog("Loading tally: " + err.Error())
+	}
+	if tally.Final || vp.height > proposal.EndHeight {
+		return wrsp.NewError(VoteCodeVotingClosed, cmn.Fmt("Voting on proposal %v ended at height %v", tx.ProposalID, proposal.EndHeight))
+	}
+	ballotKey := vp.key("ballot", idStr, cmn.Fmt("%X", ctx.CallerAddress))
+	if len(store.Get(ballotKey)) > 0 {
+		return wrsp.NewError(VoteCodeAlreadyVoted, cmn.Fmt("%X already voted on proposal %v", ctx.CallerAddress, tx.ProposalID))
+	}
+
+	res := ctx.Refund()
+	if res.IsErr() {
+		return res
+	}
+	weight := amountOf(ctx.Balance(ctx.CallerAddress), proposal.Denom)
+	if weight <= 0 {
+		return wrsp.NewError(VoteCodeNoWeight, cmn.Fmt("%X has no %v to vote with", ctx.CallerAddress, proposal.Denom))
+	}
+
+	if tx.Yes {
+		tally.Yes += weight
+	} else {
+		tally.No += weight
+	}
+	save(store, ballotKey, Ballot{Voter: ctx.CallerAddress, Yes: tx.Yes, Weight: weight})
+	save(store, vp.key("tally", idStr), tally)
+	return wrsp.OK
+}
+
+// Query paths, answered with the go-wire encoded value:
+//
+//	/params                      VoteParams
+//	/proposal/<ID>               Proposal
+//	/tally/<ID>                  Tally
+//	/ballot/<ID>/<Address hex>   Ballot
+func (vp *VotePlugin) Query(store types.KVStore, reqQuery wrsp.RequestQuery) (resQuery wrsp.ResponseQuery) {
+	parts := strings.Split(strings.TrimPrefix(reqQuery.Path, "/"), "/")
+	var key []byte
+	switch {
+	case len(parts) == 1 && parts[0] == "params":
+		key = vp.key("params")
+	case len(parts) == 2 && (parts[0] == "proposal" || parts[0] == "tally"):
+		key = vp.key(parts[0], parts[1])
+	case len(parts) == 3 && parts[0] == "ballot":
+		addr, err := hex.DecodeString(parts[2])
 		if err != nil {
-			return wrsp.ErrBaseEncodingError.AppendLog("Error decoding BallotBox: " + err.Error())
+			resQuery.Code = wrsp.CodeType_EncodingError
+			resQuery.Log = "Invalid address hex: " + err.Error()
+			return
 		}
-	} else {
+		key = vp.key("ballot", parts[1], cmn.Fmt("%X", addr))
+	default:
+		resQuery.Code = wrsp.CodeType_UnknownRequest
+		resQuery.Log = "Unknown query path " + reqQuery.Path
+		return
+	}
+	resQuery.Key = key
+	resQuery.Value = store.Get(key)
+	return
+}
+
+func (vp *VotePlugin) InitChain(store types.KVStore, vals []*wrsp.Validator) {
+}
+
+// Finalizes the tallies of the proposals that ended before height.
+// A proposal that can't be finalized is logged and left undecided.
+func (vp *VotePlugin) BeginBlock(store types.KVStore, height uint64) {
+	vp.height = height
 
-		//TODO add extra fee for opening new issue
+	var keys [][]byte
+	iter := store.Iterator(vp.key("deadline", ""), vp.deadlineKey(height, 0))
+	for ; iter.Valid(); iter.Next() {
+		keys = append(keys, iter.Key())
+	}
+	iter.Close()
 
-		tempBB = ballotBox{
-			issue:    app.bb.issue,
-			votesYes: 0,
-			votesNo:  0,
+	for _, key := range keys {
+		parts := strings.Split(string(key), ",")
+		id, err := strconv.ParseUint(parts[len(parts)-1], 10, 64)
+		if err != nil {
+			log.Warn("Invalid deadline key", "key", key, "error", err)
+		} else if err := vp.finalize(store, id); err != nil {
+			log.Warn("Failed to finalize proposal", "id", id, "error", err)
 		}
-		issueBytes := wire.BinaryBytes(struct{ ballotBox }{tempBB})
-		store.Set([]byte(app.bb.issue), issueBytes)
+		store.Delete(key)
 	}
+}
 
-	//Write the updated ballotBox to the store
-	if tx.voteYes {
-		tempBB.votesYes += 1
-	} else {
-		tempBB.votesNo += 1
+func (vp *VotePlugin) finalize(store types.KVStore, id uint64) error {
+	pluginStore, ok := store.(*types.PluginStore)
+	if !ok {
+		return fmt.Errorf("Store is a %T, not a *types.PluginStore", store)
 	}
-	issueBytes := wire.BinaryBytes(struct{ ballotBox }{tempBB})
-	store.Set([]byte(app.bb.issue), issueBytes)
+	bank := pluginStore.Bank()
 
-	return wrsp.OK
+	idStr := cmn.Fmt("%v", id)
+	var proposal Proposal
+	exists, err := load(store, vp.key("proposal", idStr), &proposal)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("No proposal %v", id)
+	}
+
+	// Each ballot counts up to the voter's balance now
+	var tally Tally
+	iter := types.PrefixIterator(store, vp.key("ballot", idStr, ""))
+	for ; iter.Valid(); iter.Next() {
+		var ballot Ballot
+		err := wire.ReadBinaryBytes(iter.Value(), &ballot)
+		if err != nil {
+			err = fmt.Errorf("Invalid ballot %s: %v", iter.Key(), err)
+			iter.Close()
+			return err
+		}
+		weight := amountOf(bank.GetBalance(ballot.Voter), proposal.Denom)
+		if weight > ballot.Weight {
+			weight = ballot.Weight
+		}
+		if ballot.Yes {
+			tally.Yes += weight
+		} else {
+			tally.No += weight
+		}
+	}
+	iter.Close()
+	tally.Final = true
+	tally.Passed = tally.Yes > tally.No
+	save(store, vp.key("tally", idStr), tally)
+
+	if proposal.Deposit.IsZero() {
+		return nil
+	}
+	addr := state.FeePoolAddress()
+	if tally.Passed {
+		addr = proposal.Proposer
+	}
+	res := bank.PayFromModule(addr, proposal.Deposit)
+	if res.IsErr() {
+		return fmt.Errorf("Paying out the deposit: %v", res.Log)
+	}
+	return nil
 }
 
-//unused
-func (app Vote) InitChain(store types.KVStore, vals []*wrsp.Validator) {
+func (vp *VotePlugin) EndBlock(store types.KVStore, height uint64) []*wrsp.Validator {
+	return nil
 }
 
-func (app Vote) BeginBlock(store types.KVStore, height uint64) {
+//--------------------------------------------------------------------------------
+
+func amountOf(coins types.Coins, denom string) int64 {
+	for _, coin := range coins {
+		if coin.Denom == denom {
+			return coin.Amount
+		}
+	}
+	return 0
+}
+
+// Load bytes from store by reading value for key and read into ptr.
+// Returns true if exists, false if nil.
+// Returns err if decoding error.
+func load(store types.KVStore, key []byte, ptr interface{}) (exists bool, err error) {
+	value := store.Get(key)
+	if len(value) == 0 {
+		return false, nil
+	}
+	err = wire.ReadBinaryBytes(value, ptr)
+	if err != nil {
+		return true, fmt.Errorf("Error decoding key 0x%X = 0x%X: %v", key, value, err.Error())
+	}
+	return true, nil
 }
 
-func (app Vote) EndBlock(store types.KVStore, height uint64) []*wrsp.Validator {
-	var diffs []*wrsp.Validator
-	return diffs
+// Save bytes to store by writing obj's go-wire binary bytes.
+func save(store types.KVStore, key []byte, obj interface{}) {
+	store.Set(key, wire.BinaryBytes(obj))
 }
@@ -1,100 +1,153 @@
 package vote
 
 import (
-	"fmt"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+	wrsp "github.com/tepleton/wrsp/types"
 	"github.com/tepleton/basecoin/app"
-	cmn "github.com/tepleton/basecoin/common"
+	sm "github.com/tepleton/basecoin/state"
+	"github.com/tepleton/basecoin/testutils"
 	"github.com/tepleton/basecoin/types"
-	. "github.com/tepleton/go-common"
+	cmn "github.com/tepleton/go-common"
 	"github.com/tepleton/go-wire"
 	eyescli "github.com/tepleton/merkleeyes/client"
 )
 
-const PluginNameVote = "vote"
+func TestVotePlugin(t *testing.T) {
 
-func TestVote(t *testing.T) {
-	//base initialization
-	eyesCli := eyescli.NewLocalClient()
+	// Basecoin initialization
+	eyesCli := eyescli.NewLocalClient("", 0)
 	chainID := "test_chain_id"
 	bcApp := app.NewBasecoin(eyesCli)
 	bcApp.SetOption("base/chainID", chainID)
-	fmt.Println(bcApp.Info())
 
-	//account initialization
-	test1PrivAcc := cmn.PrivAccountFromSecret("test1")
-
-	// Seed Basecoin with account
-	test1Acc := test1PrivAcc.Account
-	test1Acc.Balance = types.Coins{{"", 1000}}
-	fmt.Println(bcApp.SetOption("base/account", string(wire.JSONBytes(test1Acc))))
-
-	//vote initialization
-	votePlugin := NewVoteInstance("humanRights")
-	bcApp.RegisterPlugin(
-		PluginNameVote,
-		votePlugin,
-	)
-
-	//commit
-	res := bcApp.Commit()
-	if res.IsErr() {
-		Exit(Fmt("Failed Commit: %v", res.Error()))
+	// Add Vote plugin
+	votePluginName := "testvote"
+	bcApp.RegisterPlugin(New(votePluginName))
+	params := VoteParams{Denom: "gold", Deposit: types.Coins{{"", 10}}, VotingPeriod: 2}
+	assert.Equal(t, "Success", bcApp.SetOption(votePluginName+"/params", string(wire.JSONBytes(params))))
+
+	// Account initialization
+	privAccs := []types.PrivAccount{
+		testutils.PrivAccountFromSecret("test1"),
+		testutils.PrivAccountFromSecret("test2"),
+		testutils.PrivAccountFromSecret("test3"),
 	}
+	privAccs[0].Account.Balance = types.Coins{{"", 1000}, {"gold", 100}}
+	privAccs[1].Account.Balance = types.Coins{{"", 1000}, {"gold", 30}}
+	privAccs[2].Account.Balance = types.Coins{{"", 1000}}
+	for _, privAcc := range privAccs {
+		bcApp.SetOption("base/account", string(wire.JSONBytes(privAcc.Account)))
+	}
+	sequences := make([]int, len(privAccs))
+	bcApp.BeginBlock(1)
 
-	//transaction sequence number
-	seqNum := 1
-
-	//Construct, Sign, Write function variable
-	CSW := func(fees, sendCoins int64) {
-		// Construct an AppTx signature
+	// Deliver a VoteTx from privAccs[i]
+	DeliverVoteTx := func(i int, inputCoins types.Coins, voteTx VoteTx) wrsp.Result {
+		sequences[i]++
 		tx := &types.AppTx{
-			Fee:   fees,
-			Gas:   0,
-			Name:  PluginNameVote,
-			Input: cmn.MakeInput(test1Acc.PubKey, types.Coins{{"", sendCoins}}, seqNum),
-			Data:  wire.BinaryBytes(struct{ Tx }{Tx{voteYes: true}}), //a vote for human rights
-		}
-
-		// Sign request
-		signBytes := tx.SignBytes(chainID)
-		fmt.Printf("Sign bytes: %X\n", signBytes)
-		sig := test1PrivAcc.PrivKey.Sign(signBytes)
-		tx.Input.Signature = sig
-		fmt.Printf("Signed TX bytes: %X\n", wire.BinaryBytes(struct{ types.Tx }{tx}))
-
-		// Write request
-		txBytes := wire.BinaryBytes(struct{ types.Tx }{tx})
-		res = bcApp.DeliverTx(txBytes)
-		fmt.Println(res)
-
-		if res.IsOK() {
-			seqNum += 1
+			Fee:   types.Coin{"", 0},
+			Name:  votePluginName,
+			Input: types.NewTxInput(privAccs[i].Account.PubKey, inputCoins, sequences[i]),
+			Data:  wire.BinaryBytes(struct{ VoteTx }{voteTx}),
 		}
+		tx.Input.Signature = privAccs[i].Sign(tx.SignBytes(chainID))
+		// The sequence is used even if the plugin fails
+		return bcApp.DeliverTx(wire.BinaryBytes(struct{ types.Tx }{tx}))
 	}
-
-	//Test a basic send, no fees
-	CSW(0, 1)
-	if res.IsErr() {
-		Exit(Fmt("Failed: %v", res.Error()))
+	// Deliver a SendTx of coins from privAccs[i] to privAccs[j]
+	DeliverSendTx := func(i, j int, coins types.Coins) wrsp.Result {
+		sequences[i]++
+		tx := &types.SendTx{
+			Fee:    types.Coin{"", 0},
+			Inputs: []types.TxInput{types.NewTxInput(privAccs[i].Account.PubKey, coins, sequences[i])},
+			Outputs: []types.TxOutput{
+				{Address: privAccs[j].Account.PubKey.Address(), Coins: coins},
+			},
+		}
+		tx.SetSignature(privAccs[i].Account.PubKey.Address(), privAccs[i].Sign(tx.SignBytes(chainID)))
+		return bcApp.DeliverTx(wire.BinaryBytes(struct{ types.Tx }{tx}))
 	}
-
-	//Test fee prevented transaction
-	CSW(2, 1)
-	if res.IsOK() {
-		Exit(Fmt("expected bad transaction"))
+	// Queries read the last committed state
+	queryTally := func(id uint64) (tally Tally) {
+		resQuery := bcApp.Query(wrsp.RequestQuery{Path: cmn.Fmt("/plugin/%v/tally/%v", votePluginName, id)})
+		assert.True(t, resQuery.Code.IsOK(), resQuery.Log)
+		err := wire.ReadBinaryBytes(resQuery.Value, &tally)
+		assert.Nil(t, err)
+		return tally
 	}
-
-	//Test equal fees
-	CSW(2, 2)
-	if res.IsErr() {
-		Exit(Fmt("Failed: %v", res.Error()))
+	queryBalance := func(addr []byte) types.Coins {
+		resQuery := bcApp.Query(wrsp.RequestQuery{Path: cmn.Fmt("/account/%X", addr)})
+		assert.True(t, resQuery.Code.IsOK(), resQuery.Log)
+		acc, err := sm.ReadAccount(resQuery.Value)
+		assert.Nil(t, err)
+		assert.NotNil(t, acc)
+		return acc.Balance
 	}
 
-	//Test more send coins than fees
-	CSW(2, 3)
-	if res.IsErr() {
-		Exit(Fmt("Failed: %v", res.Error()))
-	}
+	// The deposit must be provided
+	res := DeliverVoteTx(0, types.Coins{{"", 5}}, ProposeTx{Issue: "humanRights"})
+	assert.Equal(t, wrsp.CodeType_BaseInsufficientFunds, res.Code, res.Log)
+	res = DeliverVoteTx(0, types.Coins{{"", 15}}, ProposeTx{Issue: "humanRights"})
+	assert.True(t, res.IsOK(), res.Log)
+	var id uint64
+	assert.Nil(t, wire.ReadBinaryBytes(res.Data, &id))
+	bcApp.Commit()
+	assert.Equal(t, types.Coins{{"", 990}, {"gold", 100}}, queryBalance(privAccs[0].Account.PubKey.Address()))
+
+	// A second issue is voted on separately
+	res = DeliverVoteTx(1, types.Coins{{"", 10}}, ProposeTx{Issue: "animalRights"})
+	assert.True(t, res.IsOK(), res.Log)
+	var id2 uint64
+	assert.Nil(t, wire.ReadBinaryBytes(res.Data, &id2))
+	assert.NotEqual(t, id, id2)
+	bcApp.Commit()
+	assert.Equal(t, types.Coins{{"", 20}}, queryBalance(types.ModuleAddress(votePluginName)))
+
+	// Votes are weighted by the voter's gold, once per address,
+	// and the coins sent are returned
+	res = DeliverVoteTx(2, types.Coins{{"", 1}}, BallotTx{ProposalID: id, Yes: true})
+	assert.Equal(t, VoteCodeNoWeight, res.Code, res.Log)
+	res = DeliverVoteTx(0, types.Coins{{"", 1}}, BallotTx{ProposalID: id, Yes: true})
+	assert.True(t, res.IsOK(), res.Log)
+	res = DeliverVoteTx(0, types.Coins{{"", 1}}, BallotTx{ProposalID: id, Yes: false})
+	assert.Equal(t, VoteCodeAlreadyVoted, res.Code, res.Log)
+	res = DeliverVoteTx(1, types.Coins{{"", 1}, {"gold", 20}}, BallotTx{ProposalID: id, Yes: false})
+	assert.True(t, res.IsOK(), res.Log)
+	res = DeliverVoteTx(0, types.Coins{{"", 1}}, BallotTx{ProposalID: 7, Yes: true})
+	assert.Equal(t, VoteCodeUnknownProposal, res.Code, res.Log)
+	bcApp.Commit()
+	assert.Equal(t, Tally{Yes: 100, No: 30}, queryTally(id))
+	assert.Equal(t, types.Coins{{"", 990}, {"gold", 30}}, queryBalance(privAccs[1].Account.PubKey.Address()))
+
+	// The same gold can vote on another proposal
+	res = DeliverVoteTx(1, types.Coins{{"", 1}}, BallotTx{ProposalID: id2, Yes: false})
+	assert.True(t, res.IsOK(), res.Log)
+
+	// Gold moved to another address votes again, but the final tally
+	// counts each ballot up to the voter's balance, so only once
+	res = DeliverSendTx(0, 2, types.Coins{{"gold", 60}})
+	assert.True(t, res.IsOK(), res.Log)
+	res = DeliverVoteTx(2, types.Coins{{"", 1}}, BallotTx{ProposalID: id, Yes: true})
+	assert.True(t, res.IsOK(), res.Log)
+	bcApp.Commit()
+	assert.Equal(t, Tally{Yes: 160, No: 30}, queryTally(id))
+
+	// Voting is open through EndHeight
+	bcApp.BeginBlock(3)
+	bcApp.Commit()
+	assert.False(t, queryTally(id).Final)
+	bcApp.BeginBlock(4)
+	bcApp.Commit()
+	assert.Equal(t, Tally{Yes: 100, No: 30, Final: true, Passed: true}, queryTally(id))
+	assert.Equal(t, Tally{No: 30, Final: true, Passed: false}, queryTally(id2))
+	res = DeliverVoteTx(0, types.Coins{{"", 1}}, BallotTx{ProposalID: id2, Yes: true})
+	assert.Equal(t, VoteCodeVotingClosed, res.Code, res.Log)
+
+	// The passed proposal's deposit is returned,
+	// the other's deposit goes to the fee pool
+	assert.True(t, queryBalance(types.ModuleAddress(votePluginName)).IsZero())
+	assert.Equal(t, types.Coins{{"", 1000}, {"gold", 40}}, queryBalance(privAccs[0].Account.PubKey.Address()))
+	assert.Equal(t, types.Coins{{"", 990}, {"gold", 30}}, queryBalance(privAccs[1].Account.PubKey.Address()))
 }
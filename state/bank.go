@@ -0,0 +1,106 @@
+package state
+
+import (
+	wrsp "github.com/tepleton/wrsp/types"
+	"github.com/tepleton/basecoin/types"
+	. "github.com/tepleton/go-common"
+	"github.com/tepleton/go-events"
+)
+
+// The types.Bank over the accounts in store, for the named plugin.
+// It fires no events, see NewTxBank.
+func NewBank(store types.KVStore, pluginName string) types.Bank {
+	return NewTxBank(store, pluginName, nil, nil, nil)
+}
+
+// Like NewBank, holding coins, the coins tx sends to the plugin, as handed
+// to plugins in their CallContext. Each account it credits or debits
+// fires EventStringAccOutput or EventStringAccInput with tx to evc,
+// which may be nil. tx is nil outside of a tx, as in BeginBlock.
+func NewTxBank(store types.KVStore, pluginName string, coins types.Coins, tx types.Tx, evc events.Fireable) types.Bank {
+	sb := storeBank{store, types.ModuleAddress(pluginName), tx, evc}
+	return types.NewTxBank(sb, sb.addCoins, coins)
+}
+
+// Every credit and debit of a Bank goes through addCoins and subCoins,
+// which fire its account events.
+type storeBank struct {
+	store  types.KVStore
+	module []byte
+	tx     types.Tx
+	evc    events.Fireable
+}
+
+func (sb storeBank) GetBalance(addr []byte) types.Coins {
+	acc := GetAccount(sb.store, addr)
+	if acc == nil {
+		return nil
+	}
+	return acc.Balance
+}
+
+func (sb storeBank) addCoins(addr []byte, coins types.Coins) {
+	addCoins(sb.store, addr, coins)
+	if sb.evc != nil {
+		sb.evc.FireEvent(types.EventStringAccOutput(addr), types.EventDataTx{sb.tx, nil, ""})
+	}
+}
+
+func (sb storeBank) subCoins(acc *types.Account, addr []byte, coins types.Coins) {
+	acc.Balance = acc.Balance.Minus(coins)
+	SetAccount(sb.store, addr, acc)
+	if sb.evc != nil {
+		sb.evc.FireEvent(types.EventStringAccInput(addr), types.EventDataTx{sb.tx, nil, ""})
+	}
+}
+
+func (sb storeBank) PayFromModule(addr []byte, coins types.Coins) wrsp.Result {
+	if len(addr) == 0 {
+		return wrsp.ErrBaseInvalidInput.AppendLog("Paying to an empty address")
+	}
+	if !coins.IsValid() || !coins.IsNonnegative() {
+		return wrsp.ErrBaseInvalidInput.AppendLog(Fmt("Invalid coins %v", coins))
+	}
+	if coins.IsZero() {
+		return wrsp.OK
+	}
+	acc := GetAccount(sb.store, sb.module)
+	if acc == nil || !acc.Balance.IsGTE(coins) {
+		return wrsp.ErrBaseInsufficientFunds.AppendLog(Fmt("Module account %X can't cover %v", sb.module, coins))
+	}
+	sb.subCoins(acc, sb.module, coins)
+	sb.addCoins(addr, coins)
+	return wrsp.OK
+}
+
+// The store handed to plugin, one of pgz, over the app's store.
+// See types.PluginStore.
+func NewPluginStore(store types.KVStore, pgz *types.Plugins, plugin types.Plugin) *types.PluginStore {
+	return NewPluginStoreWithEvents(store, pgz, plugin, nil, nil)
+}
+
+// Like NewPluginStore, whose Bank, and Host.Mint with it, fires the
+// account events of tx to evc, see NewTxBank.
+func NewPluginStoreWithEvents(store types.KVStore, pgz *types.Plugins, plugin types.Plugin, tx types.Tx, evc events.Fireable) *types.PluginStore {
+	var views []string
+	if viewer, ok := plugin.(types.Viewer); ok {
+		views = viewer.Views()
+	}
+	newBank := func(store types.KVStore, pluginName string) types.Bank {
+		return NewTxBank(store, pluginName, nil, tx, evc)
+	}
+	return pgz.NewPluginStore(store, plugin.Name(), views, newBank)
+}
+
+// Creates the account if it doesn't exist, like a SendTx output.
+func addCoins(store types.KVStore, addr []byte, coins types.Coins) {
+	acc := GetAccount(store, addr)
+	if acc == nil {
+		acc = &types.Account{
+			PubKey:   nil,
+			Sequence: 0,
+		}
+	}
+	acc.Balance = acc.Balance.Plus(coins)
+	SetAccount(store, addr, acc)
+}
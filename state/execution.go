@@ -20,10 +20,17 @@ func ExecTx(state *State, pgz *types.Plugins, tx types.Tx, isCheckTx bool, evc e
 		if res.IsErr() {
 			return res.PrependLog("in validateInputsBasic()")
 		}
+		if tx.Gas < 0 {
+			return wrsp.ErrBaseInvalidInput.AppendLog("Gas cannot be negative")
+		}
 		res = validateOutputsBasic(tx.Outputs)
 		if res.IsErr() {
 			return res.PrependLog("in validateOutputsBasic()")
 		}
+		res = validateFee(state, tx.Fee, tx.Gas)
+		if res.IsErr() {
+			return res.PrependLog("in validateFee()")
+		}
 
 		// Get inputs
 		accounts, res := getInputs(state, tx.Inputs)
@@ -48,25 +55,32 @@ func ExecTx(state *State, pgz *types.Plugins, tx types.Tx, isCheckTx bool, evc e
 			return wrsp.ErrBaseInvalidOutput.AppendLog("Input total != output total + fees")
 		}
 
-		// TODO: Fee validation for SendTx
+		// Charge gas for the accounts read and written
+		gasConfig := GetGasConfig(state)
+		gasUsed := sendTxGas(gasConfig, tx)
+		if gasUsed > tx.Gas {
+			return types.ErrOutOfGas.AppendLog(Fmt("SendTx requires %v gas, got %v", gasUsed, tx.Gas))
+		}
 
 		// Good! Adjust accounts
 		adjustByInputs(state, accounts, tx.Inputs)
 		adjustByOutputs(state, accounts, tx.Outputs, isCheckTx)
+		if !isCheckTx {
+			collectFee(state, tx.Fee)
+		}
 
-		/*
-			// Fire events
-			if !isCheckTx {
-				if evc != nil {
-					for _, i := range tx.Inputs {
-						evc.FireEvent(types.EventStringAccInput(i.Address), types.EventDataTx{tx, nil, ""})
-					}
-					for _, o := range tx.Outputs {
-						evc.FireEvent(types.EventStringAccOutput(o.Address), types.EventDataTx{tx, nil, ""})
-					}
+		// Fire events
+		if !isCheckTx {
+			if evc != nil {
+				for _, i := range tx.Inputs {
+					evc.FireEvent(types.EventStringAccInput(i.Address), types.EventDataTx{tx, nil, ""})
+				}
+				for _, o := range tx.Outputs {
+					evc.FireEvent(types.EventStringAccOutput(o.Address), types.EventDataTx{tx, nil, ""})
 				}
+				evc.FireEvent(types.EventStringTx(), types.EventDataTx{tx, nil, ""})
 			}
-		*/
+		}
 
 		return wrsp.OK
 
@@ -76,6 +90,13 @@ func ExecTx(state *State, pgz *types.Plugins, tx types.Tx, isCheckTx bool, evc e
 		if res.IsErr() {
 			return res
 		}
+		if tx.Gas < 0 {
+			return wrsp.ErrBaseInvalidInput.AppendLog("Gas cannot be negative")
+		}
+		res = validateFee(state, tx.Fee, tx.Gas)
+		if res.IsErr() {
+			return res.PrependLog("in validateFee()")
+		}
 
 		// Get input account
 		inAcc := state.GetAccount(tx.Input.Address)
@@ -119,33 +140,55 @@ func ExecTx(state *State, pgz *types.Plugins, tx types.Tx, isCheckTx bool, evc e
 		// Create inAcc checkpoint
 		inAccCopy := inAcc.Copy()
 
+		// The fee is collected whether or not the plugin succeeds
+		collectFee(state, tx.Fee)
+
 		// Run the tx.
+		// The plugin's store access is charged against tx.Gas,
+		// and it only sees its own keys.
 		cache := state.CacheWrap()
 		cache.SetAccount(tx.Input.Address, inAcc)
-		ctx := types.NewCallContext(tx.Input.Address, inAcc, coins)
-		res = plugin.RunTx(cache, ctx, tx.Data)
+		gasMeter := types.NewGasMeter(tx.Gas)
+		gasStore := types.NewGasKVStore(cache, gasMeter, GetGasConfig(state))
+		// Plugin events, and the account events of its Bank,
+		// are held back until we know the tx succeeded.
+		var evCache *events.EventCache
+		var bankEvc, pluginEvc events.Fireable
+		if evc != nil {
+			evCache = events.NewEventCache(evc)
+			bankEvc = evCache
+			pluginEvc = types.NewPluginFireable(tx.Name, evCache)
+		}
+		pluginStore := NewPluginStoreWithEvents(gasStore, pgz, plugin, tx, bankEvc)
+		// The coins go into the plugin's Bank, which pays them out.
+		bank := NewTxBank(gasStore, tx.Name, coins, tx, bankEvc)
+		ctx := types.NewCallContext(chainID, tx.Input.Address, inAcc, gasMeter, pluginEvc, bank)
+		res = runPlugin(plugin, pluginStore, ctx, tx.Data)
 		if res.IsOK() {
 			cache.CacheSync()
 			log.Info("Successful execution")
-			// Fire events
-			/*
-				if evc != nil {
-					exception := ""
-					if res.IsErr() {
-						exception = res.Error()
-					}
-					evc.FireEvent(types.EventStringAccInput(tx.Input.Address), types.EventDataTx{tx, ret, exception})
-					evc.FireEvent(types.EventStringAccOutput(tx.Address), types.EventDataTx{tx, ret, exception})
-				}
-			*/
+			if evCache != nil {
+				evCache.Flush()
+			}
 		} else {
-			log.Info("AppTx failed", "error", res)
-			// Just return the coins and return.
+			log.Info("AppTx failed", "error", res, "gasUsed", gasMeter.GasConsumed())
+			// Discard the cache and return the coins.
+			// The fee is still taken.
 			inAccCopy.Balance = inAccCopy.Balance.Plus(coins)
-			// But take the gas
-			// TODO
 			state.SetAccount(tx.Input.Address, inAccCopy)
 		}
+
+		// Fire events
+		if evc != nil {
+			exception := ""
+			if res.IsErr() {
+				exception = res.Error()
+			}
+			evData := types.EventDataTx{tx, res.Data, exception}
+			evc.FireEvent(types.EventStringAccInput(tx.Input.Address), evData)
+			evc.FireEvent(types.EventStringAppTx(tx.Name), evData)
+			evc.FireEvent(types.EventStringTx(), evData)
+		}
 		return res
 
 	default:
@@ -155,6 +198,83 @@ func ExecTx(state *State, pgz *types.Plugins, tx types.Tx, isCheckTx bool, evc e
 
 //--------------------------------------------------------------------------------
 
+// Runs the plugin, turning an out-of-gas panic into an error result.
+// Any other panic is re-raised.
+func runPlugin(plugin types.Plugin, store types.KVStore, ctx types.CallContext, txBytes []byte) (res wrsp.Result) {
+	defer func() {
+		if r := recover(); r != nil {
+			oog, ok := r.(types.ErrorOutOfGas)
+			if !ok {
+				panic(r)
+			}
+			res = types.ErrOutOfGas.AppendLog(Fmt("%v (limit %v)", oog.Error(), ctx.GasMeter.Limit()))
+		}
+	}()
+	return plugin.RunTx(store, ctx, txBytes)
+}
+
+// The fee must meet the minimum for its denomination,
+// and pay at least the minimum gas price for the gas.
+func validateFee(state types.KVStore, fee types.Coin, gas int64) (res wrsp.Result) {
+	if fee.Amount < 0 {
+		return wrsp.ErrBaseInvalidInput.AppendLog("Fee cannot be negative")
+	}
+	minFees := GetMinFees(state)
+	if !minFees.IsZero() {
+		minFee, ok := coinOfDenom(minFees, fee.Denom)
+		if !ok {
+			return types.ErrInsufficientFees.AppendLog(Fmt("Fee denomination %v is not accepted", fee.Denom))
+		}
+		if fee.Amount < minFee.Amount {
+			return types.ErrInsufficientFees.AppendLog(Fmt("Got %v, minimum is %v", fee, minFee))
+		}
+	}
+	minGasPrices := GetMinGasPrices(state)
+	if !minGasPrices.IsZero() {
+		minGasPrice, ok := coinOfDenom(minGasPrices, fee.Denom)
+		if !ok {
+			return types.ErrInsufficientGasPrice.AppendLog(Fmt("Gas price denomination %v is not accepted", fee.Denom))
+		}
+		// Divided, since gas*minGasPrice.Amount can overflow
+		if minGasPrice.Amount > 0 && fee.Amount/minGasPrice.Amount < gas {
+			return types.ErrInsufficientGasPrice.AppendLog(Fmt("Fee %v does not pay for %v gas at %v per gas", fee, gas, minGasPrice))
+		}
+	}
+	return wrsp.OK
+}
+
+func coinOfDenom(coins types.Coins, denom string) (types.Coin, bool) {
+	for _, coin := range coins {
+		if coin.Denom == denom {
+			return coin, true
+		}
+	}
+	return types.Coin{}, false
+}
+
+// Credit the fee to the fee pool account.
+func collectFee(state *State, fee types.Coin) {
+	if fee.Amount == 0 {
+		return
+	}
+	poolAddr := FeePoolAddress()
+	poolAcc := state.GetAccount(poolAddr)
+	if poolAcc == nil {
+		poolAcc = &types.Account{
+			PubKey:   nil,
+			Sequence: 0,
+		}
+	}
+	poolAcc.Balance = poolAcc.Balance.Plus(types.Coins{fee})
+	state.SetAccount(poolAddr, poolAcc)
+}
+
+// A SendTx reads and writes every input and output account once.
+func sendTxGas(config types.GasConfig, tx *types.SendTx) int64 {
+	perAccount := config.GetCost + config.SetCost
+	return perAccount * int64(len(tx.Inputs)+len(tx.Outputs))
+}
+
 // The accounts from the TxInputs must either already have
 // crypto.PubKey.(type) != nil, (it must be known),
 // or it must be specified in the TxInput.
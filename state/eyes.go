@@ -0,0 +1,208 @@
+package state
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/tepleton/basecoin/types"
+	. "github.com/tepleton/go-common"
+	"github.com/tepleton/go-wire"
+	eyes "github.com/tepleton/merkleeyes/client"
+	wrsp "github.com/tepleton/wrsp/types"
+)
+
+// EyesStore adapts a MerkleEyes client to types.KVStore.
+//
+// Iteration walks the tree by index with the /key, /index and /size
+// queries, so it only sees the last committed tree.
+// State overlays its uncommitted writes, see State.Iterator.
+type EyesStore struct {
+	*eyes.Client
+	keepErr bool // Keep the first failed query in err, instead of panicking
+	err     error
+}
+
+func NewEyesStore(eyesCli *eyes.Client) *EyesStore {
+	return &EyesStore{eyesCli}
+}
+
+func (es *EyesStore) Delete(key []byte) {
+	es.Rem(key)
+}
+
+func (es *EyesStore) Iterator(start, end []byte) types.Iterator {
+	if isEmptyDomain(start, end) {
+		return newEyesIterator(es, -1, start, end, true)
+	}
+	index := int64(0)
+	if start != nil {
+		index = es.indexOf(start)
+	}
+	return newEyesIterator(es, index, start, end, true)
+}
+
+func (es *EyesStore) ReverseIterator(start, end []byte) types.Iterator {
+	if isEmptyDomain(start, end) {
+		return newEyesIterator(es, -1, start, end, false)
+	}
+	var index int64
+	if end != nil {
+		index = es.indexOf(end) - 1
+	} else {
+		index = es.size() - 1
+	}
+	return newEyesIterator(es, index, start, end, false)
+}
+
+// A read-only EyesStore of the last committed tree, for queries, whose
+// proofs are of it. Writes panic, so wrap it in a KVCache to hand it to
+// code that may write.
+//
+// A failed read finds nothing, so that a query can't crash the app.
+// Check Err once done reading.
+func NewCommittedStore(eyesCli *eyes.Client) *CommittedStore {
+	return &CommittedStore{&EyesStore{Client: eyesCli, keepErr: true}}
+}
+
+type CommittedStore struct {
+	*EyesStore
+}
+
+// Reads with the /key query, like the iterators.
+func (cs *CommittedStore) Get(key []byte) []byte {
+	return cs.query("/key", key).Value
+}
+
+func (cs *CommittedStore) Set(key []byte, value []byte) {
+	PanicSanity("Set on the committed store")
+}
+
+func (cs *CommittedStore) Delete(key []byte) {
+	PanicSanity("Delete on the committed store")
+}
+
+// The first read that failed, if any.
+func (cs *CommittedStore) Err() error {
+	return cs.err
+}
+
+// Returns the index of key, or the index it would have if it existed.
+func (es *EyesStore) indexOf(key []byte) int64 {
+	resQuery := es.query("/key", key)
+	return resQuery.Index
+}
+
+func (es *EyesStore) size() int64 {
+	resQuery := es.query("/size", nil)
+	var size int
+	err := wire.ReadBinaryBytes(resQuery.Value, &size)
+	if err != nil {
+		es.fail(Fmt("Error reading MerkleEyes size %X: %v", resQuery.Value, err))
+		return 0
+	}
+	return int64(size)
+}
+
+// Returns a nil key if index is out of range.
+func (es *EyesStore) getByIndex(index int64) (key []byte, value []byte) {
+	if index < 0 {
+		return nil, nil
+	}
+	resQuery := es.query("/index", wire.BinaryBytes(index))
+	return resQuery.Key, resQuery.Value
+}
+
+func (es *EyesStore) query(path string, data []byte) wrsp.ResponseQuery {
+	resQuery, err := es.QuerySync(wrsp.RequestQuery{
+		Path: path,
+		Data: data,
+	})
+	if err != nil {
+		es.fail(Fmt("Error querying MerkleEyes %v: %v", path, err))
+		return wrsp.ResponseQuery{}
+	}
+	if resQuery.Code.IsErr() {
+		es.fail(Fmt("Error querying MerkleEyes %v: %v", path, resQuery.Log))
+		return wrsp.ResponseQuery{}
+	}
+	return resQuery
+}
+
+func (es *EyesStore) fail(msg string) {
+	if !es.keepErr {
+		PanicSanity(msg)
+	}
+	if es.err == nil {
+		es.err = errors.New(msg)
+	}
+}
+
+//----------------------------------------
+
+type eyesIterator struct {
+	store      *EyesStore
+	index      int64
+	start, end []byte
+	ascending  bool
+	key, value []byte
+}
+
+func newEyesIterator(store *EyesStore, index int64, start, end []byte, ascending bool) *eyesIterator {
+	ei := &eyesIterator{
+		store:     store,
+		index:     index,
+		start:     start,
+		end:       end,
+		ascending: ascending,
+	}
+	ei.load()
+	return ei
+}
+
+// Loads the key at ei.index, or invalidates the iterator
+// if it is past the domain.
+func (ei *eyesIterator) load() {
+	ei.key, ei.value = ei.store.getByIndex(ei.index)
+	if ei.key == nil || !types.IsKeyInDomain(ei.key, ei.start, ei.end) {
+		ei.key, ei.value = nil, nil
+	}
+}
+
+func (ei *eyesIterator) Valid() bool {
+	return ei.key != nil
+}
+
+func (ei *eyesIterator) Next() {
+	if !ei.Valid() {
+		panic("Next() called on invalid iterator")
+	}
+	if ei.ascending {
+		ei.index++
+	} else {
+		ei.index--
+	}
+	ei.load()
+}
+
+func (ei *eyesIterator) Key() []byte {
+	if !ei.Valid() {
+		panic("Key() called on invalid iterator")
+	}
+	return ei.key
+}
+
+func (ei *eyesIterator) Value() []byte {
+	if !ei.Valid() {
+		panic("Value() called on invalid iterator")
+	}
+	return ei.value
+}
+
+func (ei *eyesIterator) Close() {
+	ei.key, ei.value = nil, nil
+}
+
+// Saves the queries for a domain that can't contain any keys.
+func isEmptyDomain(start, end []byte) bool {
+	return start != nil && end != nil && bytes.Compare(start, end) >= 0
+}
@@ -0,0 +1,35 @@
+package state
+
+import (
+	"github.com/tepleton/basecoin/types"
+)
+
+// Host gives a plugin what the app's other plugins can't have: the stores
+// of other plugins, for the IBC plugin to run its PacketHandlers, and
+// minting, for the IBC plugin's vouchers of other chains' coins.
+// Only the app holds its Plugins, so only it can make one, and it gives
+// it only to the plugins that need it.
+type Host struct {
+	plugins *types.Plugins
+}
+
+func NewHost(pgz *types.Plugins) Host {
+	return Host{pgz}
+}
+
+// The named plugin's store, in the same app store as store, which is the
+// PluginStore the app handed the calling plugin. It has no views.
+func (h Host) PluginStore(store types.KVStore, pluginName string) (types.KVStore, error) {
+	ps, err := h.plugins.SiblingStore(store, pluginName)
+	if err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// Creates coins in addr, in the same app store as store, which is the
+// PluginStore the app handed the calling plugin. Like its Bank's
+// credits, it fires EventStringAccOutput.
+func (h Host) Mint(store types.KVStore, addr []byte, coins types.Coins) error {
+	return h.plugins.Mint(store, addr, coins)
+}
@@ -0,0 +1,87 @@
+package state
+
+import (
+	"github.com/tepleton/basecoin/types"
+	. "github.com/tepleton/go-common"
+	"github.com/tepleton/go-wire"
+)
+
+// Chain-wide parameters live in the store so every node agrees on them.
+
+func GasConfigKey() []byte {
+	return []byte("base/p/gas")
+}
+
+// Returns the zero GasConfig if none was set.
+func GetGasConfig(store types.KVStore) (config types.GasConfig) {
+	loadParam(store, GasConfigKey(), &config)
+	return
+}
+
+func SetGasConfig(store types.KVStore, config types.GasConfig) {
+	store.Set(GasConfigKey(), wire.BinaryBytes(config))
+}
+
+func MinFeesKey() []byte {
+	return []byte("base/p/minFees")
+}
+
+func MinGasPricesKey() []byte {
+	return []byte("base/p/minGasPrices")
+}
+
+// Minimum fee per denomination.
+// If empty, any fee is accepted.
+func GetMinFees(store types.KVStore) (fees types.Coins) {
+	loadParam(store, MinFeesKey(), &fees)
+	return
+}
+
+func SetMinFees(store types.KVStore, fees types.Coins) {
+	store.Set(MinFeesKey(), wire.BinaryBytes(fees))
+}
+
+// Minimum price per unit of gas, per denomination.
+// If empty, any gas price is accepted.
+func GetMinGasPrices(store types.KVStore) (prices types.Coins) {
+	loadParam(store, MinGasPricesKey(), &prices)
+	return
+}
+
+func SetMinGasPrices(store types.KVStore, prices types.Coins) {
+	store.Set(MinGasPricesKey(), wire.BinaryBytes(prices))
+}
+
+func BlockHeightKey() []byte {
+	return []byte("base/height")
+}
+
+// The height of the last block begun, so that the committed state
+// says which block it is from. 0 before the first block.
+func GetBlockHeight(store types.KVStore) (height uint64) {
+	loadParam(store, BlockHeightKey(), &height)
+	return
+}
+
+func SetBlockHeight(store types.KVStore, height uint64) {
+	store.Set(BlockHeightKey(), wire.BinaryBytes(height))
+}
+
+func loadParam(store types.KVStore, key []byte, ptr interface{}) {
+	data := store.Get(key)
+	if len(data) == 0 {
+		return
+	}
+	err := wire.ReadBinaryBytes(data, ptr)
+	if err != nil {
+		panic(Fmt("Error reading param %v %X error: %v",
+			string(key), data, err.Error()))
+	}
+}
+
+//----------------------------------------
+
+// Fees are collected into an account that nobody holds the key for.
+func FeePoolAddress() []byte {
+	return wire.BinaryRipemd160("base/feePool")
+}
@@ -1,11 +1,11 @@
 package state
 
 import (
+	"bytes"
+
 	wrsp "github.com/tepleton/wrsp/types"
 	"github.com/tepleton/basecoin/types"
 	. "github.com/tepleton/go-common"
-	"github.com/tepleton/go-wire"
-	eyes "github.com/tepleton/merkleeyes/client"
 )
 
 // CONTRACT: State should be quick to copy.
@@ -54,6 +54,31 @@ func (s *State) Set(key []byte, value []byte) {
 	s.store.Set(key, value)
 }
 
+// A nil entry in the readCache marks the key as deleted.
+func (s *State) Delete(key []byte) {
+	if s.readCache != nil {
+		s.readCache[string(key)] = nil
+	}
+	s.store.Delete(key)
+}
+
+// The readCache holds every write since the last Commit,
+// so it is merged over the store in case the store only
+// iterates over committed data, like EyesStore.
+func (s *State) Iterator(start, end []byte) types.Iterator {
+	if s.readCache == nil {
+		return s.store.Iterator(start, end)
+	}
+	return types.NewMergedIterator(s.store.Iterator(start, end), s.readCache, start, end, true)
+}
+
+func (s *State) ReverseIterator(start, end []byte) types.Iterator {
+	if s.readCache == nil {
+		return s.store.ReverseIterator(start, end)
+	}
+	return types.NewMergedIterator(s.store.ReverseIterator(start, end), s.readCache, start, end, false)
+}
+
 func (s *State) GetAccount(addr []byte) *types.Account {
 	return GetAccount(s, addr)
 }
@@ -62,6 +87,9 @@ func (s *State) SetAccount(addr []byte, acc *types.Account) {
 	SetAccount(s, addr, acc)
 }
 
+// Returns a State whose writes are held until CacheSync,
+// or dropped by CacheDiscard.
+// A cache-wrapped State can itself be wrapped.
 func (s *State) CacheWrap() *State {
 	cache := types.NewKVCache(s)
 	return &State{
@@ -72,14 +100,28 @@ func (s *State) CacheWrap() *State {
 	}
 }
 
+// Writes the cached sets and deletes to the wrapped State.
+// The cache is empty afterwards and may be reused.
 // NOTE: errors if s is not from CacheWrap()
 func (s *State) CacheSync() {
+	if s.writeCache == nil {
+		PanicSanity("CacheSync() called on a State that is not from CacheWrap()")
+	}
 	s.writeCache.Sync()
 }
 
+// Drops the cached sets and deletes.
+// NOTE: errors if s is not from CacheWrap()
+func (s *State) CacheDiscard() {
+	if s.writeCache == nil {
+		PanicSanity("CacheDiscard() called on a State that is not from CacheWrap()")
+	}
+	s.writeCache.Reset()
+}
+
 func (s *State) Commit() wrsp.Result {
 	s.readCache = make(map[string][]byte)
-	return s.store.(*eyes.Client).CommitSync()
+	return s.store.(*EyesStore).CommitSync()
 }
 
 //----------------------------------------
@@ -88,13 +130,22 @@ func AccountKey(addr []byte) []byte {
 	return append([]byte("base/a/"), addr...)
 }
 
+// Accounts are stored in a versioned encoding, see types.VersionedBytes.
+// Version 1 is the go-wire Account, which is byte for byte the encoding
+// of a non-nil *Account from before accounts were versioned.
+// Changing Account takes a new version and a "base" types.Migration
+// that rewrites the accounts to it.
+const AccountVersion = 1
+
+// A nil account is stored as go-wire's nil pointer, as before versioning.
+var nilAccountBytes = []byte{0x00}
+
 func GetAccount(store types.KVStore, addr []byte) *types.Account {
 	data := store.Get(AccountKey(addr))
 	if len(data) == 0 {
 		return nil
 	}
-	var acc *types.Account
-	err := wire.ReadBinaryBytes(data, &acc)
+	acc, err := ReadAccount(data)
 	if err != nil {
 		panic(Fmt("Error reading account %X error: %v",
 			data, err.Error()))
@@ -103,6 +154,24 @@ func GetAccount(store types.KVStore, addr []byte) *types.Account {
 }
 
 func SetAccount(store types.KVStore, addr []byte, acc *types.Account) {
-	accBytes := wire.BinaryBytes(acc)
-	store.Set(AccountKey(addr), accBytes)
+	store.Set(AccountKey(addr), AccountBytes(acc))
+}
+
+func AccountBytes(acc *types.Account) []byte {
+	if acc == nil {
+		return nilAccountBytes
+	}
+	return types.VersionedBytes(AccountVersion, *acc)
+}
+
+func ReadAccount(data []byte) (*types.Account, error) {
+	if bytes.Equal(data, nilAccountBytes) {
+		return nil, nil
+	}
+	acc := new(types.Account)
+	err := types.ReadVersionedBytes(data, AccountVersion, acc)
+	if err != nil {
+		return nil, err
+	}
+	return acc, nil
 }
@@ -4,6 +4,10 @@ import (
 	wrsp "github.com/tepleton/wrsp/types"
 )
 
+const (
+	CodeTypeOutOfGas = wrsp.CodeType(1101)
+)
+
 var (
 	ErrInternalError        = wrsp.NewError(wrsp.CodeType_InternalError, "Internal error")
 	ErrDuplicateAddress     = wrsp.NewError(wrsp.CodeType_BaseDuplicateAddress, "Error duplicate address")
@@ -16,6 +20,7 @@ var (
 	ErrInvalidPubKey        = wrsp.NewError(wrsp.CodeType_BaseInvalidPubKey, "Error invalid pubkey")
 	ErrInvalidSequence      = wrsp.NewError(wrsp.CodeType_BaseInvalidSequence, "Error invalid sequence")
 	ErrInvalidSignature     = wrsp.NewError(wrsp.CodeType_BaseInvalidSignature, "Error invalid signature")
+	ErrOutOfGas             = wrsp.NewError(CodeTypeOutOfGas, "Error out of gas")
 	ErrUnknownPubKey        = wrsp.NewError(wrsp.CodeType_BaseUnknownPubKey, "Error unknown pubkey")
 
 	ResultOK = wrsp.NewResultOK(nil, "")
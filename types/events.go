@@ -0,0 +1,56 @@
+package types
+
+import (
+	. "github.com/tepleton/go-common"
+	"github.com/tepleton/go-events"
+)
+
+// Functions to generate eventId strings
+
+func EventStringAccInput(addr []byte) string  { return Fmt("Acc/%X/Input", addr) }
+func EventStringAccOutput(addr []byte) string { return Fmt("Acc/%X/Output", addr) }
+func EventStringAppTx(name string) string     { return Fmt("App/%v/Result", name) }
+func EventStringPlugin(name, event string) string {
+	return Fmt("Plugin/%v/%v", name, event)
+}
+
+func EventStringTx() string         { return "Tx" }
+func EventStringBeginBlock() string { return "BeginBlock" }
+func EventStringEndBlock() string   { return "EndBlock" }
+
+//----------------------------------------
+
+// Fired for account inputs and outputs, AppTx results, and EventStringTx.
+// Exception is the error log if the AppTx failed.
+// Tx is nil for the inputs and outputs of a plugin's BeginBlock or EndBlock.
+type EventDataTx struct {
+	Tx        Tx     `json:"tx"`
+	Result    []byte `json:"result"`
+	Exception string `json:"exception"`
+}
+
+type EventDataBlock struct {
+	Height uint64 `json:"height"`
+}
+
+type EventDataPlugin struct {
+	Name string           `json:"name"`
+	Data events.EventData `json:"data"`
+}
+
+//----------------------------------------
+
+// Namespaces the events fired by a plugin under EventStringPlugin,
+// so a plugin cannot impersonate account or block events.
+type pluginFireable struct {
+	name string
+	evc  events.Fireable
+}
+
+func NewPluginFireable(name string, evc events.Fireable) events.Fireable {
+	return pluginFireable{name, evc}
+}
+
+func (pf pluginFireable) FireEvent(event string, data events.EventData) {
+	pf.evc.FireEvent(EventStringPlugin(pf.name, event), EventDataPlugin{pf.name, data})
+}
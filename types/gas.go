@@ -0,0 +1,161 @@
+package types
+
+import (
+	"math"
+
+	. "github.com/tepleton/go-common"
+)
+
+// GasConfig holds the gas costs charged for plugin access to the store.
+// The zero value charges nothing.
+type GasConfig struct {
+	GetCost          int64 `json:"get_cost"`            // Flat cost of a Get
+	SetCost          int64 `json:"set_cost"`            // Flat cost of a Set
+	ReadCostPerByte  int64 `json:"read_cost_per_byte"`  // Per byte of key and value read
+	WriteCostPerByte int64 `json:"write_cost_per_byte"` // Per byte of key and value written
+}
+
+//----------------------------------------
+
+// ErrorOutOfGas is panicked by GasMeter.ConsumeGas when the limit is exceeded.
+// ExecTx recovers it and reverts the plugin's writes.
+type ErrorOutOfGas struct {
+	Descriptor string
+}
+
+func (e ErrorOutOfGas) Error() string {
+	return Fmt("Out of gas in %v", e.Descriptor)
+}
+
+type GasMeter struct {
+	limit    int64
+	consumed int64
+}
+
+func NewGasMeter(limit int64) *GasMeter {
+	return &GasMeter{
+		limit:    limit,
+		consumed: 0,
+	}
+}
+
+func (g *GasMeter) Limit() int64 {
+	return g.limit
+}
+
+func (g *GasMeter) GasConsumed() int64 {
+	return g.consumed
+}
+
+func (g *GasMeter) GasRemaining() int64 {
+	return g.limit - g.consumed
+}
+
+// Panics with ErrorOutOfGas if consuming amount exceeds the limit,
+// having consumed all of it.
+func (g *GasMeter) ConsumeGas(amount int64, descriptor string) {
+	if amount < 0 {
+		PanicSanity(Fmt("Cannot consume negative gas %v for %v", amount, descriptor))
+	}
+	if amount > g.limit-g.consumed {
+		g.consumed = g.limit
+		panic(ErrorOutOfGas{descriptor})
+	}
+	g.consumed += amount
+}
+
+// The cost of n bytes at costPerByte, or math.MaxInt64 if that overflows,
+// which no limit covers.
+func bytesCost(costPerByte int64, n int) int64 {
+	if n > 0 && costPerByte > math.MaxInt64/int64(n) {
+		return math.MaxInt64
+	}
+	return costPerByte * int64(n)
+}
+
+//----------------------------------------
+
+// A KVStore that charges a GasMeter for every access.
+type GasKVStore struct {
+	store    KVStore
+	gasMeter *GasMeter
+	config   GasConfig
+}
+
+func NewGasKVStore(store KVStore, gasMeter *GasMeter, config GasConfig) *GasKVStore {
+	return &GasKVStore{
+		store:    store,
+		gasMeter: gasMeter,
+		config:   config,
+	}
+}
+
+func (gkv *GasKVStore) Set(key []byte, value []byte) {
+	gkv.gasMeter.ConsumeGas(gkv.config.SetCost, "Set")
+	gkv.gasMeter.ConsumeGas(bytesCost(gkv.config.WriteCostPerByte, len(key)+len(value)), "Set bytes")
+	gkv.store.Set(key, value)
+}
+
+func (gkv *GasKVStore) Get(key []byte) (value []byte) {
+	gkv.gasMeter.ConsumeGas(gkv.config.GetCost, "Get")
+	value = gkv.store.Get(key)
+	gkv.gasMeter.ConsumeGas(bytesCost(gkv.config.ReadCostPerByte, len(key)+len(value)), "Get bytes")
+	return value
+}
+
+// Deletes are charged like a Set of an empty value.
+func (gkv *GasKVStore) Delete(key []byte) {
+	gkv.gasMeter.ConsumeGas(gkv.config.SetCost, "Delete")
+	gkv.gasMeter.ConsumeGas(bytesCost(gkv.config.WriteCostPerByte, len(key)), "Delete bytes")
+	gkv.store.Delete(key)
+}
+
+// Each item visited is charged like a Get.
+func (gkv *GasKVStore) Iterator(start, end []byte) Iterator {
+	return newGasIterator(gkv, gkv.store.Iterator(start, end))
+}
+
+func (gkv *GasKVStore) ReverseIterator(start, end []byte) Iterator {
+	return newGasIterator(gkv, gkv.store.ReverseIterator(start, end))
+}
+
+type gasIterator struct {
+	gkv    *GasKVStore
+	parent Iterator
+}
+
+func newGasIterator(gkv *GasKVStore, parent Iterator) Iterator {
+	gi := &gasIterator{gkv, parent}
+	gi.consumeSeekGas()
+	return gi
+}
+
+func (gi *gasIterator) Valid() bool {
+	return gi.parent.Valid()
+}
+
+func (gi *gasIterator) Next() {
+	gi.parent.Next()
+	gi.consumeSeekGas()
+}
+
+func (gi *gasIterator) Key() []byte {
+	return gi.parent.Key()
+}
+
+func (gi *gasIterator) Value() []byte {
+	return gi.parent.Value()
+}
+
+func (gi *gasIterator) Close() {
+	gi.parent.Close()
+}
+
+func (gi *gasIterator) consumeSeekGas() {
+	if !gi.parent.Valid() {
+		return
+	}
+	config, gasMeter := gi.gkv.config, gi.gkv.gasMeter
+	gasMeter.ConsumeGas(config.GetCost, "Iterator")
+	gasMeter.ConsumeGas(bytesCost(config.ReadCostPerByte, len(gi.parent.Key())+len(gi.parent.Value())), "Iterator bytes")
+}
@@ -0,0 +1,91 @@
+package types
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGasKVStore(t *testing.T) {
+	config := GasConfig{
+		GetCost:          10,
+		SetCost:          20,
+		ReadCostPerByte:  1,
+		WriteCostPerByte: 2,
+	}
+	gasMeter := NewGasMeter(100)
+	store := NewGasKVStore(NewMemKVStore(), gasMeter, config)
+
+	store.Set([]byte("foo"), []byte("bar"))
+	if gasMeter.GasConsumed() != 20+2*6 {
+		t.Fatalf("Expected 32 gas for Set, got %v", gasMeter.GasConsumed())
+	}
+	if value := store.Get([]byte("foo")); string(value) != "bar" {
+		t.Fatalf("Expected bar, got %v", value)
+	}
+	if gasMeter.GasConsumed() != 32+10+6 {
+		t.Fatalf("Expected 48 gas after Get, got %v", gasMeter.GasConsumed())
+	}
+
+	defer func() {
+		r := recover()
+		if _, ok := r.(ErrorOutOfGas); !ok {
+			t.Fatalf("Expected ErrorOutOfGas panic, got %v", r)
+		}
+	}()
+	store.Set([]byte("foo"), []byte("a value that costs too much gas"))
+	t.Fatal("Expected Set to run out of gas")
+}
+
+func TestGasMeterOverflow(t *testing.T) {
+	gasMeter := NewGasMeter(math.MaxInt64)
+	gasMeter.ConsumeGas(10, "first")
+	defer func() {
+		r := recover()
+		if _, ok := r.(ErrorOutOfGas); !ok {
+			t.Fatalf("Expected ErrorOutOfGas panic, got %v", r)
+		}
+		if gasMeter.GasConsumed() != math.MaxInt64 {
+			t.Fatalf("Expected all of the gas consumed, got %v", gasMeter.GasConsumed())
+		}
+	}()
+	gasMeter.ConsumeGas(math.MaxInt64, "overflow")
+	t.Fatal("Expected the gas to run out, not to wrap around")
+}
+
+func TestGasKVStoreBytesOverflow(t *testing.T) {
+	gasMeter := NewGasMeter(math.MaxInt64)
+	store := NewGasKVStore(NewMemKVStore(), gasMeter, GasConfig{WriteCostPerByte: math.MaxInt64 / 2})
+	defer func() {
+		r := recover()
+		if _, ok := r.(ErrorOutOfGas); !ok {
+			t.Fatalf("Expected ErrorOutOfGas panic, got %v", r)
+		}
+	}()
+	store.Set([]byte("foo"), []byte("bar"))
+	t.Fatal("Expected the cost of the bytes to run out of gas, not to wrap around")
+}
+
+func TestGasKVStoreIterator(t *testing.T) {
+	config := GasConfig{GetCost: 10, ReadCostPerByte: 1}
+	store := NewMemKVStore()
+	store.Set([]byte("a"), []byte("1"))
+	store.Set([]byte("b"), []byte("2"))
+	store.Set([]byte("c"), []byte("3"))
+	gasMeter := NewGasMeter(100)
+	cache := NewKVCache(NewGasKVStore(store, gasMeter, config))
+	cache.Set([]byte("b"), []byte("two"))
+
+	// Only the keys read from the store are charged, as they're read
+	itr := cache.Iterator(nil, nil)
+	if gasMeter.GasConsumed() != 10+2 {
+		t.Fatalf("Expected 12 gas for the first key, got %v", gasMeter.GasConsumed())
+	}
+	itr.Next()
+	if string(itr.Value()) != "two" {
+		t.Fatalf("Expected the cached value, got %v", string(itr.Value()))
+	}
+	if gasMeter.GasConsumed() != 2*(10+2) {
+		t.Fatalf("Expected 24 gas for the first two keys, got %v", gasMeter.GasConsumed())
+	}
+	itr.Close()
+}
@@ -0,0 +1,242 @@
+package types
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Iterator walks a domain of keys in order.
+// The domain is [start, end), where a nil start or end is unbounded.
+// Keys with empty values are treated as absent and are skipped.
+//
+// Usage:
+//
+//	for itr := store.Iterator(start, end); itr.Valid(); itr.Next() {
+//		key, value := itr.Key(), itr.Value()
+//		...
+//	}
+type Iterator interface {
+	Valid() bool
+	Next()
+	Key() []byte
+	Value() []byte
+	Close()
+}
+
+// Returns true if key is in [start, end).
+func IsKeyInDomain(key, start, end []byte) bool {
+	if start != nil && bytes.Compare(key, start) < 0 {
+		return false
+	}
+	if end != nil && bytes.Compare(key, end) >= 0 {
+		return false
+	}
+	return true
+}
+
+// Returns the first key after all keys with the given prefix,
+// or nil if there is none (prefix is all 0xFF).
+func PrefixEndBytes(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for len(end) > 0 {
+		if end[len(end)-1] != 0xFF {
+			end[len(end)-1]++
+			return end
+		}
+		end = end[:len(end)-1]
+	}
+	return nil
+}
+
+// Iterates over all keys with the given prefix.
+func PrefixIterator(store KVReader, prefix []byte) Iterator {
+	return store.Iterator(prefix, PrefixEndBytes(prefix))
+}
+
+func ReversePrefixIterator(store KVReader, prefix []byte) Iterator {
+	return store.ReverseIterator(prefix, PrefixEndBytes(prefix))
+}
+
+//----------------------------------------
+
+type kvPair struct {
+	key   []byte
+	value []byte
+}
+
+// An Iterator over a snapshot of key/value pairs, already in order.
+type sliceIterator struct {
+	pairs []kvPair
+	index int
+}
+
+func newSliceIterator(pairs []kvPair) *sliceIterator {
+	return &sliceIterator{
+		pairs: pairs,
+		index: 0,
+	}
+}
+
+func (si *sliceIterator) Valid() bool {
+	return si.index < len(si.pairs)
+}
+
+func (si *sliceIterator) Next() {
+	if !si.Valid() {
+		panic("Next() called on invalid iterator")
+	}
+	si.index++
+}
+
+func (si *sliceIterator) Key() []byte {
+	if !si.Valid() {
+		panic("Key() called on invalid iterator")
+	}
+	return si.pairs[si.index].key
+}
+
+func (si *sliceIterator) Value() []byte {
+	if !si.Valid() {
+		panic("Value() called on invalid iterator")
+	}
+	return si.pairs[si.index].value
+}
+
+func (si *sliceIterator) Close() {
+	si.pairs = nil
+}
+
+// Filters keys to [start, end) and sorts them in iteration order.
+func sortedKeysInDomain(keys []string, start, end []byte, ascending bool) []string {
+	inDomain := []string{}
+	for _, key := range keys {
+		if IsKeyInDomain([]byte(key), start, end) {
+			inDomain = append(inDomain, key)
+		}
+	}
+	if ascending {
+		sort.Strings(inDomain)
+	} else {
+		sort.Sort(sort.Reverse(sort.StringSlice(inDomain)))
+	}
+	return inDomain
+}
+
+// Merges the writes in overlay over parent, in order.
+// parent must iterate over [start, end) in the same direction.
+// An empty value in overlay hides the parent's key.
+// The overlay is copied, but parent is only stepped as the merged
+// iterator is, so a reader pays, e.g. gas, just for the keys it reads.
+// The parent is consumed and closed.
+func NewMergedIterator(parent Iterator, overlay map[string][]byte, start, end []byte, ascending bool) Iterator {
+	keys := make([]string, 0, len(overlay))
+	for key := range overlay {
+		keys = append(keys, key)
+	}
+	pairs := []kvPair{}
+	for _, key := range sortedKeysInDomain(keys, start, end, ascending) {
+		pairs = append(pairs, kvPair{[]byte(key), overlay[key]})
+	}
+	mi := &mergedIterator{
+		parent:    parent,
+		overlay:   pairs,
+		ascending: ascending,
+	}
+	mi.settle()
+	return mi
+}
+
+// Walks parent and overlay together. The current key is from the
+// overlay if fromOverlay, and from the parent if fromParent, or both
+// if the overlay shadows the parent's key.
+type mergedIterator struct {
+	parent      Iterator
+	overlay     []kvPair
+	ascending   bool
+	fromParent  bool
+	fromOverlay bool
+}
+
+// Returns true if a comes before b in iteration order.
+func (mi *mergedIterator) before(a, b []byte) bool {
+	if mi.ascending {
+		return bytes.Compare(a, b) < 0
+	}
+	return bytes.Compare(a, b) > 0
+}
+
+// Moves to the first key at or after the current positions that isn't
+// hidden by an empty value in the overlay.
+func (mi *mergedIterator) settle() {
+	for {
+		mi.fromParent, mi.fromOverlay = false, false
+		pValid, oValid := mi.parent.Valid(), len(mi.overlay) > 0
+		switch {
+		case !pValid && !oValid:
+			return
+		case !oValid:
+			mi.fromParent = true
+			return
+		case !pValid || mi.before(mi.overlay[0].key, mi.parent.Key()):
+			mi.fromOverlay = true
+		case bytes.Equal(mi.overlay[0].key, mi.parent.Key()):
+			mi.fromParent, mi.fromOverlay = true, true
+		default:
+			mi.fromParent = true
+			return
+		}
+		if len(mi.overlay[0].value) > 0 {
+			return
+		}
+		mi.step()
+	}
+}
+
+// Steps past the current key.
+func (mi *mergedIterator) step() {
+	if mi.fromParent {
+		mi.parent.Next()
+	}
+	if mi.fromOverlay {
+		mi.overlay = mi.overlay[1:]
+	}
+}
+
+func (mi *mergedIterator) Valid() bool {
+	return mi.fromParent || mi.fromOverlay
+}
+
+func (mi *mergedIterator) Next() {
+	if !mi.Valid() {
+		panic("Next() called on invalid iterator")
+	}
+	mi.step()
+	mi.settle()
+}
+
+func (mi *mergedIterator) Key() []byte {
+	if !mi.Valid() {
+		panic("Key() called on invalid iterator")
+	}
+	if mi.fromOverlay {
+		return mi.overlay[0].key
+	}
+	return mi.parent.Key()
+}
+
+func (mi *mergedIterator) Value() []byte {
+	if !mi.Valid() {
+		panic("Value() called on invalid iterator")
+	}
+	if mi.fromOverlay {
+		return mi.overlay[0].value
+	}
+	return mi.parent.Value()
+}
+
+func (mi *mergedIterator) Close() {
+	mi.parent.Close()
+	mi.overlay = nil
+	mi.fromParent, mi.fromOverlay = false, false
+}
@@ -8,8 +8,19 @@ import (
 )
 
 type KVStore interface {
+	KVReader
 	Set(key, value []byte)
+	Delete(key []byte)
+}
+
+// The reads of a KVStore, as given by PluginStore.View.
+type KVReader interface {
 	Get(key []byte) (value []byte)
+
+	// Iterate over [start, end) in ascending or descending key order.
+	// See Iterator.
+	Iterator(start, end []byte) Iterator
+	ReverseIterator(start, end []byte) Iterator
 }
 
 //----------------------------------------
@@ -32,9 +43,37 @@ func (mkv *MemKVStore) Get(key []byte) (value []byte) {
 	return mkv.m[string(key)]
 }
 
+func (mkv *MemKVStore) Delete(key []byte) {
+	delete(mkv.m, string(key))
+}
+
+func (mkv *MemKVStore) Iterator(start, end []byte) Iterator {
+	return mkv.iterator(start, end, true)
+}
+
+func (mkv *MemKVStore) ReverseIterator(start, end []byte) Iterator {
+	return mkv.iterator(start, end, false)
+}
+
+func (mkv *MemKVStore) iterator(start, end []byte, ascending bool) Iterator {
+	keys := make([]string, 0, len(mkv.m))
+	for key := range mkv.m {
+		keys = append(keys, key)
+	}
+	pairs := []kvPair{}
+	for _, key := range sortedKeysInDomain(keys, start, end, ascending) {
+		if value := mkv.m[key]; len(value) > 0 {
+			pairs = append(pairs, kvPair{[]byte(key), value})
+		}
+	}
+	return newSliceIterator(pairs)
+}
+
 //----------------------------------------
 
 // A Cache that enforces deterministic sync order.
+// Deletes are kept as tombstones until Sync.
+// A KVCache may wrap another KVCache, and Reset discards its writes.
 type KVCache struct {
 	store    KVStore
 	cache    map[string]kvCacheValue
@@ -44,8 +83,10 @@ type KVCache struct {
 }
 
 type kvCacheValue struct {
-	v []byte        // The value of some key
-	e *list.Element // The KVCache.keys element
+	v       []byte        // The value of some key
+	e       *list.Element // The KVCache.keys element
+	dirty   bool          // Set or deleted, must be synced
+	deleted bool          // Tombstone, v is nil
 }
 
 // NOTE: If store is nil, creates a new MemKVStore
@@ -88,6 +129,25 @@ func (kvc *KVCache) Set(key []byte, value []byte) {
 		cacheValue.e = kvc.keys.PushBack(key)
 	}
 	cacheValue.v = value
+	cacheValue.dirty = true
+	cacheValue.deleted = false
+	kvc.cache[string(key)] = cacheValue
+}
+
+func (kvc *KVCache) Delete(key []byte) {
+	if kvc.logging {
+		line := fmt.Sprintf("Delete %v", LegibleBytes(key))
+		kvc.logLines = append(kvc.logLines, line)
+	}
+	cacheValue, ok := kvc.cache[string(key)]
+	if ok {
+		kvc.keys.MoveToBack(cacheValue.e)
+	} else {
+		cacheValue.e = kvc.keys.PushBack(key)
+	}
+	cacheValue.v = nil
+	cacheValue.dirty = true
+	cacheValue.deleted = true
 	kvc.cache[string(key)] = cacheValue
 }
 
@@ -113,11 +173,39 @@ func (kvc *KVCache) Get(key []byte) (value []byte) {
 	}
 }
 
+// Merges the cached writes with the underlying store, in order.
+func (kvc *KVCache) Iterator(start, end []byte) Iterator {
+	return NewMergedIterator(kvc.store.Iterator(start, end), kvc.overlay(), start, end, true)
+}
+
+func (kvc *KVCache) ReverseIterator(start, end []byte) Iterator {
+	return NewMergedIterator(kvc.store.ReverseIterator(start, end), kvc.overlay(), start, end, false)
+}
+
+// Cached values, including those cached by Get.
+// Tombstones are nil, which hides the key in the store.
+func (kvc *KVCache) overlay() map[string][]byte {
+	overlay := make(map[string][]byte, len(kvc.cache))
+	for key, cacheValue := range kvc.cache {
+		overlay[key] = cacheValue.v
+	}
+	return overlay
+}
+
+// Writes the sets and deletes to the store in the order they were last made.
+// Values that were only read are not written back.
 func (kvc *KVCache) Sync() {
 	for e := kvc.keys.Front(); e != nil; e = e.Next() {
 		key := e.Value.([]byte)
 		value := kvc.cache[string(key)]
-		kvc.store.Set(key, value.v)
+		if !value.dirty {
+			continue
+		}
+		if value.deleted {
+			kvc.store.Delete(key)
+		} else {
+			kvc.store.Set(key, value.v)
+		}
 	}
 	kvc.Reset()
 }
@@ -0,0 +1,127 @@
+package types
+
+import (
+	"testing"
+)
+
+func collectKeys(itr Iterator) (keys []string) {
+	for ; itr.Valid(); itr.Next() {
+		keys = append(keys, string(itr.Key()))
+	}
+	itr.Close()
+	return keys
+}
+
+func assertKeys(t *testing.T, expected []string, got []string) {
+	if len(expected) != len(got) {
+		t.Fatalf("Expected keys %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if expected[i] != got[i] {
+			t.Fatalf("Expected keys %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestKVCacheIterator(t *testing.T) {
+	store := NewMemKVStore()
+	store.Set([]byte("a/1"), []byte("1"))
+	store.Set([]byte("a/3"), []byte("3"))
+	store.Set([]byte("b/1"), []byte("1"))
+
+	assertKeys(t, []string{"a/1", "a/3"}, collectKeys(PrefixIterator(store, []byte("a/"))))
+
+	cache := NewKVCache(store)
+	cache.Set([]byte("a/2"), []byte("2"))
+	cache.Set([]byte("a/3"), []byte("three"))
+	cache.Get([]byte("a/4")) // cached miss is not a key
+
+	assertKeys(t, []string{"a/1", "a/2", "a/3"}, collectKeys(PrefixIterator(cache, []byte("a/"))))
+	assertKeys(t, []string{"a/3", "a/2", "a/1"}, collectKeys(ReversePrefixIterator(cache, []byte("a/"))))
+	assertKeys(t, []string{"a/2", "a/3"}, collectKeys(cache.Iterator([]byte("a/2"), []byte("b/1"))))
+	assertKeys(t, []string{"a/3", "b/1"}, collectKeys(cache.Iterator([]byte("a/3"), nil)))
+
+	itr := cache.Iterator([]byte("a/3"), []byte("a/4"))
+	if string(itr.Value()) != "three" {
+		t.Fatalf("Expected cached value to shadow the store, got %v", string(itr.Value()))
+	}
+
+	// The store is untouched until Sync
+	assertKeys(t, []string{"a/1", "a/3", "b/1"}, collectKeys(store.Iterator(nil, nil)))
+	cache.Sync()
+	assertKeys(t, []string{"a/1", "a/2", "a/3", "b/1"}, collectKeys(store.Iterator(nil, nil)))
+}
+
+func TestKVCacheDelete(t *testing.T) {
+	store := NewMemKVStore()
+	store.Set([]byte("a"), []byte("1"))
+	store.Set([]byte("b"), []byte("2"))
+
+	// Nest two caches
+	outer := NewKVCache(store)
+	inner := NewKVCache(outer)
+	inner.Delete([]byte("a"))
+	inner.Set([]byte("c"), []byte("3"))
+	if inner.Get([]byte("a")) != nil {
+		t.Fatal("Expected deleted key to be nil")
+	}
+	assertKeys(t, []string{"b", "c"}, collectKeys(inner.Iterator(nil, nil)))
+	assertKeys(t, []string{"a", "b"}, collectKeys(outer.Iterator(nil, nil)))
+
+	// Sync the tombstone into the outer cache only
+	inner.Sync()
+	assertKeys(t, []string{"b", "c"}, collectKeys(outer.Iterator(nil, nil)))
+	assertKeys(t, []string{"a", "b"}, collectKeys(store.Iterator(nil, nil)))
+
+	// Discarded writes never reach the store
+	inner.Set([]byte("d"), []byte("4"))
+	inner.Reset()
+	assertKeys(t, []string{"b", "c"}, collectKeys(inner.Iterator(nil, nil)))
+
+	outer.Sync()
+	assertKeys(t, []string{"b", "c"}, collectKeys(store.Iterator(nil, nil)))
+
+	// Re-setting a deleted key clears the tombstone
+	outer.Delete([]byte("b"))
+	outer.Set([]byte("b"), []byte("5"))
+	outer.Sync()
+	if string(store.Get([]byte("b"))) != "5" {
+		t.Fatalf("Expected b = 5, got %v", store.Get([]byte("b")))
+	}
+}
+
+// Records the writes made to the store.
+type writeRecorder struct {
+	KVStore
+	writes []string
+}
+
+func (wr *writeRecorder) Set(key []byte, value []byte) {
+	wr.writes = append(wr.writes, "set "+string(key)+" "+string(value))
+	wr.KVStore.Set(key, value)
+}
+
+func (wr *writeRecorder) Delete(key []byte) {
+	wr.writes = append(wr.writes, "delete "+string(key))
+	wr.KVStore.Delete(key)
+}
+
+func TestKVCacheSyncWrites(t *testing.T) {
+	store := &writeRecorder{KVStore: NewMemKVStore()}
+	store.Set([]byte("a"), []byte("1"))
+	store.Set([]byte("d"), []byte("4"))
+	store.writes = nil
+
+	// Only the sets and deletes are synced, in the order last made,
+	// not the keys that were only read
+	cache := NewKVCache(store)
+	cache.Get([]byte("a"))
+	cache.Set([]byte("b"), []byte("1"))
+	cache.Set([]byte("c"), []byte("2"))
+	cache.Get([]byte("x"))
+	cache.Delete([]byte("c"))
+	cache.Set([]byte("b"), []byte("3"))
+	cache.Get([]byte("d"))
+	cache.Sync()
+	assertKeys(t, []string{"delete c", "set b 3"}, store.writes)
+}
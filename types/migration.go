@@ -0,0 +1,140 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/tepleton/go-wire"
+)
+
+// A versioned encoding is a version byte followed by the go-wire bytes of
+// the value, so that a decoder knows which schema a value was written
+// with, and a migration can rewrite it to the next one.
+func VersionedBytes(version byte, o interface{}) []byte {
+	return append([]byte{version}, wire.BinaryBytes(o)...)
+}
+
+// Reads bz, written with VersionedBytes, into ptr.
+// Returns an error if bz was written with another version.
+func ReadVersionedBytes(bz []byte, version byte, ptr interface{}) error {
+	if len(bz) == 0 {
+		return errors.New("Missing version byte")
+	}
+	if bz[0] != version {
+		return errors.New(fmt.Sprintf("Expected version %v, got %v", version, bz[0]))
+	}
+	return wire.ReadBinaryBytes(bz[1:], ptr)
+}
+
+//----------------------------------------
+
+// A module's schema version is the number of migrations run on its keys.
+// module is "base", for the accounts and params, or a plugin's name.
+func SchemaVersionKey(module string) []byte {
+	return []byte("base/v/" + url.QueryEscape(module))
+}
+
+// Returns 0 if no migration has run on the module.
+func GetSchemaVersion(store KVReader, module string) (version uint64) {
+	data := store.Get(SchemaVersionKey(module))
+	if len(data) == 0 {
+		return 0
+	}
+	err := wire.ReadBinaryBytes(data, &version)
+	if err != nil {
+		panic(fmt.Sprintf("Error reading schema version of %v %X error: %v", module, data, err.Error()))
+	}
+	return
+}
+
+func SetSchemaVersion(store KVStore, module string, version uint64) {
+	store.Set(SchemaVersionKey(module), wire.BinaryBytes(version))
+}
+
+// Rewrites the value of each key with the prefix, in key order.
+// A nil value from rewrite deletes the key.
+// The keys are collected before any is written, so rewrite may
+// read the store but not iterate it.
+func MigrateKeys(store KVStore, prefix []byte, rewrite func(key, value []byte) ([]byte, error)) error {
+	var keys, values [][]byte
+	iter := PrefixIterator(store, prefix)
+	for ; iter.Valid(); iter.Next() {
+		keys = append(keys, iter.Key())
+		values = append(values, iter.Value())
+	}
+	iter.Close()
+
+	for i, key := range keys {
+		value, err := rewrite(key, values[i])
+		if err != nil {
+			return errors.New(fmt.Sprintf("Migrating key %X: %v", key, err.Error()))
+		}
+		if value == nil {
+			store.Delete(key)
+		} else {
+			store.Set(key, value)
+		}
+	}
+	return nil
+}
+
+//----------------------------------------
+
+// Migration rewrites the keys of a module from one schema version to the
+// next, in the BeginBlock of Height, or of the first block after it if
+// the chain is restarted past it. Every node must register the same
+// migrations, since they change the app hash. A plugin that encodes its
+// keys by schema version learns it with SchemaVersioner.
+type Migration struct {
+	Module  string // "base" or a plugin's name
+	Version uint64 // The module's schema version once it has run
+	Height  uint64 // The height of the block that runs it
+
+	// Migrate gets the app's store for "base", and the plugin's
+	// PluginStore otherwise. An error halts the chain, since
+	// the nodes can't go on without agreeing on the schema.
+	Migrate func(store KVStore) error
+}
+
+type Migrations struct {
+	mlist []Migration
+}
+
+func NewMigrations() *Migrations {
+	return &Migrations{}
+}
+
+// Migrations run in the order they are registered, so each is the next
+// version of its module, and none runs at a lower height than the last.
+func (mgz *Migrations) RegisterMigration(migration Migration) {
+	if migration.Module == "" {
+		panic("Migration module cannot be blank")
+	}
+	if migration.Migrate == nil {
+		panic(fmt.Sprintf("Migration %v of %v has no Migrate", migration.Version, migration.Module))
+	}
+	if latest := mgz.LatestVersion(migration.Module); migration.Version != latest+1 {
+		panic(fmt.Sprintf("Migration %v of %v must follow version %v", migration.Version, migration.Module, latest))
+	}
+	if n := len(mgz.mlist); n > 0 && migration.Height < mgz.mlist[n-1].Height {
+		panic(fmt.Sprintf("Migration %v of %v at height %v is before the last registered, at %v",
+			migration.Version, migration.Module, migration.Height, mgz.mlist[n-1].Height))
+	}
+	mgz.mlist = append(mgz.mlist, migration)
+}
+
+// The schema version of the module once all of its migrations have run,
+// which is what a new chain starts at.
+func (mgz *Migrations) LatestVersion(module string) (version uint64) {
+	for _, migration := range mgz.mlist {
+		if migration.Module == module {
+			version = migration.Version
+		}
+	}
+	return
+}
+
+func (mgz *Migrations) GetList() []Migration {
+	return mgz.mlist
+}
@@ -0,0 +1,96 @@
+package types
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVersionedBytes(t *testing.T) {
+	coins := Coins{{"gold", 5}}
+	bz := VersionedBytes(2, coins)
+	if bz[0] != 2 {
+		t.Fatalf("Expected the version first, got %X", bz)
+	}
+
+	var got Coins
+	if err := ReadVersionedBytes(bz, 2, &got); err != nil || !got.IsEqual(coins) {
+		t.Fatalf("Expected %v, got %v and error %v", coins, got, err)
+	}
+	if err := ReadVersionedBytes(bz, 1, &got); err == nil {
+		t.Fatal("Expected another version to fail")
+	}
+	if err := ReadVersionedBytes(nil, 1, &got); err == nil {
+		t.Fatal("Expected empty bytes to fail")
+	}
+}
+
+func TestMigrateKeys(t *testing.T) {
+	store := NewMemKVStore()
+	store.Set([]byte("a/1"), []byte("one"))
+	store.Set([]byte("a/2"), []byte("two"))
+	store.Set([]byte("a/3"), []byte("three"))
+	store.Set([]byte("b/1"), []byte("other"))
+
+	var order []string
+	err := MigrateKeys(store, []byte("a/"), func(key, value []byte) ([]byte, error) {
+		order = append(order, string(key))
+		if string(value) == "two" {
+			return nil, nil
+		}
+		return append([]byte("new "), value...), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertKeys(t, []string{"a/1", "a/2", "a/3"}, order)
+	assertKeys(t, []string{"a/1", "a/3", "b/1"}, collectKeys(store.Iterator(nil, nil)))
+	if string(store.Get([]byte("a/3"))) != "new three" || string(store.Get([]byte("b/1"))) != "other" {
+		t.Fatal("Expected only the prefixed keys to be rewritten")
+	}
+
+	err = MigrateKeys(store, []byte("a/"), func(key, value []byte) ([]byte, error) {
+		return nil, errors.New("Bad value")
+	})
+	if err == nil {
+		t.Fatal("Expected the error of rewrite")
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	noop := func(store KVStore) error { return nil }
+	mgz := NewMigrations()
+	mgz.RegisterMigration(Migration{"base", 1, 10, noop})
+	mgz.RegisterMigration(Migration{"foo", 1, 10, noop})
+	mgz.RegisterMigration(Migration{"base", 2, 20, noop})
+	if mgz.LatestVersion("base") != 2 || mgz.LatestVersion("foo") != 1 || mgz.LatestVersion("bar") != 0 {
+		t.Fatalf("Expected the latest versions, got %v", mgz.GetList())
+	}
+
+	invalid := map[string]Migration{
+		"skipped version":  {"base", 4, 30, noop},
+		"repeated version": {"foo", 1, 30, noop},
+		"lower height":     {"foo", 2, 15, noop},
+		"no module":        {"", 1, 30, noop},
+		"no migrate":       {"bar", 1, 30, nil},
+	}
+	for name, migration := range invalid {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected a migration with %v to panic", name)
+				}
+			}()
+			mgz.RegisterMigration(migration)
+		}()
+	}
+
+	// SchemaVersion reads the plugin's version
+	root := NewMemKVStore()
+	SetSchemaVersion(root, "foo", 3)
+	if v := NewPluginStore(root, "foo", nil, nil).SchemaVersion(); v != 3 {
+		t.Fatalf("Expected schema version 3, got %v", v)
+	}
+	if v := GetSchemaVersion(root, "bar"); v != 0 {
+		t.Fatalf("Expected schema version 0, got %v", v)
+	}
+}
@@ -2,9 +2,14 @@ package types
 
 import (
 	"fmt"
+
+	"github.com/tepleton/go-events"
+	"github.com/tepleton/go-wire"
 	wrsp "github.com/tepleton/wrsp/types"
 )
 
+// The store handed to each method is the plugin's PluginStore,
+// holding only its own keys.
 type Plugin interface {
 
 	// Name of this plugin, should be short.
@@ -20,35 +25,231 @@ type Plugin interface {
 	EndBlock(store KVStore, height uint64) []*wrsp.Validator
 }
 
+// Querier is optionally implemented by a Plugin to answer
+// queries routed to /plugin/<Name()>/<path>.
+// reqQuery.Path is the remaining "/<path>", and store must not be written.
+// Set resQuery.Key to the store key holding the answer so that
+// proofs can be returned for it. It is returned with the plugin's prefix.
+type Querier interface {
+	Query(store KVStore, reqQuery wrsp.RequestQuery) (resQuery wrsp.ResponseQuery)
+}
+
+// Viewer is optionally implemented by a Plugin that reads the keys of
+// other plugins, through PluginStore.View.
+type Viewer interface {
+	// Names of the plugins whose keys it reads.
+	Views() []string
+}
+
+// GenesisInitializer is optionally implemented by a Plugin to load its
+// section of the genesis document, see app.Genesis. genesis is the JSON of
+// the section, and an error rejects the whole document.
+// Without it, each field of the section is set with SetOption.
+type GenesisInitializer interface {
+	InitGenesis(store KVStore, genesis []byte) error
+}
+
+// GenesisExporter is optionally implemented by a GenesisInitializer to
+// export its state as the section of the genesis document it loads.
+// Without it, the plugin's keys are exported as they are.
+type GenesisExporter interface {
+	ExportGenesis(store KVStore) (genesis []byte, err error)
+}
+
+// SchemaVersioner is optionally implemented by a Plugin that reads and
+// writes its keys in the encoding of its schema version, see Migration.
+// The app sets it when the plugin is registered, and again whenever the
+// version changes, by InitGenesis or a migration.
+type SchemaVersioner interface {
+	SetSchemaVersion(version uint64)
+}
+
+// LegacyKeyOwner is optionally implemented by a Plugin that stored keys at
+// the root of the app's store, before they were under its PluginPrefix,
+// so that a migration can move them there, see app.PluginKeysMigration.
+type LegacyKeyOwner interface {
+	// Whether the plugin wrote key, a root key outside of "base/".
+	OwnsLegacyKey(key []byte) bool
+}
+
 //----------------------------------------
 
 type CallContext struct {
-	CallerAddress []byte   // Caller's Address (hash of PubKey)
-	CallerAccount *Account // Caller's Account, w/ fee & TxInputs deducted
-	Coins         Coins    // The coins that the caller wishes to spend, excluding fees
+	ChainID       string          // The app's chain ID
+	CallerAddress []byte          // Caller's Address (hash of PubKey)
+	CallerAccount *Account        // Caller's Account, w/ fee & TxInputs deducted. Not updated by Bank.
+	GasMeter      *GasMeter       // Gas available for this call, also charged by the store
+	Events        events.Fireable // Plugin events, fired only if the tx succeeds. May be nil.
+	Bank          Bank            // The app's accounts, holding the tx's coins, see Coins
 }
 
-func NewCallContext(callerAddress []byte, callerAccount *Account, coins Coins) CallContext {
+func NewCallContext(chainID string, callerAddress []byte, callerAccount *Account, gasMeter *GasMeter, evc events.Fireable, bank Bank) CallContext {
 	return CallContext{
+		ChainID:       chainID,
 		CallerAddress: callerAddress,
 		CallerAccount: callerAccount,
-		Coins:         coins,
+		GasMeter:      gasMeter,
+		Events:        evc,
+		Bank:          bank,
+	}
+}
+
+// Fires an event on behalf of the plugin.
+// The event is namespaced by the plugin name, see EventStringPlugin.
+func (ctx CallContext) FireEvent(event string, data events.EventData) {
+	if ctx.Events != nil {
+		ctx.Events.FireEvent(event, data)
+	}
+}
+
+// Bank reads accounts for a plugin.
+// Coins only leave an account through a tx's inputs, and only reach one
+// through Send and Refund, out of the tx's coins that the Bank holds, or
+// through PayFromModule, out of the plugin's module account, so a plugin
+// can't create coins. What it doesn't pay out is burned.
+type Bank interface {
+	BankAccounts
+	// The tx's coins not yet paid out, or none outside of a tx.
+	Coins() Coins
+	// Creates the account if it doesn't exist, like a SendTx output.
+	// It's unexported, so only NewBank's and NewTxBank's Banks have it,
+	// and plugins can't call it.
+	credit(addr []byte, coins Coins)
+	// Takes coins out of Coins, or returns false if it doesn't hold them.
+	spend(coins Coins) bool
+}
+
+// BankAccounts is the part of a Bank that the app implements, see NewBank.
+type BankAccounts interface {
+	// Returns nil if the account doesn't exist.
+	GetBalance(addr []byte) Coins
+	// Pays coins to addr out of the plugin's module account.
+	PayFromModule(addr []byte, coins Coins) wrsp.Result
+}
+
+// The Bank of accounts, credited by credit. See state.NewBank.
+func NewBank(accounts BankAccounts, credit func(addr []byte, coins Coins)) Bank {
+	return NewTxBank(accounts, credit, nil)
+}
+
+// Like NewBank, holding coins, the coins a tx sends to a plugin.
+// Only a Bank can pay them out, so a plugin can't add to them.
+func NewTxBank(accounts BankAccounts, credit func(addr []byte, coins Coins), coins Coins) Bank {
+	return bank{accounts, credit, &coins}
+}
+
+type bank struct {
+	BankAccounts
+	addCoins func(addr []byte, coins Coins)
+	coins    *Coins // Shared by the copies of the CallContext
+}
+
+func (b bank) Coins() Coins {
+	return *b.coins
+}
+
+func (b bank) credit(addr []byte, coins Coins) {
+	b.addCoins(addr, coins)
+}
+
+func (b bank) spend(coins Coins) bool {
+	if !b.coins.IsGTE(coins) {
+		return false
 	}
+	*b.coins = b.coins.Minus(coins)
+	return true
+}
+
+// The address of the plugin's module account, where it keeps the coins
+// it holds. Nobody has its key, so only the plugin's Bank can debit it,
+// but anyone can send to it.
+func ModuleAddress(pluginName string) []byte {
+	return wire.BinaryRipemd160("plugin/" + pluginName)
+}
+
+// The coins that the caller wishes to spend, excluding fees,
+// less what has been paid out of them.
+func (ctx *CallContext) Coins() Coins {
+	if ctx.Bank == nil {
+		return nil
+	}
+	return ctx.Bank.Coins()
+}
+
+// Pays coins to addr out of ctx.Coins().
+func (ctx *CallContext) Send(addr []byte, coins Coins) wrsp.Result {
+	if len(addr) == 0 {
+		return wrsp.ErrBaseInvalidInput.AppendLog("Sending to an empty address")
+	}
+	res := ctx.take(coins)
+	if res.IsErr() || coins.IsZero() {
+		return res
+	}
+	ctx.Bank.credit(addr, coins)
+	return wrsp.OK
+}
+
+// Burns coins out of ctx.Coins(), so they aren't refunded.
+func (ctx *CallContext) Burn(coins Coins) wrsp.Result {
+	return ctx.take(coins)
+}
+
+func (ctx *CallContext) take(coins Coins) wrsp.Result {
+	if !coins.IsValid() || !coins.IsNonnegative() {
+		return wrsp.ErrBaseInvalidInput.AppendLog(fmt.Sprintf("Invalid coins %v", coins))
+	}
+	if coins.IsZero() {
+		return wrsp.OK
+	}
+	provided := ctx.Coins()
+	if ctx.Bank == nil || !ctx.Bank.spend(coins) {
+		return wrsp.ErrBaseInsufficientFunds.AppendLog(fmt.Sprintf("Sending %v, only provided %v", coins, provided))
+	}
+	return wrsp.OK
+}
+
+// Pays whatever is left of ctx.Coins() back to the caller.
+// Unneeded if the plugin returns an error, since the AppTx refunds
+// all of the coins then.
+func (ctx *CallContext) Refund() wrsp.Result {
+	coins := ctx.Coins()
+	if coins.IsZero() {
+		return wrsp.OK
+	}
+	return ctx.Send(ctx.CallerAddress, coins)
+}
+
+// Returns the balance of addr, including anything paid to it in this tx.
+func (ctx *CallContext) Balance(addr []byte) Coins {
+	return ctx.Bank.GetBalance(addr)
 }
 
 //----------------------------------------
 
 type Plugins struct {
-	byName map[string]Plugin
-	plist  []Plugin
+	byName   map[string]Plugin
+	plist    []Plugin
+	prefixed bool // Whether their stores are under their PluginPrefix
 }
 
 func NewPlugins() *Plugins {
 	return &Plugins{
-		byName: make(map[string]Plugin),
+		byName:   make(map[string]Plugin),
+		prefixed: true,
 	}
 }
 
+// Whether the stores of pgz.NewPluginStore are under their PluginPrefix,
+// or the whole of the app's store, as before PrefixedKeysVersion.
+// The app sets it from its "base" schema version.
+func (pgz *Plugins) SetPrefixed(prefixed bool) {
+	pgz.prefixed = prefixed
+}
+
+func (pgz *Plugins) IsPrefixed() bool {
+	return pgz.prefixed
+}
+
 func (pgz *Plugins) RegisterPlugin(plugin Plugin) {
 	name := plugin.Name()
 	if name == "" {
@@ -0,0 +1,232 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// The prefix of the named plugin's keys in the app's store.
+// The name is escaped, so no plugin's prefix starts with another's.
+func PluginPrefix(pluginName string) []byte {
+	return []byte("plugin/" + url.QueryEscape(pluginName) + "/")
+}
+
+// The "base" schema version from which each plugin's keys are under its
+// PluginPrefix. Before it, as on chains started before the prefixes,
+// the Plugins' stores are the whole of the app's store, until
+// app.PluginKeysMigration moves their keys. A new chain starts at it.
+const PrefixedKeysVersion = 1
+
+//----------------------------------------
+
+// PrefixStore is the part of a store under a prefix.
+// Its keys are given and iterated without the prefix.
+type PrefixStore struct {
+	store  KVStore
+	prefix []byte
+}
+
+func NewPrefixStore(store KVStore, prefix []byte) *PrefixStore {
+	return &PrefixStore{
+		store:  store,
+		prefix: prefix,
+	}
+}
+
+// The prefix of its keys in the underlying store.
+func (ps *PrefixStore) Prefix() []byte {
+	return ps.prefix
+}
+
+func (ps *PrefixStore) key(key []byte) []byte {
+	pkey := make([]byte, len(ps.prefix), len(ps.prefix)+len(key))
+	copy(pkey, ps.prefix)
+	return append(pkey, key...)
+}
+
+func (ps *PrefixStore) Set(key []byte, value []byte) {
+	ps.store.Set(ps.key(key), value)
+}
+
+func (ps *PrefixStore) Get(key []byte) (value []byte) {
+	return ps.store.Get(ps.key(key))
+}
+
+func (ps *PrefixStore) Delete(key []byte) {
+	ps.store.Delete(ps.key(key))
+}
+
+func (ps *PrefixStore) Iterator(start, end []byte) Iterator {
+	start, end = ps.domain(start, end)
+	return &prefixIterator{ps.store.Iterator(start, end), len(ps.prefix)}
+}
+
+func (ps *PrefixStore) ReverseIterator(start, end []byte) Iterator {
+	start, end = ps.domain(start, end)
+	return &prefixIterator{ps.store.ReverseIterator(start, end), len(ps.prefix)}
+}
+
+// Returns [start, end) in the underlying store.
+// An unbounded end stops at the end of the prefix.
+func (ps *PrefixStore) domain(start, end []byte) ([]byte, []byte) {
+	if end == nil {
+		return ps.key(start), PrefixEndBytes(ps.prefix)
+	}
+	return ps.key(start), ps.key(end)
+}
+
+// Strips the prefix from the keys of its parent.
+type prefixIterator struct {
+	parent Iterator
+	strip  int
+}
+
+func (pi *prefixIterator) Valid() bool {
+	return pi.parent.Valid()
+}
+
+func (pi *prefixIterator) Next() {
+	pi.parent.Next()
+}
+
+func (pi *prefixIterator) Key() []byte {
+	return pi.parent.Key()[pi.strip:]
+}
+
+func (pi *prefixIterator) Value() []byte {
+	return pi.parent.Value()
+}
+
+func (pi *prefixIterator) Close() {
+	pi.parent.Close()
+}
+
+//----------------------------------------
+
+// PluginStore is the store handed to a plugin. It holds only the plugin's
+// own keys, under PluginPrefix(name) of the app's store, unless its
+// Plugins aren't prefixed, see Plugins.SetPrefixed.
+// Accounts are reached through Bank, and the keys of the plugins it
+// declares with Viewer through View.
+type PluginStore struct {
+	*PrefixStore
+	root    KVStore
+	name    string
+	views   []string
+	newBank func(store KVStore, pluginName string) Bank
+	plugins *Plugins // Whose AppStore reaches root, if made by Plugins.NewPluginStore
+}
+
+// newBank makes the Bank over the app's store, see state.NewPluginStore.
+func NewPluginStore(root KVStore, pluginName string, views []string, newBank func(store KVStore, pluginName string) Bank) *PluginStore {
+	return &PluginStore{
+		PrefixStore: NewPrefixStore(root, PluginPrefix(pluginName)),
+		root:        root,
+		name:        pluginName,
+		views:       views,
+		newBank:     newBank,
+	}
+}
+
+// Like NewPluginStore, for a plugin of pgz, so that the holder of pgz
+// can reach the app's store from it with AppStore.
+func (pgz *Plugins) NewPluginStore(root KVStore, pluginName string, views []string, newBank func(store KVStore, pluginName string) Bank) *PluginStore {
+	ps := NewPluginStore(root, pluginName, views, newBank)
+	ps.plugins = pgz
+	ps.PrefixStore = NewPrefixStore(root, ps.prefixOf(pluginName))
+	return ps
+}
+
+// The app's store under store, a PluginStore made with pgz.NewPluginStore.
+// Only the app holds its Plugins, so a plugin can't reach the app's store
+// from its own, and the app decides which plugins may, see state.Host.
+func (pgz *Plugins) AppStore(store KVStore) (KVStore, error) {
+	ps, err := pgz.pluginStore(store)
+	if err != nil {
+		return nil, err
+	}
+	return ps.root, nil
+}
+
+// The named plugin's store in the same app store as store, a PluginStore
+// made with pgz.NewPluginStore, whose Bank is made like store's.
+// It has no views.
+func (pgz *Plugins) SiblingStore(store KVStore, pluginName string) (*PluginStore, error) {
+	ps, err := pgz.pluginStore(store)
+	if err != nil {
+		return nil, err
+	}
+	return pgz.NewPluginStore(ps.root, pluginName, nil, ps.newBank), nil
+}
+
+// Creates coins in addr with the Bank of store, a PluginStore made with
+// pgz.NewPluginStore, so the credit fires the Bank's account event.
+func (pgz *Plugins) Mint(store KVStore, addr []byte, coins Coins) error {
+	ps, err := pgz.pluginStore(store)
+	if err != nil {
+		return err
+	}
+	ps.Bank().credit(addr, coins)
+	return nil
+}
+
+func (pgz *Plugins) pluginStore(store KVStore) (*PluginStore, error) {
+	ps, ok := store.(*PluginStore)
+	if !ok || pgz == nil || ps.plugins != pgz {
+		return nil, errors.New("Not a PluginStore of the app's plugins")
+	}
+	return ps, nil
+}
+
+func (ps *PluginStore) Name() string {
+	return ps.name
+}
+
+// The accounts of the app's store, with the plugin's module account.
+// Within RunTx, the CallContext's Bank is the same, holding the tx's coins.
+func (ps *PluginStore) Bank() Bank {
+	return ps.newBank(ps.root, ps.name)
+}
+
+// The plugin's schema version, so that it reads and writes its keys
+// in the encoding of the last Migration run on them.
+func (ps *PluginStore) SchemaVersion() uint64 {
+	return GetSchemaVersion(ps.root, ps.name)
+}
+
+// A read-only view of the named plugin's keys.
+// Returns an error unless the plugin declared it with Viewer.
+func (ps *PluginStore) View(pluginName string) (KVReader, error) {
+	for _, name := range ps.views {
+		if name == pluginName {
+			return readOnlyStore{NewPrefixStore(ps.root, ps.prefixOf(pluginName))}, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("Plugin %v does not view %v", ps.name, pluginName))
+}
+
+// The prefix of the named plugin's keys in ps.root.
+func (ps *PluginStore) prefixOf(pluginName string) []byte {
+	if ps.plugins != nil && !ps.plugins.prefixed {
+		return nil
+	}
+	return PluginPrefix(pluginName)
+}
+
+// Hides the writes of a store, so a view can't be converted back.
+type readOnlyStore struct {
+	store KVStore
+}
+
+func (ros readOnlyStore) Get(key []byte) (value []byte) {
+	return ros.store.Get(key)
+}
+
+func (ros readOnlyStore) Iterator(start, end []byte) Iterator {
+	return ros.store.Iterator(start, end)
+}
+
+func (ros readOnlyStore) ReverseIterator(start, end []byte) Iterator {
+	return ros.store.ReverseIterator(start, end)
+}
@@ -0,0 +1,73 @@
+package types
+
+import (
+	"testing"
+)
+
+func TestPluginStore(t *testing.T) {
+	root := NewMemKVStore()
+	root.Set([]byte("base/a/1"), []byte("account"))
+	foo := NewPluginStore(root, "foo", []string{"bar"}, nil)
+	bar := NewPluginStore(root, "bar", nil, nil)
+	foo.Set([]byte("a"), []byte("1"))
+	foo.Set([]byte("b"), []byte("2"))
+	bar.Set([]byte("a"), []byte("3"))
+
+	// Each plugin sees only its own keys, without the prefix
+	if string(foo.Get([]byte("a"))) != "1" || string(bar.Get([]byte("a"))) != "3" {
+		t.Fatalf("Expected each plugin's own value, got %v and %v", foo.Get([]byte("a")), bar.Get([]byte("a")))
+	}
+	if foo.Get([]byte("base/a/1")) != nil {
+		t.Fatal("Expected accounts to be out of reach")
+	}
+	assertKeys(t, []string{"a", "b"}, collectKeys(foo.Iterator(nil, nil)))
+	assertKeys(t, []string{"b", "a"}, collectKeys(foo.ReverseIterator(nil, nil)))
+	assertKeys(t, []string{"a"}, collectKeys(foo.Iterator(nil, []byte("b"))))
+	assertKeys(t, []string{"base/a/1", "plugin/bar/a", "plugin/foo/a", "plugin/foo/b"}, collectKeys(root.Iterator(nil, nil)))
+
+	// Names are escaped, so one prefix can't reach into another
+	nested := NewPluginStore(root, "foo/a", nil, nil)
+	if nested.Get(nil) != nil || len(collectKeys(nested.Iterator(nil, nil))) != 0 {
+		t.Fatal("Expected an empty store for plugin foo/a")
+	}
+
+	// Only declared views can be read
+	view, err := foo.View("bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(view.Get([]byte("a"))) != "3" {
+		t.Fatalf("Expected bar's value, got %v", view.Get([]byte("a")))
+	}
+	if _, ok := view.(KVStore); ok {
+		t.Fatal("Expected a read-only view")
+	}
+	if _, err := bar.View("foo"); err == nil {
+		t.Fatal("Expected an undeclared view to fail")
+	}
+
+	// Only the plugins that made a store reach the app's store from it
+	pgz := NewPlugins()
+	if _, err := pgz.AppStore(foo); err == nil {
+		t.Fatal("Expected another PluginStore to fail")
+	}
+	if _, err := NewPlugins().AppStore(pgz.NewPluginStore(root, "foo", nil, nil)); err == nil {
+		t.Fatal("Expected other plugins to fail")
+	}
+	appStore, err := pgz.AppStore(pgz.NewPluginStore(root, "foo", nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	NewPluginStore(appStore, "bar", nil, nil).Set([]byte("c"), []byte("4"))
+	assertKeys(t, []string{"a", "c"}, collectKeys(bar.Iterator(nil, nil)))
+
+	// Unprefixed plugins have the whole of the app's store, as on old chains
+	pgz.SetPrefixed(false)
+	legacy := pgz.NewPluginStore(root, "foo", []string{"bar"}, nil)
+	if string(legacy.Get([]byte("base/a/1"))) != "account" || len(legacy.Prefix()) != 0 {
+		t.Fatal("Expected an unprefixed store")
+	}
+	if view, err := legacy.View("bar"); err != nil || string(view.Get([]byte("plugin/bar/a"))) != "3" {
+		t.Fatal("Expected an unprefixed view")
+	}
+}
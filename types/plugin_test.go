@@ -0,0 +1,62 @@
+package types
+
+import (
+	"testing"
+
+	wrsp "github.com/tepleton/wrsp/types"
+)
+
+type mapBank map[string]Coins
+
+func (mb mapBank) GetBalance(addr []byte) Coins {
+	return mb[string(addr)]
+}
+
+func (mb mapBank) credit(addr []byte, coins Coins) {
+	mb[string(addr)] = mb[string(addr)].Plus(coins)
+}
+
+func (mb mapBank) PayFromModule(addr []byte, coins Coins) wrsp.Result {
+	return wrsp.ErrInternalError
+}
+
+func TestCallContextBank(t *testing.T) {
+	accounts := mapBank{}
+	bank := NewTxBank(accounts, accounts.credit, Coins{{"atom", 6}, {"gold", 3}})
+	caller, other := []byte("caller"), []byte("other")
+	ctx := NewCallContext("test_chain_id", caller, nil, nil, nil, bank)
+
+	if res := ctx.Send(other, Coins{{"gold", 0}}); res.Code != wrsp.CodeType_BaseInvalidInput {
+		t.Fatalf("Expected invalid coins, got %v", res)
+	}
+	if res := ctx.Send(other, Coins{{"gold", 4}}); res.Code != wrsp.CodeType_BaseInsufficientFunds {
+		t.Fatalf("Expected insufficient funds, got %v", res)
+	}
+	if res := ctx.Send(nil, Coins{{"gold", 1}}); res.Code != wrsp.CodeType_BaseInvalidInput {
+		t.Fatalf("Expected invalid address, got %v", res)
+	}
+
+	if res := ctx.Burn(Coins{{"atom", 1}}); res.IsErr() {
+		t.Fatalf("Burn failed: %v", res)
+	}
+	if res := ctx.Send(other, Coins{{"gold", 2}}); res.IsErr() {
+		t.Fatalf("Send failed: %v", res)
+	}
+	if coins := ctx.Coins(); !coins.IsEqual(Coins{{"atom", 5}, {"gold", 1}}) {
+		t.Fatalf("Expected the rest of the coins, got %v", coins)
+	}
+	// Copies of the context share its coins.
+	copied := ctx
+	if res := copied.Refund(); res.IsErr() {
+		t.Fatalf("Refund failed: %v", res)
+	}
+	if coins := ctx.Coins(); !coins.IsZero() {
+		t.Fatalf("Expected no coins left, got %v", coins)
+	}
+	if balance := ctx.Balance(other); !balance.IsEqual(Coins{{"gold", 2}}) {
+		t.Fatalf("Expected 2 gold sent, got %v", balance)
+	}
+	if balance := ctx.Balance(caller); !balance.IsEqual(Coins{{"atom", 5}, {"gold", 1}}) {
+		t.Fatalf("Expected the rest refunded, got %v", balance)
+	}
+}
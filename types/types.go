@@ -84,17 +84,8 @@ type Account struct {
 	Balance  uint64
 }
 
-type PubAccount struct {
-	crypto.PubKey
-	Account
-}
-
 type PrivAccount struct {
 	crypto.PubKey
 	crypto.PrivKey
 	Account
 }
-
-type GenesisState struct {
-	Accounts []PubAccount
-}